@@ -43,7 +43,9 @@ function createTerminal(path) {
   fitAddon.fit();
 
   // create the websocket and connect to the server
-  const ws_uri = "wss://" + window.location.host + path;
+  // use ws:// if a reverse proxy serves the page over plain http
+  const ws_proto = (window.location.protocol === "http:") ? "ws://" : "wss://";
+  const ws_uri = ws_proto + window.location.host + path;
   const socket = new WebSocket(ws_uri);
   socket.binaryType = "arraybuffer";
   const attachAddon = new AttachAddon.AttachAddon(socket);
@@ -80,6 +80,58 @@ function base64ToUint8array(base64) {
   return array;
 }
 
+// names of the special keys in the keystroke overlay
+const keyNames = {
+  "\r": "⏎", "\n": "⏎", "\t": "⇥", "\x7f": "⌫", "\x1b": "Esc",
+  "\x1b[A": "↑", "\x1b[B": "↓", "\x1b[C": "→", "\x1b[D": "←",
+  "\x1b[H": "Home", "\x1b[F": "End", "\x1b[3~": "Del",
+}
+
+// convert the input to readable keys, e.g., ^C for ctrl-c
+function keyLabel(input) {
+  if (input in keyNames) {
+    return keyNames[input]
+  }
+
+  var label = ""
+
+  for (const ch of input) {
+    var code = ch.charCodeAt(0)
+
+    if (ch in keyNames) {
+      label += keyNames[ch]
+    } else if (code < 32) {
+      label += "^" + String.fromCharCode(code + 64)
+    } else {
+      label += ch
+    }
+  }
+
+  return label
+}
+
+var keysTimer
+
+// show the typed keys over the terminal, they fade after a while
+function showKeys(data) {
+  var overlay = document.getElementById("keys_overlay")
+
+  if (!overlay) {
+    return
+  }
+
+  var input = new TextDecoder().decode(data)
+
+  overlay.textContent = (overlay.textContent + " " + keyLabel(input)).slice(-40)
+  overlay.style.visibility = "visible"
+
+  clearTimeout(keysTimer)
+  keysTimer = setTimeout(function () {
+    overlay.style.visibility = "hidden"
+    overlay.textContent = ""
+  }, 1500)
+}
+
 // replay session
 // term: xterm, path: session file to replay,
 // start: start position to replay in percentile, range 0-100
@@ -105,7 +157,15 @@ async function replay_session(term, records, max_wait, total_dur, start, paused,
       }
     }
 
-    term.write(base64ToUint8array(item.Data))
+    if (item.Type == "i") {
+      // only show the keys typed while playing
+      if (cur >= start) {
+        showKeys(base64ToUint8array(item.Data))
+      }
+    } else {
+      term.write(base64ToUint8array(item.Data))
+    }
+
     cur += item.Duration
 
     if (cur > start) {
@@ -127,12 +187,50 @@ function forwardScreen(term, records, end) {
       return
     }
 
-    term.write(base64ToUint8array(item.Data))
+    if (item.Type != "i") {
+      term.write(base64ToUint8array(item.Data))
+    }
     cur += item.Duration
   }
 }
 
 
+// parse the recording. It is a header line followed by one record per
+// line, or a JSON array in the legacy format. The incomplete last record
+// of a crashed session is dropped
+function parseRecording(text) {
+  text = text.trim()
+
+  if (text.startsWith("[")) {
+    try {
+      return JSON.parse(text)
+    } catch (e) {
+      // the closing ] is missing, cut after the last complete record
+      return JSON.parse(text.substring(0, text.lastIndexOf("}") + 1) + "]")
+    }
+  }
+
+  var lines = text.split("\n")
+  var records = []
+
+  // skip the header and the signed end
+  for (var i = 1; i < lines.length; i++) {
+    try {
+      var item = JSON.parse(lines[i])
+
+      if (!("end" in item)) {
+        records.push(item)
+      }
+    } catch (e) {
+      if (i < lines.length - 1) {
+        throw e
+      }
+    }
+  }
+
+  return records
+}
+
 async function fetchAndParse(path, update) {
   var records
   var total_dur = 0
@@ -144,7 +242,7 @@ async function fetchAndParse(path, update) {
     return
   }
 
-  records = await res.json()
+  records = parseRecording(await res.text())
 
   //calculate the total duration
   for (const item of records) {
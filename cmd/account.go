@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+)
+
+// These functions are used by the web server to let users manage their
+// own passwords, and administrators to manage other users.
+
+var ErrWrongPassword = errors.New("current password does not match")
+
+// UserInfo is what the web server needs to know about a user
+type UserInfo struct {
+	Name       string
+	Admin      bool
+	MustChange bool
+	Changed    int64 // when the password is set, see UserRecord
+}
+
+// LookupUser returns the information of the user in user.db
+func LookupUser(username string) (UserInfo, error) {
+	u, err := userStore.Get([]byte(username))
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	return UserInfo{Name: string(u.User), Admin: u.Admin, MustChange: u.MustChange, Changed: u.Changed}, nil
+}
+
+// ListUserInfo returns the information of all the users
+func ListUserInfo() ([]UserInfo, error) {
+	users, err := userStore.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []UserInfo
+	for _, u := range users {
+		infos = append(infos, UserInfo{Name: string(u.User), Admin: u.Admin, MustChange: u.MustChange, Changed: u.Changed})
+	}
+
+	return infos, nil
+}
+
+// update the password of an existing user, check is called with the
+// current record and can reject the update
+func setPassword(username []byte, passwd []byte, mustChange bool, check func(u *UserRecord) error) error {
+	rec := newUserRecord(username, passwd)
+
+	return userStore.Update(func(users []UserRecord) ([]UserRecord, error) {
+		for i, u := range users {
+			if !bytes.Equal(u.User, username) {
+				continue
+			}
+
+			if check != nil {
+				if err := check(&u); err != nil {
+					return nil, err
+				}
+			}
+
+			rec.Admin = u.Admin
+			rec.MustChange = mustChange
+			users[i] = rec
+			return users, nil
+		}
+
+		return nil, ErrUserNotFound
+	})
+}
+
+// ChangePassword changes the password of the user after verifying the current one
+func ChangePassword(username string, current []byte, passwd []byte, policy *PasswordPolicy) error {
+	if err := policy.Check([]byte(username), passwd); err != nil {
+		return err
+	}
+
+	if bytes.Equal(current, passwd) {
+		return errors.New("new password must be different from the current one")
+	}
+
+	return setPassword([]byte(username), passwd, false, func(u *UserRecord) error {
+		if !u.check(current) {
+			return ErrWrongPassword
+		}
+
+		return nil
+	})
+}
+
+// ResetPassword sets the password of the user, optionally forcing the
+// user to change it on next login
+func ResetPassword(username string, passwd []byte, mustChange bool, policy *PasswordPolicy) error {
+	if err := policy.Check([]byte(username), passwd); err != nil {
+		return err
+	}
+
+	return setPassword([]byte(username), passwd, mustChange, nil)
+}
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// This file converts recordings from and to asciicast v2, the format of
+// asciinema (https://docs.asciinema.org/manual/asciicast/v2/). The file
+// is a JSON header line followed by one [time, code, data] event per line,
+// time is in seconds since the start. The code is "o" for the output and
+// "i" for the input.
+
+const FormatAsciicast = "asciicast"
+
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// NewCastHeader returns the header of a witty session started at start
+func NewCastHeader(title string, start time.Time) CastHeader {
+	return CastHeader{
+		Version:   2,
+		Width:     term_conn.TermCols,
+		Height:    term_conn.TermRows,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	}
+}
+
+// WriteCast writes the records as an asciicast v2 file
+func WriteCast(w io.Writer, hdr CastHeader, records []term_conn.WriteRecord) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(hdr); err != nil {
+		return err
+	}
+
+	var elapsed time.Duration
+	var pending []byte // an incomplete UTF-8 sequence split by the pty reads
+
+	for _, r := range records {
+		elapsed += r.Dur
+
+		if r.Type == term_conn.RecordInput {
+			secs := math.Round(elapsed.Seconds()*1e6) / 1e6
+			if err := enc.Encode([]interface{}{secs, "i", string(r.Data)}); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		data := append(pending, r.Data...)
+		pending = nil
+
+		// the data of the events are strings, hold the partial character
+		// back until the rest of it arrives
+		if n := partialRune(data); n > 0 {
+			pending = append([]byte{}, data[len(data)-n:]...)
+			data = data[:len(data)-n]
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		secs := math.Round(elapsed.Seconds()*1e6) / 1e6
+		if err := enc.Encode([]interface{}{secs, "o", string(data)}); err != nil {
+			return err
+		}
+	}
+
+	if len(pending) > 0 {
+		secs := math.Round(elapsed.Seconds()*1e6) / 1e6
+		if err := enc.Encode([]interface{}{secs, "o", string(pending)}); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// the length of the incomplete UTF-8 sequence at the end of data, if any
+func partialRune(data []byte) int {
+	for n := 1; n <= utf8.UTFMax-1 && n <= len(data); n++ {
+		b := data[len(data)-n]
+
+		if b < utf8.RuneSelf {
+			return 0
+		}
+
+		if utf8.RuneStart(b) {
+			if utf8.FullRune(data[len(data)-n:]) {
+				return 0
+			}
+
+			return n
+		}
+	}
+
+	return 0
+}
+
+// ReadCast reads an asciicast v2 file, the output and input events become
+// records. The other events, e.g., markers, are skipped, their time is kept
+func ReadCast(r io.Reader) (CastHeader, []term_conn.WriteRecord, error) {
+	var hdr CastHeader
+	var records []term_conn.WriteRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return hdr, nil, err
+		}
+
+		return hdr, nil, errors.New("empty asciicast file")
+	}
+
+	if err := json.Unmarshal(scanner.Bytes(), &hdr); err != nil {
+		return hdr, nil, fmt.Errorf("invalid asciicast header: %v", err)
+	}
+
+	if hdr.Version != 2 {
+		return hdr, nil, fmt.Errorf("unsupported asciicast version %d, expect 2", hdr.Version)
+	}
+
+	var last float64
+	line := 1
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var event []interface{}
+		if err := json.Unmarshal([]byte(text), &event); err != nil || len(event) != 3 {
+			return hdr, nil, fmt.Errorf("line %d: invalid asciicast event", line)
+		}
+
+		secs, ok1 := event[0].(float64)
+		code, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+
+		if !ok1 || !ok2 || !ok3 || secs < last {
+			return hdr, nil, fmt.Errorf("line %d: invalid asciicast event", line)
+		}
+
+		var typ string
+
+		switch code {
+		case "o":
+			typ = term_conn.RecordOutput
+		case "i":
+			typ = term_conn.RecordInput
+		default:
+			continue
+		}
+
+		records = append(records, term_conn.WriteRecord{
+			Dur:  time.Duration((secs - last) * float64(time.Second)),
+			Data: []byte(data),
+			Type: typ,
+		})
+
+		last = secs
+	}
+
+	return hdr, records, scanner.Err()
+}
+
+// ExportRecord writes the recording in fp to w in the format
+func ExportRecord(w io.Writer, fp *os.File, format string) error {
+	if format != FormatAsciicast {
+		return fmt.Errorf("unknown export format %q, expect %s", format, FormatAsciicast)
+	}
+
+	finfo, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, records, err := term_conn.ReadRecording(fp)
+	if err != nil {
+		return err
+	}
+
+	// legacy recordings have no start time, they are closed at the mod time
+	start := hdr.Start
+	if start.IsZero() {
+		start = finfo.ModTime().Add(-term_conn.Duration(records))
+	}
+
+	title := strings.TrimSuffix(finfo.Name(), filepath.Ext(finfo.Name()))
+	cast := NewCastHeader(title, start)
+	cast.Width, cast.Height = hdr.Width, hdr.Height
+
+	return WriteCast(w, cast, records)
+}
+
+// Export converts the recording fname to output in the format
+func Export(fname string, output string, format string) error {
+	store, name := RecordStoreOf(fname)
+	in, err := store.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	// the output is not a recording, but a link is not followed either
+	fp, err := openRegular(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := ExportRecord(fp, in, format); err != nil {
+		fp.Close()
+		os.Remove(output)
+		return err
+	}
+
+	return fp.Close()
+}
+
+// Import converts the asciicast file fname to the recording output
+func Import(fname string, output string) error {
+	fp, err := openRegular(fname, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer fp.Close()
+
+	cast, records, err := ReadCast(fp)
+	if err != nil {
+		return err
+	}
+
+	hdr := &term_conn.RecordHeader{
+		Version: term_conn.RecordVersion,
+		Width:   cast.Width,
+		Height:  cast.Height,
+		Session: cast.Title,
+	}
+
+	for _, r := range records {
+		if r.Type == term_conn.RecordInput {
+			hdr.Input = true
+			break
+		}
+	}
+
+	if cast.Timestamp > 0 {
+		hdr.Start = time.Unix(cast.Timestamp, 0)
+	}
+
+	var buf bytes.Buffer
+
+	if err := term_conn.WriteRecording(&buf, hdr, records, nil); err != nil {
+		return err
+	}
+
+	store, name := RecordStoreOf(output)
+	out, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if err := SaveRecord(out, &buf); err != nil {
+		store.Remove(name)
+		return err
+	}
+
+	return nil
+}
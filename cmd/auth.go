@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"log"
+)
+
+// Authenticator validates the user name and password of a login attempt.
+// The web server uses it for the login form, so that different password
+// backends can be plugged in with the run flags.
+type Authenticator interface {
+	Authenticate(username []byte, passwd []byte) bool
+
+	// Admin returns whether the user authenticated by the backend is an
+	// administrator
+	Admin(username string) bool
+}
+
+// AuthConfig selects and configures the authentication backend
+type AuthConfig struct {
+	Backend    string `yaml:"backend"`      // one of json, htpasswd, ldap, shadow
+	Htpasswd   string `yaml:"htpasswd"`     // path of the htpasswd file
+	ShadowFile string `yaml:"shadow"`       // path of the shadow file, /etc/shadow by default
+	LdapURL    string `yaml:"ldap_url"`     // ldap://host:port or ldaps://host:port
+	LdapBindDN string `yaml:"ldap_bind_dn"` // DN template for simple bind, %s is the user name
+
+	// the administrators of the htpasswd, ldap and shadow backends, the
+	// roles in user.db only apply to the json backend
+	Admins []string `yaml:"admins"`
+}
+
+const (
+	BackendJson     = "json"
+	BackendHtpasswd = "htpasswd"
+	BackendLdap     = "ldap"
+	BackendShadow   = "shadow"
+
+	defShadowFile = "/etc/shadow"
+)
+
+// jsonAuth uses the user.db managed by adduser/deluser
+type jsonAuth struct{}
+
+func (jsonAuth) Authenticate(username []byte, passwd []byte) bool {
+	return ValidateUser(username, passwd)
+}
+
+func (jsonAuth) Admin(username string) bool {
+	info, err := LookupUser(username)
+	return err == nil && info.Admin
+}
+
+// LocalBackend returns whether the users of the backend are in user.db
+func LocalBackend(a Authenticator) bool {
+	_, ok := a.(jsonAuth)
+	return ok
+}
+
+// the administrators configured for the other backends
+type adminList []string
+
+func (l adminList) Admin(username string) bool {
+	for _, a := range l {
+		if a == username {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewAuthenticator creates the authenticator for the configured backend
+func NewAuthenticator(conf *AuthConfig) (Authenticator, error) {
+	switch conf.Backend {
+	case "", BackendJson:
+		return jsonAuth{}, nil
+
+	case BackendHtpasswd:
+		if conf.Htpasswd == "" {
+			return nil, errors.New("htpasswd backend requires a htpasswd file")
+		}
+
+		return &htpasswdAuth{fname: conf.Htpasswd, adminList: conf.Admins}, nil
+
+	case BackendLdap:
+		l, err := newLdapAuth(conf.LdapURL, conf.LdapBindDN)
+		if err != nil {
+			return nil, err
+		}
+
+		l.adminList = conf.Admins
+		return l, nil
+
+	case BackendShadow:
+		fname := conf.ShadowFile
+		if fname == "" {
+			fname = defShadowFile
+		}
+
+		return &shadowAuth{fname: fname, adminList: conf.Admins}, nil
+	}
+
+	return nil, errors.New("unknown authentication backend " + conf.Backend)
+}
+
+// verify a password against a hash from htpasswd or shadow files
+func verifyHash(hashed string, passwd []byte) bool {
+	ok, err := verifyCrypt(hashed, passwd)
+
+	if err != nil {
+		log.Println("Failed to verify password", err)
+		return false
+	}
+
+	return ok
+}
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// how a recording is stored
+type recordFormat struct {
+	compress string // the compression method, none if not compressed
+	key      string // the ID of the encryption key, empty if not encrypted
+}
+
+// how the uploaded, imported and merged recordings are stored, the same
+// as the recordings of the sessions, see SetRecordFormat
+var (
+	saveCompress = term_conn.CompressNone
+	saveEncrypt  = false
+)
+
+// SetRecordFormat sets the compression and the encryption of the saved
+// recordings, the current key is used to encrypt
+func SetRecordFormat(compress string, encrypt bool) {
+	if compress == "" {
+		compress = term_conn.CompressNone
+	}
+
+	saveCompress, saveEncrypt = compress, encrypt
+}
+
+func saveFormat() (recordFormat, error) {
+	format := recordFormat{compress: saveCompress}
+
+	if saveEncrypt {
+		ring := term_conn.RecordKeys()
+		if ring == nil || ring.Current == "" {
+			return format, errors.New("no current key to encrypt the recording")
+		}
+
+		format.key = ring.Current
+	}
+
+	return format, nil
+}
+
+// SaveRecord stores the recording read from r, in any format, to fp in
+// the format set by SetRecordFormat. The file is closed
+func SaveRecord(fp *os.File, r io.Reader) error {
+	format, err := saveFormat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	_, zr, err := openRecord(r)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	defer zr.Close()
+
+	_, err = writeRecord(fp, zr, format)
+	return err
+}
+
+// ErrLiveRecord is returned for the recordings without the end line, the
+// server may still be writing them and their tail would be lost
+var ErrLiveRecord = errors.New("the recording is not closed, it may still be recorded (use --force if not)")
+
+// the recordings are rewritten byte by byte in the new format, so the
+// signatures stay valid, and the modification time is kept. The
+// recordings that are not closed are skipped unless force is set
+func rewriteRecords(fnames []string, force bool, change func(*recordFormat)) error {
+	failed, skipped := 0, 0
+
+	for _, fname := range fnames {
+		before, after, err := rewriteRecord(fname, force, change)
+
+		switch {
+		case err == ErrLiveRecord:
+			fmt.Println(fname+": skipped,", err)
+			skipped++
+		case err != nil:
+			fmt.Println(fname+": FAILED,", err)
+			failed++
+		case after < 0:
+			fmt.Println(fname + ": unchanged")
+		default:
+			fmt.Printf("%s: %d -> %d bytes\n", fname, before, after)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d recordings failed", failed, len(fnames))
+	}
+
+	if skipped > 0 {
+		return fmt.Errorf("%d of %d recordings skipped", skipped, len(fnames))
+	}
+
+	return nil
+}
+
+// CompressRecords converts the recordings to the compression method in
+// place, none to decompress them. Encrypted recordings stay encrypted.
+// The recordings that are not closed are only converted if force is set
+func CompressRecords(fnames []string, method string, force bool) error {
+	if err := term_conn.ValidCompress(method); err != nil {
+		return err
+	}
+
+	if method == "" {
+		method = term_conn.CompressNone
+	}
+
+	return rewriteRecords(fnames, force, func(format *recordFormat) {
+		format.compress = method
+	})
+}
+
+// EncryptRecords encrypts the recordings in place with the current key,
+// the recordings encrypted with old keys are re-encrypted. If decrypt is
+// set, they are decrypted instead. The recordings that are not closed are
+// only rewritten if force is set, see CompressRecords
+func EncryptRecords(fnames []string, decrypt bool, force bool) error {
+	ring := term_conn.RecordKeys()
+
+	if !decrypt && (ring == nil || ring.Current == "") {
+		return errors.New("no current key to encrypt the recordings")
+	}
+
+	return rewriteRecords(fnames, force, func(format *recordFormat) {
+		if decrypt {
+			format.key = ""
+		} else {
+			format.key = ring.Current
+		}
+	})
+}
+
+// the format of the recording file
+func recordFormatOf(fname string) (recordFormat, error) {
+	fp, err := openRegular(fname, os.O_RDONLY, 0)
+	if err != nil {
+		return recordFormat{}, err
+	}
+
+	defer fp.Close()
+
+	format, zr, err := openRecord(fp)
+	if err != nil {
+		return format, err
+	}
+
+	zr.Close()
+	return format, nil
+}
+
+// open the recording, returns its format and the plain content
+func openRecord(r io.Reader) (recordFormat, io.ReadCloser, error) {
+	var format recordFormat
+	var plain io.Reader
+
+	br := bufio.NewReader(r)
+	format.key = term_conn.EncryptionKey(br)
+	plain = br
+
+	if format.key != "" {
+		dr, err := term_conn.Decrypt(br, term_conn.RecordKeys())
+		if err != nil {
+			return format, nil, err
+		}
+
+		plain = dr
+	}
+
+	pbr := bufio.NewReader(plain)
+	format.compress = term_conn.Compression(pbr)
+
+	zr, err := term_conn.Decompress(pbr)
+	return format, zr, err
+}
+
+// returns the file sizes before and after, after is -1 if nothing is done
+func rewriteRecord(fname string, force bool, change func(*recordFormat)) (int64, int64, error) {
+	// the links are refused, they would be replaced by the file
+	fp, err := openRegular(fname, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer fp.Close()
+
+	// refuse files that are not recordings
+	if _, _, err := term_conn.ReadRecording(fp); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	// the server appends to the live recordings, the rewritten file would
+	// replace them and lose what is recorded after the copy
+	closed, err := term_conn.RecordingClosed(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !closed && !force {
+		return 0, 0, ErrLiveRecord
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	finfo, err := fp.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	format, zr, err := openRecord(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer zr.Close()
+
+	newFormat := format
+	change(&newFormat)
+
+	if newFormat == format {
+		return finfo.Size(), -1, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".tmp*")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// no-op if the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	size, err := writeRecord(tmp, zr, newFormat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := os.Chmod(tmp.Name(), finfo.Mode().Perm()); err != nil {
+		return 0, 0, err
+	}
+
+	// the list of recordings shows the modification time
+	if err := os.Chtimes(tmp.Name(), finfo.ModTime(), finfo.ModTime()); err != nil {
+		return 0, 0, err
+	}
+
+	return finfo.Size(), size, os.Rename(tmp.Name(), fname)
+}
+
+// copy r to the file in the format, the file is closed
+func writeRecord(fp *os.File, r io.Reader, format recordFormat) (int64, error) {
+	defer fp.Close()
+
+	var w io.Writer = fp
+	var enc *term_conn.Encrypter
+
+	if format.key != "" {
+		var err error
+		if enc, err = term_conn.NewEncrypter(fp, term_conn.RecordKeys()); err != nil {
+			return 0, err
+		}
+
+		w = enc
+	}
+
+	cw, err := term_conn.NewCompressor(w, format.compress)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := io.Copy(cw, r); err != nil {
+		return 0, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return 0, err
+	}
+
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := fp.Sync(); err != nil {
+		return 0, err
+	}
+
+	finfo, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return finfo.Size(), nil
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// a recording the server is still writing, it has no end line
+func writeLiveRecord(t *testing.T, dir string, name string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	rw, err := term_conn.NewRecordWriter(&buf, term_conn.NewRecordHeader("session", "alice", nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Add(term_conn.WriteRecord{Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCompressLive(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRecord(t, dir, "closed.scr", "alice")
+	live := writeLiveRecord(t, dir, "live.scr")
+
+	fnames := []string{filepath.Join(dir, "closed.scr"), filepath.Join(dir, "live.scr")}
+
+	if err := CompressRecords(fnames, term_conn.CompressZstd, false); err == nil {
+		t.Fatal("the live recording is not reported")
+	}
+
+	if format, err := recordFormatOf(fnames[0]); err != nil || format.compress != term_conn.CompressZstd {
+		t.Errorf("closed recording: got %+v, %v", format, err)
+	}
+
+	if data, _ := os.ReadFile(fnames[1]); !bytes.Equal(data, live) {
+		t.Error("the live recording is rewritten")
+	}
+
+	// the recording is left by a crash, not by the server
+	if err := CompressRecords(fnames, term_conn.CompressZstd, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if format, err := recordFormatOf(fnames[1]); err != nil || format.compress != term_conn.CompressZstd {
+		t.Errorf("forced: got %+v, %v", format, err)
+	}
+}
+
+func TestEncryptLive(t *testing.T) {
+	dir := t.TempDir()
+
+	ring, err := LoadRecordKeys(filepath.Join(dir, "keys.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer term_conn.SetRecordKeys(term_conn.RecordKeys())
+	term_conn.SetRecordKeys(ring)
+
+	writeTestRecord(t, dir, "closed.scr", "alice")
+	live := writeLiveRecord(t, dir, "live.scr")
+
+	fnames := []string{filepath.Join(dir, "closed.scr"), filepath.Join(dir, "live.scr")}
+
+	if err := EncryptRecords(fnames, false, false); err == nil {
+		t.Fatal("the live recording is not reported")
+	}
+
+	if format, err := recordFormatOf(fnames[0]); err != nil || format.key != ring.Current {
+		t.Errorf("closed recording: got %+v, %v", format, err)
+	}
+
+	if data, _ := os.ReadFile(fnames[1]); !bytes.Equal(data, live) {
+		t.Error("the live recording is rewritten")
+	}
+
+	// the rotation re-encrypts the closed recordings only
+	if ring, err = RotateRecordKey(filepath.Join(dir, "keys.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	term_conn.SetRecordKeys(ring)
+
+	if err := EncryptRecords(fnames, false, false); err == nil {
+		t.Fatal("the live recording is not reported")
+	}
+
+	if format, err := recordFormatOf(fnames[0]); err != nil || format.key != ring.Current {
+		t.Errorf("rotated: got %+v, %v", format, err)
+	}
+
+	if data, _ := os.ReadFile(fnames[1]); !bytes.Equal(data, live) {
+		t.Error("the live recording is rewritten by the rotation")
+	}
+
+	if err := EncryptRecords(fnames, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if format, err := recordFormatOf(fnames[1]); err != nil || format.key != ring.Current {
+		t.Errorf("forced: got %+v, %v", format, err)
+	}
+}
@@ -0,0 +1,377 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This file implements the crypt(3) schemes commonly found in /etc/shadow
+// and Apache htpasswd files. Only verification is supported, we never
+// generate such hashes ourselves.
+
+const (
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	shaCryptDefRounds = 5000
+	shaCryptMinRounds = 1000
+	shaCryptMaxRounds = 999999999
+)
+
+var errUnsupportedHash = errors.New("unsupported password hash format")
+
+// the byte orders used to encode the final digests, see the crypt specs
+var (
+	md5CryptOrder = [][3]int{
+		{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5},
+	}
+
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// encode 3 bytes into n characters of the crypt alphabet
+func crypt64(sb *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+
+	for ; n > 0; n-- {
+		sb.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// md5Crypt implements the BSD $1$ scheme, and Apache's $apr1$ variant
+// which only differs in the magic string.
+func md5Crypt(passwd []byte, magic string, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	alt.Write(passwd)
+	alt.Write([]byte(salt))
+	alt.Write(passwd)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(passwd)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+
+	for pl := len(passwd); pl > 0; pl -= 16 {
+		if pl > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:pl])
+		}
+	}
+
+	for i := len(passwd); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(passwd[:1])
+		}
+	}
+
+	final := ctx.Sum(nil)
+
+	// 1000 rounds to slow down brute force, as the original implementation
+	for i := 0; i < 1000; i++ {
+		ctx = md5.New()
+
+		if i&1 != 0 {
+			ctx.Write(passwd)
+		} else {
+			ctx.Write(final)
+		}
+
+		if i%3 != 0 {
+			ctx.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			ctx.Write(passwd)
+		}
+
+		if i&1 != 0 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(passwd)
+		}
+
+		final = ctx.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(magic + salt + "$")
+
+	for _, o := range md5CryptOrder {
+		crypt64(&sb, final[o[0]], final[o[1]], final[o[2]], 4)
+	}
+
+	crypt64(&sb, 0, 0, final[11], 2)
+	return sb.String()
+}
+
+// repeat the digest until it is exactly n bytes long
+func repeatTo(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+
+	for len(out) < n {
+		if n-len(out) > len(digest) {
+			out = append(out, digest...)
+		} else {
+			out = append(out, digest[:n-len(out)]...)
+		}
+	}
+
+	return out
+}
+
+// shaCrypt implements the $5$ (SHA-256) and $6$ (SHA-512) schemes of glibc.
+// param is the part between the magic and the hash, e.g., rounds=N$salt
+func shaCrypt(passwd []byte, magic string, param string) (string, error) {
+	var newHash func() hash.Hash
+	var order [][3]int
+
+	switch magic {
+	case "$5$":
+		newHash, order = sha256.New, sha256CryptOrder
+	case "$6$":
+		newHash, order = sha512.New, sha512CryptOrder
+	default:
+		return "", errUnsupportedHash
+	}
+
+	rounds := shaCryptDefRounds
+	customRounds := false
+
+	if strings.HasPrefix(param, "rounds=") {
+		idx := strings.Index(param, "$")
+		if idx < 0 {
+			return "", errUnsupportedHash
+		}
+
+		n, err := strconv.Atoi(param[len("rounds="):idx])
+		if err != nil {
+			return "", errUnsupportedHash
+		}
+
+		if n < shaCryptMinRounds {
+			n = shaCryptMinRounds
+		} else if n > shaCryptMaxRounds {
+			n = shaCryptMaxRounds
+		}
+
+		rounds, customRounds = n, true
+		param = param[idx+1:]
+	}
+
+	salt := []byte(param)
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	ctxB := newHash()
+	ctxB.Write(passwd)
+	ctxB.Write(salt)
+	ctxB.Write(passwd)
+	sumB := ctxB.Sum(nil)
+
+	ctxA := newHash()
+	ctxA.Write(passwd)
+	ctxA.Write(salt)
+
+	cnt := len(passwd)
+	for ; cnt > len(sumB); cnt -= len(sumB) {
+		ctxA.Write(sumB)
+	}
+	ctxA.Write(sumB[:cnt])
+
+	for cnt = len(passwd); cnt > 0; cnt >>= 1 {
+		if cnt&1 != 0 {
+			ctxA.Write(sumB)
+		} else {
+			ctxA.Write(passwd)
+		}
+	}
+
+	sumA := ctxA.Sum(nil)
+
+	ctxDP := newHash()
+	for i := 0; i < len(passwd); i++ {
+		ctxDP.Write(passwd)
+	}
+	seqP := repeatTo(ctxDP.Sum(nil), len(passwd))
+
+	ctxDS := newHash()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ctxDS.Write(salt)
+	}
+	seqS := repeatTo(ctxDS.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		ctxC := newHash()
+
+		if i&1 != 0 {
+			ctxC.Write(seqP)
+		} else {
+			ctxC.Write(sumA)
+		}
+
+		if i%3 != 0 {
+			ctxC.Write(seqS)
+		}
+
+		if i%7 != 0 {
+			ctxC.Write(seqP)
+		}
+
+		if i&1 != 0 {
+			ctxC.Write(sumA)
+		} else {
+			ctxC.Write(seqP)
+		}
+
+		sumA = ctxC.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(magic)
+
+	if customRounds {
+		sb.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+
+	sb.Write(salt)
+	sb.WriteString("$")
+
+	for _, o := range order {
+		crypt64(&sb, sumA[o[0]], sumA[o[1]], sumA[o[2]], 4)
+	}
+
+	if magic == "$5$" {
+		crypt64(&sb, 0, sumA[31], sumA[30], 3)
+	} else {
+		crypt64(&sb, 0, 0, sumA[63], 2)
+	}
+
+	return sb.String(), nil
+}
+
+// verifyCrypt checks the password against a crypt(3) style hash
+func verifyCrypt(hashed string, passwd []byte) (bool, error) {
+	var computed string
+	var err error
+
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"),
+		strings.HasPrefix(hashed, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), passwd) == nil, nil
+
+	case strings.HasPrefix(hashed, "$1$"), strings.HasPrefix(hashed, "$apr1$"):
+		magic := hashed[:strings.Index(hashed[1:], "$")+2]
+		salt := hashed[len(magic):]
+
+		if idx := strings.Index(salt, "$"); idx >= 0 {
+			salt = salt[:idx]
+		}
+
+		computed = md5Crypt(passwd, magic, salt)
+
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		param := hashed[3:]
+
+		if idx := strings.LastIndex(param, "$"); idx >= 0 {
+			param = param[:idx]
+		}
+
+		computed, err = shaCrypt(passwd, hashed[:3], param)
+
+		if err != nil {
+			return false, err
+		}
+
+	default:
+		return false, errUnsupportedHash
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+}
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// checkCrypt checks that the hash is well formed in a supported scheme,
+// so that the passwords can be verified against it
+func checkCrypt(hashed string) error {
+	if strings.HasPrefix(hashed, "$2a$") || strings.HasPrefix(hashed, "$2b$") ||
+		strings.HasPrefix(hashed, "$2y$") {
+		if _, err := bcrypt.Cost([]byte(hashed)); err != nil {
+			return errMalformedHash
+		}
+
+		return nil
+	}
+
+	var computed string
+	var err error
+
+	switch {
+	case strings.HasPrefix(hashed, "$1$"), strings.HasPrefix(hashed, "$apr1$"):
+		magic := hashed[:strings.Index(hashed[1:], "$")+2]
+		salt := hashed[len(magic):]
+
+		if idx := strings.Index(salt, "$"); idx >= 0 {
+			salt = salt[:idx]
+		}
+
+		computed = md5Crypt(nil, magic, salt)
+
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		param := hashed[3:]
+
+		if idx := strings.LastIndex(param, "$"); idx >= 0 {
+			param = param[:idx]
+		}
+
+		if computed, err = shaCrypt(nil, hashed[:3], param); err != nil {
+			return err
+		}
+
+	default:
+		return errUnsupportedHash
+	}
+
+	// the same parameters and a digest of the same length in the alphabet
+	idx := strings.LastIndex(computed, "$")
+
+	if len(hashed) != len(computed) || hashed[:idx] != computed[:idx] {
+		return errMalformedHash
+	}
+
+	for _, c := range hashed[idx+1:] {
+		if !strings.ContainsRune(cryptAlphabet, c) {
+			return errMalformedHash
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the hashes are made by openssl passwd
+var cryptVectors = []struct {
+	passwd string
+	hashed string
+}{
+	{"Hello world!", "$1$saltstri$YMyguxXMBpd2TEZ.vS/3q1"},
+	{"Hello world!", "$apr1$saltstri$aGfuB7Lcvs2TUeFTqUVfN0"},
+	{"Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+	{"Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+	{"This is just a test", "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+	{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+}
+
+func TestVerifyCrypt(t *testing.T) {
+	for _, v := range cryptVectors {
+		ok, err := verifyCrypt(v.hashed, []byte(v.passwd))
+		if err != nil || !ok {
+			t.Errorf("%s: got %v, %v, expect a match", v.hashed, ok, err)
+		}
+
+		if ok, _ := verifyCrypt(v.hashed, []byte(v.passwd+"x")); ok {
+			t.Errorf("%s: a wrong password matches", v.hashed)
+		}
+
+		if err := checkCrypt(v.hashed); err != nil {
+			t.Errorf("%s: %v", v.hashed, err)
+		}
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("Hello world!"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := verifyCrypt(string(hashed), []byte("Hello world!")); err != nil || !ok {
+		t.Errorf("bcrypt: got %v, %v, expect a match", ok, err)
+	}
+
+	if ok, _ := verifyCrypt(string(hashed), []byte("hello world!")); ok {
+		t.Error("bcrypt: a wrong password matches")
+	}
+
+	if err := checkCrypt(string(hashed)); err != nil {
+		t.Errorf("bcrypt: %v", err)
+	}
+}
+
+func TestCheckCrypt(t *testing.T) {
+	malformed := []string{
+		"$1$saltstri$YMyguxXMBpd2TEZ.vS/3q",   // too short
+		"$1$saltstri$YMyguxXMBpd2TEZ.vS/3q1x", // too long
+		"$1$saltstri$YMyguxXMBpd2TEZ.vS/3q!",  // not in the alphabet
+		"$5$saltstring$",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz",
+		"$6$rounds=10000$saltstringsaltstring$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		"$2a$10$short",
+		"$2b$99$" + "abcdefghijklmnopqrstuvabcdefghijklmnopqrstuvwxyz01234",
+	}
+
+	for _, hashed := range malformed {
+		if err := checkCrypt(hashed); err == nil {
+			t.Errorf("%s: expect an error", hashed)
+		}
+	}
+
+	for _, hashed := range []string{"", "plain", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "$y$j9T$salt$hash"} {
+		if err := checkCrypt(hashed); err != errUnsupportedHash {
+			t.Errorf("%q: got %v, expect errUnsupportedHash", hashed, err)
+		}
+
+		if _, err := verifyCrypt(hashed, []byte("x")); err != errUnsupportedHash {
+			t.Errorf("%q: got %v, expect errUnsupportedHash", hashed, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultCertHosts are the names in a generated certificate if none is
+// given: this host, and the loopback addresses
+func DefaultCertHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+	if name, err := os.Hostname(); err == nil && name != "localhost" {
+		hosts = append([]string{name}, hosts...)
+	}
+
+	return hosts
+}
+
+// GenCert creates a self-signed ECDSA certificate for the hosts, which
+// can be DNS names or IP addresses. Existing files are only replaced
+// if force is set
+func GenCert(certFile string, keyFile string, hosts []string, days int, force bool) error {
+	if len(hosts) == 0 {
+		return errors.New("the certificate needs at least one host")
+	}
+
+	if days <= 0 {
+		return errors.New("the certificate must be valid for at least one day")
+	}
+
+	if !force {
+		for _, fname := range []string{certFile, keyFile} {
+			if _, err := os.Stat(fname); err == nil {
+				return fmt.Errorf("%s already exists, use -force to replace it", fname)
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	templ := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"WiTTY"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour), // tolerate clock skew of the clients
+		NotAfter:              now.Add(time.Duration(days) * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			templ.IPAddresses = append(templ.IPAddresses, ip)
+		} else {
+			templ.DNSNames = append(templ.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &templ, &templ, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, fname := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+			return err
+		}
+	}
+
+	// write the key first, the server only reloads when the cert changes
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := AtomicWriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return AtomicWriteFile(certFile, certPem, 0644)
+}
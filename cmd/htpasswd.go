@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"os"
+	"strings"
+)
+
+// htpasswdAuth validates users against an Apache htpasswd file.
+// The file is read on every login so that htpasswd edits take
+// effect immediately, same as user.db.
+type htpasswdAuth struct {
+	fname string
+	adminList
+}
+
+func (h *htpasswdAuth) Authenticate(username []byte, passwd []byte) bool {
+	fp, err := os.Open(h.fname)
+
+	if err != nil {
+		log.Println("Failed to open htpasswd file", err)
+		return false
+	}
+
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idx := strings.Index(line, ":")
+		if idx < 0 || line[:idx] != string(username) {
+			continue
+		}
+
+		hashed := line[idx+1:]
+
+		// {SHA} is the unsalted SHA1 of the password, base64 encoded
+		if strings.HasPrefix(hashed, "{SHA}") {
+			sum := sha1.Sum(passwd)
+			computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+			return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+		}
+
+		return verifyHash(hashed, passwd)
+	}
+
+	return false
+}
@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapAuth validates users with a LDAP simple bind. The user DN is built
+// from a template, e.g., uid=%s,ou=people,dc=example,dc=com. We only need
+// the bind operation, so a tiny BER encoder is used instead of a full
+// LDAP library.
+type ldapAuth struct {
+	addr   string
+	useTLS bool
+	host   string
+	bindDN string
+	adminList
+}
+
+const (
+	ldapTimeout = 10 * time.Second
+
+	berSequence    = 0x30
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+
+	ldapBindRequest   = 0x60 // [APPLICATION 0], constructed
+	ldapBindResponse  = 0x61 // [APPLICATION 1], constructed
+	ldapUnbindRequest = 0x42 // [APPLICATION 2], primitive
+	ldapSimpleAuth    = 0x80 // [0], primitive
+)
+
+func newLdapAuth(rawURL string, bindDN string) (*ldapAuth, error) {
+	if rawURL == "" || bindDN == "" {
+		return nil, errors.New("ldap backend requires both url and bind DN")
+	}
+
+	if !strings.Contains(bindDN, "%s") {
+		return nil, errors.New("ldap bind DN must contain %s for the user name")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ldapAuth{host: u.Hostname(), bindDN: bindDN}
+	port := u.Port()
+
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		l.useTLS = true
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, errors.New("unsupported ldap url scheme " + u.Scheme)
+	}
+
+	l.addr = net.JoinHostPort(l.host, port)
+	return l, nil
+}
+
+func (l *ldapAuth) Authenticate(username []byte, passwd []byte) bool {
+	// an empty password is an unauthenticated bind, which always succeeds
+	if len(username) == 0 || len(passwd) == 0 {
+		return false
+	}
+
+	dn := strings.Replace(l.bindDN, "%s", escapeDN(string(username)), 1)
+
+	if err := l.bind(dn, passwd); err != nil {
+		log.Println("LDAP bind failed for", dn, err)
+		return false
+	}
+
+	return true
+}
+
+func (l *ldapAuth) bind(dn string, passwd []byte) error {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+
+	if l.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", l.addr, &tls.Config{ServerName: l.host})
+	} else {
+		conn, err = dialer.Dial("tcp", l.addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	req := berTLV(berSequence,
+		berTLV(berInteger, []byte{1}),
+		berTLV(ldapBindRequest,
+			berTLV(berInteger, []byte{3}), // LDAPv3
+			berTLV(berOctetString, []byte(dn)),
+			berTLV(ldapSimpleAuth, passwd)))
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(conn)
+
+	tag, msg, err := berRead(rd)
+	if err != nil {
+		return err
+	}
+
+	if tag != berSequence {
+		return errors.New("malformed ldap response")
+	}
+
+	// skip the message ID, then look into the bind response
+	_, _, rest, err := berNext(msg)
+	if err != nil {
+		return err
+	}
+
+	tag, resp, _, err := berNext(rest)
+	if err != nil {
+		return err
+	}
+
+	if tag != ldapBindResponse {
+		return fmt.Errorf("unexpected ldap response %#x", tag)
+	}
+
+	tag, code, _, err := berNext(resp)
+	if err != nil {
+		return err
+	}
+
+	if tag != berEnumerated || len(code) != 1 {
+		return errors.New("malformed ldap result code")
+	}
+
+	// be nice and unbind before we close the connection
+	conn.Write(berTLV(berSequence, berTLV(berInteger, []byte{2}), berTLV(ldapUnbindRequest)))
+
+	if code[0] != 0 {
+		return fmt.Errorf("ldap result code %d", code[0])
+	}
+
+	return nil
+}
+
+// encode a tag-length-value with the definite length form
+func berTLV(tag byte, values ...[]byte) []byte {
+	var body []byte
+	for _, v := range values {
+		body = append(body, v...)
+	}
+
+	out := []byte{tag}
+	n := len(body)
+
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	return append(out, body...)
+}
+
+// read one tag-length-value from the reader
+func berRead(rd *bufio.Reader) (byte, []byte, error) {
+	tag, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := int(n)
+
+	if n&0x80 != 0 {
+		cnt := int(n & 0x7f)
+		if cnt == 0 || cnt > 3 {
+			return 0, nil, errors.New("unsupported ber length")
+		}
+
+		length = 0
+		for i := 0; i < cnt; i++ {
+			b, err := rd.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+
+			length = length<<8 | int(b)
+		}
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return 0, nil, err
+	}
+
+	return tag, buf, nil
+}
+
+// split the first tag-length-value from buf, returns its value and the rest
+func berNext(buf []byte) (byte, []byte, []byte, error) {
+	if len(buf) < 2 {
+		return 0, nil, nil, errors.New("truncated ber data")
+	}
+
+	tag, n := buf[0], buf[1]
+	length, hdr := int(n), 2
+
+	if n&0x80 != 0 {
+		cnt := int(n & 0x7f)
+		if cnt == 0 || cnt > 3 || len(buf) < 2+cnt {
+			return 0, nil, nil, errors.New("unsupported ber length")
+		}
+
+		length = 0
+		for _, b := range buf[2 : 2+cnt] {
+			length = length<<8 | int(b)
+		}
+
+		hdr += cnt
+	}
+
+	if len(buf) < hdr+length {
+		return 0, nil, nil, errors.New("truncated ber data")
+	}
+
+	return tag, buf[hdr : hdr+length], buf[hdr+length:], nil
+}
+
+// escape the special characters of a DN attribute value (RFC 4514)
+func escapeDN(val string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == 0:
+			sb.WriteString("\\00")
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(val)-1:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
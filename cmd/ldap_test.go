@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testBindDN = "uid=%s,ou=people,dc=example,dc=com"
+
+// a stand-in LDAP server, it accepts the bind of passwords[dn], or sends
+// the reply if not nil. The bind DNs are sent to binds
+func ldapServer(t *testing.T, passwords map[string]string, reply []byte) (string, chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+	binds := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+
+				tag, msg, err := berRead(rd)
+				if err != nil || tag != berSequence {
+					t.Errorf("bad request %#x, %v", tag, err)
+					return
+				}
+
+				_, id, rest, _ := berNext(msg)
+				tag, req, _, _ := berNext(rest)
+				if tag != ldapBindRequest {
+					t.Errorf("expect a bind request, got %#x", tag)
+					return
+				}
+
+				_, version, req, _ := berNext(req)
+				_, dn, req, _ := berNext(req)
+				tag, passwd, _, err := berNext(req)
+
+				if err != nil || len(version) != 1 || version[0] != 3 || tag != ldapSimpleAuth {
+					t.Errorf("bad bind request, version %v, auth %#x, %v", version, tag, err)
+					return
+				}
+
+				binds <- string(dn)
+
+				// the client waits for the rest of a truncated reply
+				if reply != nil {
+					conn.Write(reply)
+					return
+				}
+
+				code := byte(49) // invalidCredentials
+				if p, ok := passwords[string(dn)]; ok && p == string(passwd) {
+					code = 0
+				}
+
+				conn.Write(berTLV(berSequence, berTLV(berInteger, id),
+					berTLV(ldapBindResponse,
+						berTLV(berEnumerated, []byte{code}),
+						berTLV(berOctetString),
+						berTLV(berOctetString))))
+
+				// the client unbinds if the response was understood
+				if tag, _, err := berRead(rd); err == nil && tag != berSequence {
+					t.Errorf("expect an unbind request, got %#x", tag)
+				}
+			}()
+		}
+	}()
+
+	return "ldap://" + ln.Addr().String(), binds
+}
+
+func TestLdapBind(t *testing.T) {
+	long := strings.Repeat("p", 300) // the length takes two bytes
+	passwords := map[string]string{
+		"uid=alice,ou=people,dc=example,dc=com":   "Passw0rd!xyz",
+		`uid=a\,b\+c,ou=people,dc=example,dc=com`: "secret",
+		"uid=bob,ou=people,dc=example,dc=com":     long,
+	}
+
+	url, binds := ldapServer(t, passwords, nil)
+
+	auth, err := newLdapAuth(url, testBindDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user   string
+		passwd string
+		ok     bool
+		dn     string
+	}{
+		{"alice", "Passw0rd!xyz", true, "uid=alice,ou=people,dc=example,dc=com"},
+		{"alice", "wrong", false, "uid=alice,ou=people,dc=example,dc=com"},
+		{"a,b+c", "secret", true, `uid=a\,b\+c,ou=people,dc=example,dc=com`},
+		{"bob", long, true, "uid=bob,ou=people,dc=example,dc=com"},
+		{"bob", long[1:], false, "uid=bob,ou=people,dc=example,dc=com"},
+	}
+
+	for _, tt := range tests {
+		if ok := auth.Authenticate([]byte(tt.user), []byte(tt.passwd)); ok != tt.ok {
+			t.Errorf("%s: got %v, expect %v", tt.user, ok, tt.ok)
+		}
+
+		if dn := <-binds; dn != tt.dn {
+			t.Errorf("%s: bound as %s, expect %s", tt.user, dn, tt.dn)
+		}
+	}
+
+	// an unauthenticated bind would succeed, it is not even tried
+	if auth.Authenticate([]byte("alice"), nil) {
+		t.Error("empty password accepted")
+	}
+
+	select {
+	case dn := <-binds:
+		t.Errorf("bound as %s with an empty password", dn)
+	default:
+	}
+}
+
+func TestLdapBadResponse(t *testing.T) {
+	replies := [][]byte{
+		{berSequence, 0x05, 0x02, 0x01},                                                                  // truncated
+		berTLV(berSequence, berTLV(berInteger, []byte{1}), berTLV(0x65)),                                 // search done
+		berTLV(berSequence, berTLV(berInteger, []byte{1}), berTLV(ldapBindResponse, berTLV(berInteger))), // no result code
+	}
+
+	for i, reply := range replies {
+		url, _ := ldapServer(t, nil, reply)
+
+		auth, err := newLdapAuth(url, testBindDN)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if auth.Authenticate([]byte("alice"), []byte("Passw0rd!xyz")) {
+			t.Errorf("reply %d: accepted", i)
+		}
+	}
+}
+
+func TestNewLdapAuth(t *testing.T) {
+	tests := []struct {
+		url  string
+		dn   string
+		addr string
+		tls  bool
+	}{
+		{"ldap://ldap.example.com", testBindDN, "ldap.example.com:389", false},
+		{"ldaps://ldap.example.com", testBindDN, "ldap.example.com:636", true},
+		{"ldaps://[::1]:1636", testBindDN, "[::1]:1636", true},
+		{"http://ldap.example.com", testBindDN, "", false},
+		{"ldap://ldap.example.com", "uid=alice,dc=example,dc=com", "", false},
+		{"", testBindDN, "", false},
+	}
+
+	for _, tt := range tests {
+		auth, err := newLdapAuth(tt.url, tt.dn)
+
+		if tt.addr == "" {
+			if err == nil {
+				t.Errorf("%s %s: expect an error", tt.url, tt.dn)
+			}
+
+			continue
+		}
+
+		if err != nil || auth.addr != tt.addr || auth.useTLS != tt.tls {
+			t.Errorf("%s: got %+v, %v", tt.url, auth, err)
+		}
+	}
+}
@@ -1,45 +1,59 @@
 package cmd
 
 import (
-	"encoding/json"
+	"bytes"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/syssecfsu/witty/term_conn"
 )
 
+// Merge concatenates the recordings, in either format, into a new
+// recording with the header of the first one
 func Merge(fnames []string, output string) {
 	var all_recrods []term_conn.WriteRecord
-	var records []term_conn.WriteRecord
+	var header *term_conn.RecordHeader
 
 	for _, fname := range fnames {
-		file, err := os.ReadFile(fname)
+		store, name := RecordStoreOf(fname)
+		hdr, records, err := store.Read(name)
+
 		if err != nil {
-			log.Println("Failed to read users file", err)
+			log.Println("Failed to read recording", err, "for", fname)
 			return
 		}
 
-		err = json.Unmarshal(file, &records)
-
-		if err != nil {
-			log.Println("Failed to parse json format", err, "for", fname)
-			return
+		if header == nil {
+			header = hdr
 		}
 
 		all_recrods = append(all_recrods, records...)
 	}
 
-	data, err := json.Marshal(all_recrods)
+	header.Version = term_conn.RecordVersion
 
-	if err != nil {
-		log.Println("Failed to merge into JSON format", err)
+	if !strings.HasSuffix(output, RecordExt) {
+		output += RecordExt
+	}
+
+	var buf bytes.Buffer
+
+	if err := term_conn.WriteRecording(&buf, header, all_recrods, nil); err != nil {
+		log.Println("Failed to write merged file", err)
 		return
 	}
 
-	if !strings.HasSuffix(output, ".scr") {
-		output += ".scr"
+	// an existing recording is not replaced
+	store, name := RecordStoreOf(output)
+	fp, err := store.Create(name)
+
+	if err != nil {
+		log.Println("Failed to create merged file", err)
+		return
 	}
 
-	os.WriteFile(output, data, 0664)
+	// compressed and encrypted like the recordings of the sessions
+	if err := SaveRecord(fp, &buf); err != nil {
+		log.Println("Failed to write merged file", err)
+	}
 }
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+// PasswordPolicy are the rules new passwords must follow
+type PasswordPolicy struct {
+	MinLength     int  `yaml:"min_length"`     // minimal length in bytes
+	MaxLength     int  `yaml:"max_length"`     // maximal length in bytes, 0 for no limit
+	MinClasses    int  `yaml:"min_classes"`    // how many of lower, upper, digit, and other are required
+	AllowUsername bool `yaml:"allow_username"` // whether the password can contain the user name
+}
+
+// DefaultPolicy is the policy witty has always used
+var DefaultPolicy = PasswordPolicy{
+	MinLength:     12,
+	AllowUsername: true,
+}
+
+// count the character classes in the password
+func charClasses(passwd []byte) int {
+	var lower, upper, digit, other int
+
+	for _, r := range string(passwd) {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	return lower + upper + digit + other
+}
+
+// Check returns an error explaining why the password is rejected
+func (p *PasswordPolicy) Check(username []byte, passwd []byte) error {
+	if len(passwd) < p.MinLength {
+		return fmt.Errorf("password too short, at least %d bytes", p.MinLength)
+	}
+
+	if p.MaxLength > 0 && len(passwd) > p.MaxLength {
+		return fmt.Errorf("password too long, at most %d bytes", p.MaxLength)
+	}
+
+	if n := charClasses(passwd); n < p.MinClasses {
+		return fmt.Errorf("password needs %d of lower case, upper case, digit, and other characters", p.MinClasses)
+	}
+
+	if !p.AllowUsername && len(username) > 0 &&
+		bytes.Contains(bytes.ToLower(passwd), bytes.ToLower(username)) {
+		return errors.New("password cannot contain the user name")
+	}
+
+	return nil
+}
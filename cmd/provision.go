@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file supports provisioning users without a terminal, e.g., from
+// Ansible or a Dockerfile. Password hashes are exchanged as strings:
+// witty's own salted SHA256 is written as $witty$<base64 seed>$<hex hash>,
+// other hashes are in the crypt(3) formats understood by verifyCrypt.
+
+const (
+	wittyHashPrefix = "$witty$"
+
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// the user and password pair in import and export files. Either
+// Passwd or Hash is set for import, export only writes Hash.
+type userEntry struct {
+	User   string `json:"username"`
+	Passwd string `json:"password,omitempty"`
+	Hash   string `json:"password_hash,omitempty"`
+	Admin  *bool  `json:"admin,omitempty"` // nil keeps the role of existing users
+
+	line int // the line in the csv file, 0 for json
+}
+
+// read the password from the first line of the reader
+func readPasswdLine(rd io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(rd).ReadString('\n')
+
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, errors.New("no password on stdin")
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// encode the password hash of the record as a string
+func (u *UserRecord) hashString() string {
+	if u.Hash != "" {
+		return u.Hash
+	}
+
+	return wittyHashPrefix + base64.StdEncoding.EncodeToString(u.Seed) + "$" + hex.EncodeToString(u.Passwd[:])
+}
+
+// create the record from a pre-hashed password
+func recordFromHash(username []byte, hashed string) (UserRecord, error) {
+	if strings.HasPrefix(hashed, wittyHashPrefix) {
+		parts := strings.Split(hashed[len(wittyHashPrefix):], "$")
+
+		if len(parts) != 2 {
+			return UserRecord{}, errors.New("malformed witty password hash")
+		}
+
+		seed, err1 := base64.StdEncoding.DecodeString(parts[0])
+		sum, err2 := hex.DecodeString(parts[1])
+
+		if err1 != nil || err2 != nil || len(sum) != 32 {
+			return UserRecord{}, errors.New("malformed witty password hash")
+		}
+
+		rec := UserRecord{User: username, Seed: seed, Changed: time.Now().UnixNano()}
+		copy(rec.Passwd[:], sum)
+		return rec, nil
+	}
+
+	// make sure we can verify the hash before accepting it
+	if err := checkCrypt(hashed); err != nil {
+		return UserRecord{}, err
+	}
+
+	return UserRecord{User: username, Hash: hashed, Changed: time.Now().UnixNano()}, nil
+}
+
+func readEntries(rd io.Reader, format string) ([]userEntry, error) {
+	var entries []userEntry
+
+	switch format {
+	case FormatJSON:
+		if err := json.NewDecoder(rd).Decode(&entries); err != nil {
+			return nil, err
+		}
+
+	case FormatCSV:
+		cr := csv.NewReader(rd)
+
+		var rows [][]string
+		var lines []int
+
+		for {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			line, _ := cr.FieldPos(0)
+			rows = append(rows, row)
+			lines = append(lines, line)
+		}
+
+		if len(rows) == 0 {
+			return nil, nil
+		}
+
+		// the header tells which column is which
+		cols := make(map[string]int)
+		for i, name := range rows[0] {
+			cols[strings.TrimSpace(name)] = i
+		}
+
+		if _, ok := cols["username"]; !ok {
+			return nil, errors.New("csv header must have a username column")
+		}
+
+		field := func(row []string, name string) string {
+			if i, ok := cols[name]; ok && i < len(row) {
+				return row[i]
+			}
+
+			return ""
+		}
+
+		for i, row := range rows[1:] {
+			e := userEntry{
+				User:   field(row, "username"),
+				Passwd: field(row, "password"),
+				Hash:   field(row, "password_hash"),
+				line:   lines[i+1],
+			}
+
+			if a := strings.TrimSpace(field(row, "admin")); a != "" {
+				admin, err := strconv.ParseBool(a)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid admin %q", e.line, a)
+				}
+
+				e.Admin = &admin
+			}
+
+			entries = append(entries, e)
+		}
+
+	default:
+		return nil, errors.New("unknown format " + format)
+	}
+
+	return entries, nil
+}
+
+// ImportUsers adds the users in the file ("-" for stdin). Existing users
+// are only updated if update is true. Nothing is changed if any entry
+// is invalid.
+func ImportUsers(fname string, format string, update bool, policy *PasswordPolicy) {
+	rd := io.Reader(os.Stdin)
+
+	if fname != "-" {
+		fp, err := os.Open(fname)
+		if err != nil {
+			fmt.Println("Failed to open import file:", err)
+			return
+		}
+
+		defer fp.Close()
+		rd = fp
+	}
+
+	entries, err := readEntries(rd, format)
+	if err != nil {
+		fmt.Println("Failed to parse import file:", err)
+		return
+	}
+
+	var records []UserRecord
+
+	for i, e := range entries {
+		var rec UserRecord
+
+		switch {
+		case e.User == "":
+			err = errors.New("empty user name")
+		case e.Hash != "":
+			rec, err = recordFromHash([]byte(e.User), e.Hash)
+		case e.Passwd != "":
+			if err = policy.Check([]byte(e.User), []byte(e.Passwd)); err == nil {
+				rec = newUserRecord([]byte(e.User), []byte(e.Passwd))
+			}
+		default:
+			err = errors.New("no password or password_hash")
+		}
+
+		if err != nil {
+			if e.line > 0 {
+				fmt.Printf("Line %d (%s) is invalid: %v\n", e.line, e.User, err)
+			} else {
+				fmt.Printf("Entry %d (%s) is invalid: %v\n", i+1, e.User, err)
+			}
+			return
+		}
+
+		records = append(records, rec)
+	}
+
+	added, updated, skipped := 0, 0, 0
+
+	err = userStore.Update(func(users []UserRecord) ([]UserRecord, error) {
+		added, updated, skipped = 0, 0, 0
+
+	next:
+		for i, rec := range records {
+			admin := entries[i].Admin
+
+			for j, u := range users {
+				if !bytes.Equal(u.User, rec.User) {
+					continue
+				}
+
+				if update {
+					users[j] = updatedUser(u, rec, admin)
+					updated++
+				} else {
+					skipped++
+				}
+
+				continue next
+			}
+
+			rec.Admin = admin != nil && *admin
+			users = append(users, rec)
+			added++
+		}
+
+		return users, nil
+	})
+
+	if err != nil {
+		fmt.Println("Failed to import users:", err)
+		return
+	}
+
+	fmt.Printf("Imported users: %d added, %d updated, %d skipped\n", added, updated, skipped)
+}
+
+// ExportUsers writes the users and their password hashes to the file ("-" for stdout)
+func ExportUsers(fname string, format string) {
+	users, err := userStore.Users()
+	if err != nil {
+		fmt.Println("Failed to read users file:", err)
+		return
+	}
+
+	entries := []userEntry{}
+	for _, u := range users {
+		admin := u.Admin
+		entries = append(entries, userEntry{User: string(u.User), Hash: u.hashString(), Admin: &admin})
+	}
+
+	var buf bytes.Buffer
+
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+
+	case FormatCSV:
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"username", "password_hash", "admin"})
+
+		for _, e := range entries {
+			w.Write([]string{e.User, e.Hash, strconv.FormatBool(*e.Admin)})
+		}
+
+		w.Flush()
+		err = w.Error()
+
+	default:
+		err = errors.New("unknown format " + format)
+	}
+
+	if err != nil {
+		fmt.Println("Failed to export users:", err)
+		return
+	}
+
+	if fname == "-" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+
+	// the export contains password hashes, keep it private
+	if err := AtomicWriteFile(fname, buf.Bytes(), 0600); err != nil {
+		fmt.Println("Failed to write export file:", err)
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// user.db in a temporary directory
+func testUserDB(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	SetDataFiles(filepath.Join(dir, "user.db"), filepath.Join(dir, "token.db"))
+	return dir
+}
+
+func testHash(t *testing.T, passwd string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(hash)
+}
+
+func checkUser(t *testing.T, name string, passwd string, admin bool, mustChange bool) {
+	t.Helper()
+
+	info, err := LookupUser(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Admin != admin || info.MustChange != mustChange {
+		t.Errorf("%s: got admin %v, must change %v, expect %v, %v", name, info.Admin, info.MustChange, admin, mustChange)
+	}
+
+	if !ValidateUser([]byte(name), []byte(passwd)) {
+		t.Errorf("%s: the password is not %s", name, passwd)
+	}
+}
+
+func TestAddUserKeepsRole(t *testing.T) {
+	testUserDB(t)
+
+	AddUser("root1", &AddUserOptions{PasswdHash: testHash(t, "first"), Admin: true, AdminSet: true})
+	checkUser(t, "root1", "first", true, false)
+
+	if err := ResetPassword("root1", []byte("Passw0rd!xyz"), true, &PasswordPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// provisioning again without --admin only changes the password
+	AddUser("root1", &AddUserOptions{PasswdHash: testHash(t, "second")})
+	checkUser(t, "root1", "second", true, true)
+
+	AddUser("root1", &AddUserOptions{PasswdHash: testHash(t, "third"), AdminSet: true})
+	checkUser(t, "root1", "third", false, true)
+
+	AddUser("bob", &AddUserOptions{PasswdHash: testHash(t, "bob")})
+	checkUser(t, "bob", "bob", false, false)
+}
+
+func TestImportKeepsRole(t *testing.T) {
+	dir := testUserDB(t)
+
+	AddUser("root1", &AddUserOptions{PasswdHash: testHash(t, "first"), Admin: true, AdminSet: true})
+	AddUser("alice", &AddUserOptions{PasswdHash: testHash(t, "first"), Admin: true, AdminSet: true})
+
+	fname := filepath.Join(dir, "users.csv")
+	csv := "username,password_hash,admin\n" +
+		"root1," + testHash(t, "second") + ",\n" +
+		"alice," + testHash(t, "second") + ",false\n" +
+		"carol," + testHash(t, "carol") + ",true\n"
+
+	if err := os.WriteFile(fname, []byte(csv), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ImportUsers(fname, FormatCSV, true, &PasswordPolicy{})
+
+	checkUser(t, "root1", "second", true, false)
+	checkUser(t, "alice", "second", false, false)
+	checkUser(t, "carol", "carol", true, false)
+
+	// an invalid admin field changes nothing
+	if err := os.WriteFile(fname, []byte("username,password_hash,admin\nroot1,"+testHash(t, "third")+",maybe\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ImportUsers(fname, FormatCSV, true, &PasswordPolicy{})
+	checkUser(t, "root1", "second", true, false)
+}
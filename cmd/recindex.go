@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// The metadata of the recordings are kept in an index file in the record
+// directory, so that listing them does not read every recording. The
+// index is updated when recordings are closed, renamed or deleted, and
+// the entries of the files changed by other means, e.g., copied into the
+// directory or converted by the CLI, are refreshed by their size and
+// modification time when the recordings are listed.
+
+const recordIndexName = ".index.json"
+
+// RecordMeta is the metadata of a recording
+type RecordMeta struct {
+	Fname    string        `json:"fname"`
+	Size     int64         `json:"size"`
+	ModTime  time.Time     `json:"mtime"`
+	Duration time.Duration `json:"duration"`
+	User     string        `json:"user,omitempty"`    // the user of the session
+	Command  []string      `json:"command,omitempty"` // the recorded command
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Title    string        `json:"title,omitempty"`
+	Tags     []string      `json:"tags,omitempty"`
+
+	Mandatory bool `json:"mandatory,omitempty"` // only the administrators can delete or rename it
+
+	// who can see the recording. The owner is the user who recorded,
+	// uploaded or imported it, never the user in the header, which anyone
+	// who can write a file can set. Empty for the administrators only
+	Owner      string `json:"owner,omitempty"`
+	Visibility string `json:"visibility,omitempty"` // empty for the default
+	Link       string `json:"link,omitempty"`       // the token of the public link
+}
+
+// the visibility of the recordings
+const (
+	VisibilityPrivate = "private" // the owner and the administrators
+	VisibilityTeam    = "team"    // and the teams of the owner
+	VisibilityPublic  = "public"  // everyone, also without login by the link
+)
+
+// ValidVisibility checks the visibility of recordings
+func ValidVisibility(v string) bool {
+	return v == VisibilityPrivate || v == VisibilityTeam || v == VisibilityPublic
+}
+
+// the ways to sort the recordings
+const (
+	SortTime     = "time"
+	SortName     = "name"
+	SortSize     = "size"
+	SortDuration = "duration"
+	SortUser     = "user"
+)
+
+func (s *RecordStore) indexPath() string {
+	return filepath.Join(s.dir, recordIndexName)
+}
+
+// whether the index file is still the one parsed
+func sameIndex(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// readIndex returns a copy of the index, it is parsed again only if the
+// file has changed since
+func (s *RecordStore) readIndex() (map[string]*RecordMeta, error) {
+	finfo, err := os.Stat(s.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*RecordMeta{}, nil
+		}
+
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.indexInfo == nil || !sameIndex(s.indexInfo, finfo) {
+		data, err := os.ReadFile(s.indexPath())
+		if err != nil {
+			return nil, err
+		}
+
+		index := map[string]*RecordMeta{}
+
+		if err := json.Unmarshal(data, &index); err != nil {
+			// the index can always be rebuilt from the recordings
+			log.Println("Invalid record index, rebuild it:", err)
+			index = map[string]*RecordMeta{}
+		}
+
+		s.index, s.indexInfo = index, finfo
+	}
+
+	return copyIndex(s.index), nil
+}
+
+// the callers may change the entries of the index
+func copyIndex(index map[string]*RecordMeta) map[string]*RecordMeta {
+	c := make(map[string]*RecordMeta, len(index))
+
+	for name, meta := range index {
+		m := *meta
+		c[name] = &m
+	}
+
+	return c
+}
+
+// updateIndex runs fn on the index with the file locked, and writes the
+// index back if fn reports a change
+func (s *RecordStore) updateIndex(fn func(index map[string]*RecordMeta) bool) error {
+	unlock, err := lockFile(s.indexPath())
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	if !fn(index) {
+		return nil
+	}
+
+	output, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if err := AtomicWriteFile(s.indexPath(), output, 0644); err != nil {
+		return err
+	}
+
+	// no one else writes the index while it is locked
+	if finfo, err := os.Stat(s.indexPath()); err == nil {
+		s.mtx.Lock()
+		s.index, s.indexInfo = copyIndex(index), finfo
+		s.mtx.Unlock()
+	}
+
+	return nil
+}
+
+// read the metadata of the recording, the settings are kept from old
+func (s *RecordStore) readMeta(finfo os.FileInfo, old *RecordMeta) *RecordMeta {
+	meta := &RecordMeta{
+		Fname:   finfo.Name(),
+		Size:    finfo.Size(),
+		ModTime: finfo.ModTime(),
+	}
+
+	if old != nil {
+		meta.Title, meta.Tags = old.Title, old.Tags
+		meta.Owner, meta.Visibility, meta.Link = old.Owner, old.Visibility, old.Link
+	}
+
+	hdr, records, err := s.Read(finfo.Name())
+	if err != nil {
+		log.Println("Failed to read record file", finfo.Name(), err)
+	}
+
+	meta.Duration = term_conn.Duration(records)
+
+	// legacy recordings have no header, they are closed at the mod time
+	if hdr != nil && !hdr.Start.IsZero() {
+		meta.User, meta.Command = hdr.User, hdr.Command
+		meta.Start, meta.Mandatory = hdr.Start, hdr.Mandatory
+		meta.End = hdr.Start.Add(meta.Duration)
+	} else {
+		meta.End = finfo.ModTime()
+		meta.Start = meta.End.Add(-meta.Duration)
+	}
+
+	if meta.Title == "" && hdr != nil {
+		meta.Title = hdr.Session
+	}
+
+	return meta
+}
+
+// whether the entry is missing or out of date. The recordings still being
+// written are indexed again when they are closed, not on every access
+func staleMeta(meta *RecordMeta, finfo os.FileInfo) bool {
+	if meta != nil && term_conn.Recording(finfo.Name()) {
+		return false
+	}
+
+	return meta == nil || meta.Size != finfo.Size() || !meta.ModTime.Equal(finfo.ModTime())
+}
+
+// Index reads the recording into the index, e.g., when it is closed
+func (s *RecordStore) Index(name string) error {
+	finfo, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	return s.updateIndex(func(index map[string]*RecordMeta) bool {
+		index[name] = s.readMeta(finfo, index[name])
+		return true
+	})
+}
+
+// remove the entry of the deleted recording
+func (s *RecordStore) unindex(name string) error {
+	return s.updateIndex(func(index map[string]*RecordMeta) bool {
+		delete(index, name)
+		return true
+	})
+}
+
+// move the entry of the renamed recording
+func (s *RecordStore) renameIndexed(oldName string, newName string) error {
+	return s.updateIndex(func(index map[string]*RecordMeta) bool {
+		meta, ok := index[oldName]
+		if !ok {
+			return false
+		}
+
+		delete(index, oldName)
+		meta.Fname = newName
+		index[newName] = meta
+		return true
+	})
+}
+
+// Lookup returns the metadata of the recording, the error is
+// os.ErrNotExist if there is no such recording
+func (s *RecordStore) Lookup(name string) (*RecordMeta, error) {
+	finfo, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the index is only locked to refresh the entry
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if meta := index[name]; !staleMeta(meta, finfo) {
+		return meta, nil
+	}
+
+	var meta RecordMeta
+
+	err = s.UpdateMeta(name, func(m *RecordMeta) bool {
+		meta = *m
+		return false
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// UpdateMeta runs fn on the metadata of the recording, the index is
+// written back if fn reports a change
+func (s *RecordStore) UpdateMeta(name string, fn func(meta *RecordMeta) bool) error {
+	finfo, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	return s.updateIndex(func(index map[string]*RecordMeta) bool {
+		changed := false
+		meta := index[name]
+
+		if staleMeta(meta, finfo) {
+			meta = s.readMeta(finfo, meta)
+			index[name] = meta
+			changed = true
+		}
+
+		return fn(meta) || changed
+	})
+}
+
+// FindLink returns the metadata of the recording with the public link,
+// nil if there is none
+func (s *RecordStore) FindLink(link string) *RecordMeta {
+	index, err := s.readIndex()
+	if err != nil || link == "" {
+		return nil
+	}
+
+	for _, meta := range index {
+		if subtle.ConstantTimeCompare([]byte(meta.Link), []byte(link)) == 1 {
+			return meta
+		}
+	}
+
+	return nil
+}
+
+// NewRecordLink returns a new token for the public link of recordings
+func NewRecordLink() string {
+	return uniuri.NewLen(32)
+}
+
+// List returns the metadata of the recordings, the index is brought up
+// to date with the files
+func (s *RecordStore) List() ([]RecordMeta, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []RecordMeta
+
+	err = s.updateIndex(func(index map[string]*RecordMeta) bool {
+		changed := false
+		found := map[string]bool{}
+
+		for _, finfo := range files {
+			fname := finfo.Name()
+			if !finfo.Mode().IsRegular() || !ValidRecordName(fname) {
+				continue
+			}
+
+			found[fname] = true
+			meta := index[fname]
+
+			if staleMeta(meta, finfo) {
+				meta = s.readMeta(finfo, meta)
+				index[fname] = meta
+				changed = true
+			}
+
+			records = append(records, *meta)
+		}
+
+		// deleted by other means
+		for fname := range index {
+			if !found[fname] {
+				delete(index, fname)
+				changed = true
+			}
+		}
+
+		return changed
+	})
+
+	return records, err
+}
+
+// SortRecords sorts the recordings by the key, the newest first by default
+func SortRecords(records []RecordMeta, key string, desc bool) {
+	less := func(i, j int) bool {
+		a, b := &records[i], &records[j]
+
+		switch key {
+		case SortName:
+			return a.Fname < b.Fname
+		case SortSize:
+			return a.Size < b.Size
+		case SortDuration:
+			return a.Duration < b.Duration
+		case SortUser:
+			return a.User < b.User
+		}
+
+		return a.Start.Before(b.Start)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if desc {
+			return less(j, i)
+		}
+
+		return less(i, j)
+	})
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// write a small recording of the user into the directory
+func writeTestRecord(t *testing.T, dir string, name string, user string) {
+	t.Helper()
+
+	fp, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fp.Close()
+
+	hdr := term_conn.NewRecordHeader("session", user, []string{"bash"})
+	records := []term_conn.WriteRecord{
+		{Dur: 0, Data: []byte("hello ")},
+		{Dur: time.Second, Data: []byte("world\r\n")},
+	}
+
+	if err := term_conn.WriteRecording(fp, hdr, records, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRecord(t, dir, "a.scr", "alice")
+
+	web, cli := NewRecordStore(dir), NewRecordStore(dir)
+
+	meta, err := web.Lookup("a.scr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user in the header does not own the recording
+	if meta.User != "alice" || meta.Owner != "" || meta.Duration != time.Second {
+		t.Fatalf("wrong metadata %+v", meta)
+	}
+
+	// the callers must not change the cached index
+	meta.Title = "changed"
+
+	// changed by another process, e.g., the CLI
+	err = cli.UpdateMeta("a.scr", func(m *RecordMeta) bool {
+		m.Title = "demo"
+		return true
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta, err = web.Lookup("a.scr"); err != nil || meta.Title != "demo" {
+		t.Fatalf("expect the new title, got %+v, %v", meta, err)
+	}
+
+	if _, err := web.Lookup("b.scr"); !os.IsNotExist(err) {
+		t.Fatalf("expect no such recording, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// The keys to encrypt the recordings are kept by the server in a JSON key
+// ring, readable only by its owner. The current key encrypts the new
+// recordings, the old keys are kept to decrypt the old ones until they
+// are re-encrypted with "witty encrypt -rotate".
+
+// LoadRecordKeys loads the key ring. If create is set, a key ring with a
+// new key is created when the file does not exist
+func LoadRecordKeys(fname string, create bool) (*term_conn.KeyRing, error) {
+	data, err := os.ReadFile(fname)
+
+	if os.IsNotExist(err) && create {
+		ring := &term_conn.KeyRing{}
+		if err := addRecordKey(ring); err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+			return nil, err
+		}
+
+		return ring, saveRecordKeys(fname, ring)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ring term_conn.KeyRing
+	if err := json.Unmarshal(data, &ring); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	if err := ring.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return &ring, nil
+}
+
+func saveRecordKeys(fname string, ring *term_conn.KeyRing) error {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return AtomicWriteFile(fname, data, 0600)
+}
+
+// add a new key and make it current
+func addRecordKey(ring *term_conn.KeyRing) error {
+	key, err := term_conn.NewRecordKey()
+	if err != nil {
+		return err
+	}
+
+	ring.Keys = append(ring.Keys, key)
+	ring.Current = key.ID
+	return nil
+}
+
+// RotateRecordKey adds a new current key to the key ring, the old keys are
+// kept to decrypt the recordings not re-encrypted yet
+func RotateRecordKey(fname string) (*term_conn.KeyRing, error) {
+	ring, err := LoadRecordKeys(fname, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addRecordKey(ring); err != nil {
+		return nil, err
+	}
+
+	return ring, saveRecordKeys(fname, ring)
+}
+
+// PruneRecordKeys removes the old keys that no recording in the store uses
+func PruneRecordKeys(fname string, store *RecordStore) error {
+	ring, err := LoadRecordKeys(fname, false)
+	if err != nil {
+		return err
+	}
+
+	used := map[string]bool{ring.Current: true}
+
+	files, err := store.Paths()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		format, err := recordFormatOf(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		used[format.key] = true
+	}
+
+	var keys []term_conn.RecordKey
+
+	for _, key := range ring.Keys {
+		if used[key.ID] {
+			keys = append(keys, key)
+		} else {
+			fmt.Println("Removed the unused key", key.ID)
+		}
+	}
+
+	ring.Keys = keys
+	return saveRecordKeys(fname, ring)
+}
@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// RecordStore is the directory of the recordings. The recordings are
+// only accessed by their names, which are plain file names ending with
+// .scr, so that no request can reach the files outside the directory.
+// Symbolic links and other special files are refused, in case one is
+// planted in the directory.
+
+const (
+	RecordExt = ".scr"
+
+	maxRecordName = 255
+)
+
+var (
+	ErrRecordName = errors.New("invalid recording name")
+	ErrNotRecord  = errors.New("not a regular recording file")
+)
+
+type RecordStore struct {
+	dir string
+
+	// the parsed index, kept until the index file changes
+	mtx       sync.Mutex
+	index     map[string]*RecordMeta
+	indexInfo os.FileInfo
+}
+
+func NewRecordStore(dir string) *RecordStore {
+	return &RecordStore{dir: dir}
+}
+
+// RecordStoreOf returns the store of the directory of the recording at
+// path, and its name, for the recordings given on the command line
+func RecordStoreOf(path string) (*RecordStore, string) {
+	return NewRecordStore(filepath.Dir(path)), filepath.Base(path)
+}
+
+// Dir returns the directory of the recordings
+func (s *RecordStore) Dir() string {
+	return s.dir
+}
+
+// ValidRecordName checks that the name is a plain file name of a recording
+func ValidRecordName(name string) bool {
+	if name == "" || len(name) > maxRecordName || strings.HasPrefix(name, ".") ||
+		!strings.HasSuffix(name, RecordExt) || name == RecordExt {
+		return false
+	}
+
+	for _, r := range name {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return false
+		}
+	}
+
+	return name == filepath.Base(name)
+}
+
+// Path returns the path of the recording, ErrRecordName if the name is
+// not valid
+func (s *RecordStore) Path(name string) (string, error) {
+	if !ValidRecordName(name) {
+		return "", ErrRecordName
+	}
+
+	return filepath.Join(s.dir, name), nil
+}
+
+// Stat returns the file info of the recording, without following links
+func (s *RecordStore) Stat(name string) (os.FileInfo, error) {
+	path, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return regularFile(path)
+}
+
+// the file info of path if it is a regular file
+func regularFile(path string) (os.FileInfo, error) {
+	finfo, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !finfo.Mode().IsRegular() {
+		return nil, ErrNotRecord
+	}
+
+	return finfo, nil
+}
+
+// Open opens the recording to read
+func (s *RecordStore) Open(name string) (*os.File, error) {
+	path, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return openRegular(path, os.O_RDONLY, 0)
+}
+
+// Create creates the new recording, os.ErrExist if it exists
+func (s *RecordStore) Create(name string) (*os.File, error) {
+	path, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return openRegular(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// open the file without following a link at the last component, which
+// is ELOOP, and refuse special files such as FIFOs
+func openRegular(path string, flag int, perm os.FileMode) (*os.File, error) {
+	fp, err := os.OpenFile(path, flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, perm)
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) {
+			return nil, ErrNotRecord
+		}
+
+		return nil, err
+	}
+
+	finfo, err := fp.Stat()
+	if err == nil && !finfo.Mode().IsRegular() {
+		err = ErrNotRecord
+	}
+
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+// Read reads the recording, see term_conn.ReadRecording
+func (s *RecordStore) Read(name string) (*term_conn.RecordHeader, []term_conn.WriteRecord, error) {
+	fp, err := s.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer fp.Close()
+	return term_conn.ReadRecording(fp)
+}
+
+// Verify checks the hashes and the signature of the recording, see
+// term_conn.VerifyRecording
+func (s *RecordStore) Verify(name string, pub ed25519.PublicKey) (*term_conn.Verified, error) {
+	fp, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+	return term_conn.VerifyRecording(fp, pub)
+}
+
+// Remove deletes the recording and its index entry
+func (s *RecordStore) Remove(name string) error {
+	path, err := s.Path(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := regularFile(path); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return s.unindex(name)
+}
+
+// Rename renames the recording and its index entry, os.ErrExist if the
+// new name is taken. The recording is linked to the new name first, so
+// that an existing file is never replaced
+func (s *RecordStore) Rename(oldName string, newName string) error {
+	oldPath, err := s.Path(oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := s.Path(newName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := regularFile(oldPath); err != nil {
+		return err
+	}
+
+	if err := os.Link(oldPath, newPath); err != nil {
+		return err
+	}
+
+	if err := os.Remove(oldPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+
+	return s.renameIndexed(oldName, newName)
+}
+
+// Names returns the names of the recordings, the links and other files
+// are skipped
+func (s *RecordStore) Names() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, finfo := range files {
+		if finfo.Mode().IsRegular() && ValidRecordName(finfo.Name()) {
+			names = append(names, finfo.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Paths returns the paths of the recordings, for the commands that take
+// the files
+func (s *RecordStore) Paths() ([]string, error) {
+	names, err := s.Names()
+
+	for i, name := range names {
+		names[i] = filepath.Join(s.dir, name)
+	}
+
+	return names, err
+}
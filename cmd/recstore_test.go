@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestValidRecordName(t *testing.T) {
+	valid := []string{"a.scr", "alice_61f0c2a1.scr", "with space.scr", "中文.scr"}
+	invalid := []string{
+		"", ".scr", ".index.json", ".hidden.scr", "a.txt", "a.scr.txt",
+		"../a.scr", "dir/a.scr", "/etc/a.scr", `dir\a.scr`, "a\n.scr", "a\x00.scr",
+		strings.Repeat("a", maxRecordName) + ".scr",
+	}
+
+	for _, name := range valid {
+		if !ValidRecordName(name) {
+			t.Errorf("%q should be valid", name)
+		}
+	}
+
+	for _, name := range invalid {
+		if ValidRecordName(name) {
+			t.Errorf("%q should be invalid", name)
+		}
+	}
+
+	store := NewRecordStore(t.TempDir())
+
+	if _, err := store.Open("../a.scr"); err != ErrRecordName {
+		t.Errorf("expect ErrRecordName, got %v", err)
+	}
+
+	if err := store.Rename("a.scr", "../b.scr"); err != ErrRecordName {
+		t.Errorf("expect ErrRecordName, got %v", err)
+	}
+}
+
+func TestRecordStoreSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret.scr")
+	writeTestRecord(t, filepath.Dir(outside), "secret.scr", "root")
+	writeTestRecord(t, dir, "a.scr", "alice")
+
+	if err := os.Symlink(outside, filepath.Join(dir, "link.scr")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(t.TempDir(), "new.scr"), filepath.Join(dir, "dangling.scr")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader would block on the FIFO without O_NONBLOCK
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo.scr"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewRecordStore(dir)
+
+	for _, name := range []string{"link.scr", "fifo.scr"} {
+		if _, err := store.Open(name); err != ErrNotRecord {
+			t.Errorf("open %s: expect ErrNotRecord, got %v", name, err)
+		}
+
+		if _, err := store.Stat(name); err != ErrNotRecord {
+			t.Errorf("stat %s: expect ErrNotRecord, got %v", name, err)
+		}
+
+		if _, _, err := store.Read(name); err != ErrNotRecord {
+			t.Errorf("read %s: expect ErrNotRecord, got %v", name, err)
+		}
+
+		if err := store.Remove(name); err != ErrNotRecord {
+			t.Errorf("remove %s: expect ErrNotRecord, got %v", name, err)
+		}
+
+		if err := store.Rename(name, "b.scr"); err != ErrNotRecord {
+			t.Errorf("rename %s: expect ErrNotRecord, got %v", name, err)
+		}
+	}
+
+	// not written through the link
+	if fp, err := store.Create("dangling.scr"); err == nil {
+		fp.Close()
+		t.Error("created the recording through a link")
+	}
+
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(outside), "new.scr")); err == nil {
+		t.Error("the file behind the link was created")
+	}
+
+	if _, err := store.Create("a.scr"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expect os.ErrExist, got %v", err)
+	}
+
+	// the link is not replaced by a rename either
+	if err := store.Rename("a.scr", "link.scr"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expect os.ErrExist, got %v", err)
+	}
+
+	names, err := store.Names()
+	if err != nil || !reflect.DeepEqual(names, []string{"a.scr"}) {
+		t.Errorf("got %v, %v, expect only a.scr", names, err)
+	}
+
+	records, err := store.List()
+	if err != nil || len(records) != 1 || records[0].User != "alice" {
+		t.Errorf("got %+v, %v, expect only a.scr", records, err)
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("the file behind the link is gone: %v", err)
+	}
+}
+
+// the recordings given on the command line go through the store too
+func TestRecordPaths(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRecord(t, dir, "a.scr", "alice")
+	writeTestRecord(t, dir, "b.scr", "bob")
+
+	outside := filepath.Join(t.TempDir(), "secret.scr")
+	writeTestRecord(t, filepath.Dir(outside), "secret.scr", "root")
+
+	if err := os.Symlink(outside, filepath.Join(dir, "link.scr")); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, link := filepath.Join(dir, "a.scr"), filepath.Join(dir, "b.scr"), filepath.Join(dir, "link.scr")
+	before, _ := os.ReadFile(b)
+
+	// the output exists, it is not replaced
+	Merge([]string{a, a}, b)
+
+	if after, _ := os.ReadFile(b); string(after) != string(before) {
+		t.Error("merge replaced the existing recording")
+	}
+
+	Merge([]string{a, link}, filepath.Join(dir, "merged.scr"))
+
+	if _, err := os.Stat(filepath.Join(dir, "merged.scr")); err == nil {
+		t.Error("merge read the recording through a link")
+	}
+
+	if err := Export(link, filepath.Join(dir, "link.cast"), FormatAsciicast); !errors.Is(err, ErrNotRecord) {
+		t.Errorf("export: expect ErrNotRecord, got %v", err)
+	}
+
+	store, name := RecordStoreOf(link)
+	if _, err := store.Verify(name, nil); !errors.Is(err, ErrNotRecord) {
+		t.Errorf("verify: expect ErrNotRecord, got %v", err)
+	}
+
+	cast := filepath.Join(dir, "a.cast")
+	if err := Export(a, cast, FormatAsciicast); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Import(cast, b); !errors.Is(err, os.ErrExist) {
+		t.Errorf("import: expect os.ErrExist, got %v", err)
+	}
+
+	if err := Import(cast, filepath.Join(dir, "c.txt")); err != ErrRecordName {
+		t.Errorf("import: expect ErrRecordName, got %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"encoding/json"
 	"io"
 	"log"
 	"os"
@@ -12,7 +11,8 @@ import (
 )
 
 func Replay(fname string, wait uint) {
-	fp, err := os.Open(fname)
+	store, name := RecordStoreOf(fname)
+	fp, err := store.Open(name)
 
 	if err != nil {
 		log.Fatalln("Failed to open record file", err)
@@ -35,32 +35,25 @@ func Replay(fname string, wait uint) {
 		log.Println("Set terminal window to 120x36 before continue")
 	}
 
-	decoder := json.NewDecoder(fp)
+	_, records, err := term_conn.ReadRecording(fp)
 
-	if decoder == nil {
-		log.Fatalln("Failed to create JSON decoder")
+	if err != nil {
+		log.Println("Failed to read the recording, replay what is read", err)
 	}
 
-	// To work with javascript decoder, we organize the file as
-	// an array of writeRecord. golang decode instead decode
-	// as individual record. Call decoder.Token to skip opening [
 	t.Write([]byte("\n\n---beginning of replay---\n\n"))
 
-	decoder.Token()
-	for decoder.More() {
-		var record term_conn.WriteRecord
-
-		if err := decoder.Decode(&record); err != nil {
-			log.Println("Failed to decode record", err)
-			continue
-		}
-
+	for _, record := range records {
 		if record.Dur > time.Duration(wait)*time.Millisecond {
 			record.Dur = time.Duration(wait) * time.Millisecond
 		}
 
 		time.Sleep(record.Dur)
-		t.Write(record.Data)
+
+		// the input is only shown by the replay page
+		if record.Type == term_conn.RecordOutput {
+			t.Write(record.Data)
+		}
 	}
 
 	t.Write([]byte("\n\n---end of replay---\n\n"))
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shadowAuth validates local accounts with the hashes in /etc/shadow.
+// witty needs to be able to read the file, usually it means running as
+// root or as a member of the shadow group.
+type shadowAuth struct {
+	fname string
+	adminList
+}
+
+func (s *shadowAuth) Authenticate(username []byte, passwd []byte) bool {
+	fp, err := os.Open(s.fname)
+
+	if err != nil {
+		log.Println("Failed to open shadow file", err)
+		return false
+	}
+
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+
+	for scanner.Scan() {
+		// name:hash:lastchg:min:max:warn:inactive:expire:reserved
+		fields := strings.Split(scanner.Text(), ":")
+
+		if len(fields) < 2 || fields[0] != string(username) {
+			continue
+		}
+
+		// locked (!...) or password-less (*) accounts are never allowed
+		hashed := fields[1]
+		if hashed == "" || strings.HasPrefix(hashed, "!") || strings.HasPrefix(hashed, "*") {
+			log.Println("Account", fields[0], "is locked or has no password")
+			return false
+		}
+
+		// the expire field counts days since epoch
+		if len(fields) > 7 && fields[7] != "" {
+			days, err := strconv.ParseInt(fields[7], 10, 64)
+
+			if err == nil && time.Now().Unix() >= days*24*3600 {
+				log.Println("Account", fields[0], "has expired")
+				return false
+			}
+		}
+
+		return verifyHash(hashed, passwd)
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The recordings are signed with an Ed25519 key when they are closed. The
+// private key is kept by the server in PKCS #8 PEM, the public key can be
+// given to auditors to verify the recordings without it.
+
+// LoadSignKey loads the private key to sign the recordings. If create is
+// set, a new key is generated when the file does not exist
+func LoadSignKey(fname string, create bool) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(fname)
+
+	if os.IsNotExist(err) && create {
+		return genSignKey(fname)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: not a PEM private key", fname)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", fname)
+	}
+
+	return priv, nil
+}
+
+func genSignKey(fname string) (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return nil, err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := AtomicWriteFile(fname, keyPem, 0600); err != nil {
+		return nil, err
+	}
+
+	return priv, nil
+}
+
+// LoadVerifyKey loads the key to verify the recordings, the file is
+// either the public key or the private key of the server
+func LoadVerifyKey(fname string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: not a PEM file", fname)
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := LoadSignKey(fname, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return priv.Public().(ed25519.PublicKey), nil
+
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fname, err)
+		}
+
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an Ed25519 key", fname)
+		}
+
+		return pub, nil
+	}
+
+	return nil, errors.New(fname + ": not a public or private key")
+}
+
+// WritePublicKey writes the public key of the signing key, for auditors
+func WritePublicKey(keyFile string, output string) error {
+	pub, err := LoadVerifyKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	return AtomicWriteFile(output, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+}
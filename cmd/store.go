@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on fname.lock, so that concurrent
+// witty processes (e.g., the server and adduser) serialize their updates.
+// A separate lock file is used because the data file is replaced by rename.
+func lockFile(fname string) (func(), error) {
+	fp, err := os.OpenFile(fname+".lock", os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+		fp.Close()
+	}, nil
+}
+
+// AtomicWriteFile writes data to a temporary file in the same directory
+// and renames it over fname. Readers see either the old or the new
+// content, never a partially written file, even if witty crashes.
+func AtomicWriteFile(fname string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	// no-op if the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fname)
+}
@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+const (
+	tokenPrefix = "wt_"
+
+	ScopeSessionsRead = "sessions:read"
+	ScopeRecordsRead  = "records:read"
+	ScopeRecordsWrite = "records:write"
+)
+
+// where the tokens are stored, see SetDataFiles
+var tokenFileName = "./token.db"
+
+// AllScopes are the scopes a token can be granted
+var AllScopes = []string{ScopeSessionsRead, ScopeRecordsRead, ScopeRecordsWrite}
+
+// TokenRecord is an API token. Only the hash of the secret is stored,
+// the token itself is shown once when it is created.
+type TokenRecord struct {
+	Id      string    `json:"Id"`
+	User    string    `json:"Username"`
+	Name    string    `json:"Name"`
+	Scopes  []string  `json:"Scopes"`
+	Hash    [32]byte  `json:"Hash"`
+	Created time.Time `json:"Created"`
+	Expires time.Time `json:"Expires"` // zero means the token never expires
+}
+
+// HasScope checks whether the token is granted the scope
+func (t *TokenRecord) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readTokens() ([]TokenRecord, error) {
+	var tokens []TokenRecord
+
+	file, err := os.ReadFile(tokenFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	err = json.Unmarshal(file, &tokens)
+	return tokens, err
+}
+
+// updateTokens runs fn on the tokens with the file locked, and
+// atomically writes the result back
+func updateTokens(fn func(tokens []TokenRecord) ([]TokenRecord, error)) error {
+	unlock, err := lockFile(tokenFileName)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	tokens, err := readTokens()
+	if err != nil {
+		return err
+	}
+
+	if tokens, err = fn(tokens); err != nil {
+		return err
+	}
+
+	if tokens == nil {
+		tokens = []TokenRecord{}
+	}
+
+	output, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	return AtomicWriteFile(tokenFileName, output, 0600)
+}
+
+func validScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateToken creates a token for the user and prints it, the user must
+// be in user.db, so that deleting it also invalidates its tokens
+func CreateToken(username string, name string, scopes []string, ttl time.Duration) {
+	if _, err := LookupUser(username); err != nil {
+		fmt.Println("Cannot create a token for", username+":", err)
+		return
+	}
+
+	for _, s := range scopes {
+		if !validScope(s) {
+			fmt.Println("Unknown scope", s, "valid scopes are", strings.Join(AllScopes, ","))
+			return
+		}
+	}
+
+	secret := uniuri.NewLen(40)
+	rec := TokenRecord{
+		Id:      uniuri.NewLen(12),
+		User:    username,
+		Name:    name,
+		Scopes:  scopes,
+		Hash:    sha256.Sum256([]byte(secret)),
+		Created: time.Now(),
+	}
+
+	if ttl > 0 {
+		rec.Expires = rec.Created.Add(ttl)
+	}
+
+	err := updateTokens(func(tokens []TokenRecord) ([]TokenRecord, error) {
+		return append(tokens, rec), nil
+	})
+
+	if err != nil {
+		fmt.Println("Failed to save token:", err)
+		return
+	}
+
+	fmt.Println("Token", rec.Id, "created for", username, "with scopes", strings.Join(scopes, ","))
+	fmt.Println("Save the token now, it cannot be shown again:")
+	fmt.Println("   ", tokenPrefix+rec.Id+"."+secret)
+}
+
+// ListTokens lists the tokens of the user, or all tokens if username is empty
+func ListTokens(username string) {
+	tokens, err := readTokens()
+	if err != nil {
+		log.Println("Failed to read tokens file", err)
+		return
+	}
+
+	fmt.Println("API tokens:")
+	for _, t := range tokens {
+		if username != "" && t.User != username {
+			continue
+		}
+
+		expires := "never"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format("Jan/2/2006, 15:04:05")
+		}
+
+		fmt.Printf("    %s  user: %s, name: %s, scopes: %s, expires: %s\n",
+			t.Id, t.User, t.Name, strings.Join(t.Scopes, ","), expires)
+	}
+}
+
+// RevokeToken deletes the token with the id
+func RevokeToken(id string) {
+	err := updateTokens(func(tokens []TokenRecord) ([]TokenRecord, error) {
+		for i, t := range tokens {
+			if t.Id == id {
+				return append(tokens[:i], tokens[i+1:]...), nil
+			}
+		}
+
+		return nil, errors.New("token " + id + " does not exist")
+	})
+
+	if err != nil {
+		fmt.Println("Failed to revoke token:", err)
+		return
+	}
+
+	fmt.Println("Token", id, "revoked")
+}
+
+// ValidateToken returns the record of a valid, unexpired token, or nil.
+// The tokens of deleted users, and of users who must change the password
+// first, are not valid
+func ValidateToken(token string) *TokenRecord {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil
+	}
+
+	idx := strings.Index(token, ".")
+	if idx < 0 {
+		return nil
+	}
+
+	id := token[len(tokenPrefix):idx]
+	hashed := sha256.Sum256([]byte(token[idx+1:]))
+
+	tokens, err := readTokens()
+	if err != nil {
+		log.Println("Failed to read tokens file", err)
+		return nil
+	}
+
+	for i, t := range tokens {
+		if t.Id != id {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(hashed[:], t.Hash[:]) != 1 {
+			return nil
+		}
+
+		if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+			log.Println("Token", id, "has expired")
+			return nil
+		}
+
+		if info, err := LookupUser(t.User); err != nil || info.MustChange {
+			log.Println("Token", id, "of user", t.User, "is disabled:", err)
+			return nil
+		}
+
+		return &tokens[i]
+	}
+
+	return nil
+}
@@ -3,10 +3,12 @@ package cmd
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/json"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/dchest/uniuri"
 	"golang.org/x/term"
@@ -20,140 +22,168 @@ type UserRecord struct {
 	User   []byte   `json:"Username"`
 	Seed   []byte   `json:"Seed"`
 	Passwd [32]byte `json:"Password"`
+	Hash   string   `json:"Hash,omitempty"` // imported crypt(3) hash, used instead of Seed/Passwd
+
+	Admin      bool `json:"Admin,omitempty"`      // administrators can manage other users
+	MustChange bool `json:"MustChange,omitempty"` // the password must be changed on next login
+
+	// when the password is set, in Unix nanoseconds. The web logins made
+	// before are revoked, even if the password is changed by the CLI
+	Changed int64 `json:"Changed,omitempty"`
+}
+
+// AddUserOptions controls how adduser gets the password
+type AddUserOptions struct {
+	PasswdStdin bool   // read the password from the first line of stdin
+	PasswdHash  string // use this pre-hashed password
+	Admin       bool   // make the user an administrator, or not
+	AdminSet    bool   // Admin is given, existing users keep their role otherwise
+	Policy      PasswordPolicy
 }
 
 func hashPassword(seed []byte, passwd []byte) [32]byte {
-	input := append(seed, passwd...)
+	// do not append to seed directly, it may share the array with the cache
+	input := append(append([]byte{}, seed...), passwd...)
 	return sha256.Sum256(input)
 }
 
-func addUser(username []byte, passwd []byte) {
-	var users []UserRecord
-	var err error
-
+// create the record with a new seed for the password
+func newUserRecord(username []byte, passwd []byte) UserRecord {
 	seed := []byte(uniuri.NewLen(64))
-	hashed := hashPassword(seed, passwd)
-
-	exist := false
-	file, err := os.ReadFile(userFileName)
+	return UserRecord{User: username, Seed: seed, Passwd: hashPassword(seed, passwd), Changed: time.Now().UnixNano()}
+}
 
-	if err != nil {
-		goto nonexist
+// the existing user u with the password of rec. The role is only changed
+// if admin is not nil, the other flags are kept. Importing the same hash
+// again does not revoke the logins of the user
+func updatedUser(u UserRecord, rec UserRecord, admin *bool) UserRecord {
+	if rec.Hash == u.Hash && bytes.Equal(rec.Seed, u.Seed) && rec.Passwd == u.Passwd {
+		rec.Changed = u.Changed
 	}
 
-	if err = json.Unmarshal(file, &users); err != nil {
-		log.Println("Failed to unmarsh file", err)
-		goto nonexist
+	rec.Admin = u.Admin
+	if admin != nil {
+		rec.Admin = *admin
 	}
 
-	// update the existing user if it exists
-	for i, u := range users {
-		if bytes.Equal(u.User, username) {
-			users[i].Seed = seed
-			users[i].Passwd = hashed
-			exist = true
-			break
-		}
-	}
+	rec.MustChange = u.MustChange
+	return rec
+}
 
-nonexist:
-	if !exist {
-		users = append(users, UserRecord{username, seed, hashed})
-	}
+// add the user, or update its password if the user exists, see updatedUser
+func putUser(rec UserRecord, admin *bool) error {
+	return userStore.Update(func(users []UserRecord) ([]UserRecord, error) {
+		// update the existing user if it exists
+		for i, u := range users {
+			if bytes.Equal(u.User, rec.User) {
+				users[i] = updatedUser(u, rec, admin)
+				return users, nil
+			}
+		}
 
-	output, err := json.Marshal(users)
-	if err != nil {
-		log.Println("Failed to marshal passwords", err)
-		return
-	}
+		rec.Admin = admin != nil && *admin
+		return append(users, rec), nil
+	})
+}
 
-	os.WriteFile(userFileName, output, 0660)
+func addUser(username []byte, passwd []byte) error {
+	return putUser(newUserRecord(username, passwd), nil)
 }
 
-func AddUser(username string) {
-	fmt.Println("Please type your password (it will not be echoed back):")
-	passwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+func AddUser(username string, opts *AddUserOptions) {
+	var passwd []byte
+	var err error
+	var admin *bool
 
-	if err != nil {
-		log.Println("Failed to read password", err)
-		return
+	if opts.AdminSet {
+		admin = &opts.Admin
 	}
 
-	if len(passwd) < 12 {
-		fmt.Println("Password too short, at least 12 bytes")
+	switch {
+	case opts.PasswdHash != "":
+		rec, err := recordFromHash([]byte(username), opts.PasswdHash)
+
+		if err == nil {
+			err = putUser(rec, admin)
+		}
+
+		if err != nil {
+			fmt.Println("Failed to add user:", err)
+		}
 		return
-	}
 
-	fmt.Println("Please type your password again:")
-	passwd2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	case opts.PasswdStdin:
+		passwd, err = readPasswdLine(os.Stdin)
+
+	default:
+		passwd, err = readPasswdTerm()
+	}
 
 	if err != nil {
-		log.Println("Failed to read password", err)
+		fmt.Println("Failed to read password:", err)
 		return
 	}
 
-	if !bytes.Equal(passwd, passwd2) {
-		fmt.Println("Password mismatch, try again")
+	if err := opts.Policy.Check([]byte(username), passwd); err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	addUser([]byte(username), passwd)
+	if err := putUser(newUserRecord([]byte(username), passwd), admin); err != nil {
+		fmt.Println("Failed to add user:", err)
+	}
 }
 
-func DelUser(username string) {
-	var users []UserRecord
-	var err error
+// read the password twice from the terminal
+func readPasswdTerm() ([]byte, error) {
+	fmt.Println("Please type your password (it will not be echoed back):")
+	passwd, err := term.ReadPassword(int(os.Stdin.Fd()))
 
-	exist := false
-	file, err := os.ReadFile(userFileName)
 	if err != nil {
-		log.Println("Failed to read users file", err)
-		return
+		return nil, err
 	}
 
-	err = json.Unmarshal(file, &users)
+	fmt.Println("Please type your password again:")
+	passwd2, err := term.ReadPassword(int(os.Stdin.Fd()))
 
 	if err != nil {
-		log.Println("Failed to parse json format", err)
-		return
+		return nil, err
 	}
-	// update the existing user if it exists
-	for i, u := range users {
-		if bytes.Equal(u.User, []byte(username)) {
-			users = append(users[:i], users[i+1:]...)
-			exist = true
-			break
-		}
+
+	if !bytes.Equal(passwd, passwd2) {
+		return nil, errors.New("password mismatch, try again")
 	}
 
-	if exist {
-		output, err := json.Marshal(users)
-		if err != nil {
-			log.Println("Failed to marshal passwords", err)
-			return
+	return passwd, nil
+}
+
+// delete the user, returns ErrUserNotFound if it does not exist
+func delUser(username []byte) error {
+	return userStore.Update(func(users []UserRecord) ([]UserRecord, error) {
+		for i, u := range users {
+			if bytes.Equal(u.User, username) {
+				return append(users[:i], users[i+1:]...), nil
+			}
 		}
 
-		os.WriteFile(userFileName, output, 0660)
+		return nil, ErrUserNotFound
+	})
+}
+
+func DelUser(username string) {
+	if err := delUser([]byte(username)); err != nil {
+		fmt.Println("Failed to delete user:", err)
 	}
 }
 
 func ListUsers() {
-	var users []UserRecord
-	var err error
+	users, err := userStore.Users()
 
-	file, err := os.ReadFile(userFileName)
 	if err != nil {
-		log.Println("Failed to read users file", err)
+		fmt.Println("Failed to read users file:", err)
 		return
 	}
 
-	err = json.Unmarshal(file, &users)
-
-	if err != nil {
-		log.Println("Failed to parse json format", err)
-		return
-	}
-	// update the existing user if it exists
 	fmt.Println("Users of the system:")
 	for _, u := range users {
 		fmt.Println("   ", string(u.User))
@@ -161,29 +191,25 @@ func ListUsers() {
 }
 
 func ValidateUser(username []byte, passwd []byte) bool {
-	var users []UserRecord
-	var err error
+	u, err := userStore.Get(username)
 
-	file, err := os.ReadFile(userFileName)
 	if err != nil {
-		log.Println("Failed to read users file", err)
-		return false
-	}
-
-	err = json.Unmarshal(file, &users)
+		if err != ErrUserNotFound {
+			log.Println("Failed to read users file", err)
+		}
 
-	if err != nil {
-		log.Println("Failed to parse json format", err)
 		return false
 	}
 
-	// update the existing user if it exists
-	for _, u := range users {
-		if bytes.Equal(u.User, []byte(username)) {
-			hashed := hashPassword(u.Seed, passwd)
-			return bytes.Equal(hashed[:], u.Passwd[:])
-		}
+	return u.check(passwd)
+}
+
+// check the password against the record
+func (u *UserRecord) check(passwd []byte) bool {
+	if u.Hash != "" {
+		return verifyHash(u.Hash, passwd)
 	}
 
-	return false
+	hashed := hashPassword(u.Seed, passwd)
+	return subtle.ConstantTimeCompare(hashed[:], u.Passwd[:]) == 1
 }
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+var (
+	ErrUserNotFound = errors.New("user does not exist")
+)
+
+// UserStore manages the users in user.db. Reads are served from memory
+// and the cache is reloaded when the file changes on disk. Updates are
+// serialized with a file lock and written atomically.
+type UserStore struct {
+	fname string
+
+	mtx   sync.Mutex
+	users []UserRecord
+	finfo os.FileInfo // the file that users is loaded from
+}
+
+// the store for ./user.db used by the commands and the web server
+var userStore = NewUserStore(userFileName)
+
+// SetDataFiles moves user.db and token.db, it must be called before
+// the users or tokens are used. Empty names keep the current files
+func SetDataFiles(userFile string, tokenFile string) {
+	if userFile != "" {
+		userStore = NewUserStore(userFile)
+	}
+
+	if tokenFile != "" {
+		tokenFileName = tokenFile
+	}
+}
+
+func NewUserStore(fname string) *UserStore {
+	return &UserStore{fname: fname}
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b) &&
+		a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// read the users from disk, a missing file means no users
+func (s *UserStore) read() ([]UserRecord, os.FileInfo, error) {
+	var users []UserRecord
+
+	finfo, err := os.Stat(s.fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+
+		return nil, nil, err
+	}
+
+	file, err := os.ReadFile(s.fname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := json.Unmarshal(file, &users); err != nil {
+		return nil, nil, err
+	}
+
+	return users, finfo, nil
+}
+
+// load returns the cached users, reload them if the file has changed
+func (s *UserStore) load() ([]UserRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	finfo, err := os.Stat(s.fname)
+	if err == nil && sameFile(finfo, s.finfo) {
+		return s.users, nil
+	}
+
+	users, finfo, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	s.users, s.finfo = users, finfo
+	return users, nil
+}
+
+// Users returns a copy of all the users
+func (s *UserStore) Users() ([]UserRecord, error) {
+	users, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]UserRecord(nil), users...), nil
+}
+
+// Get returns the user with the name
+func (s *UserStore) Get(username []byte) (UserRecord, error) {
+	users, err := s.load()
+	if err != nil {
+		return UserRecord{}, err
+	}
+
+	for _, u := range users {
+		if bytes.Equal(u.User, username) {
+			return u, nil
+		}
+	}
+
+	return UserRecord{}, ErrUserNotFound
+}
+
+// Update runs fn on the latest users from disk while holding the lock,
+// then writes the returned users back
+func (s *UserStore) Update(fn func(users []UserRecord) ([]UserRecord, error)) error {
+	unlock, err := lockFile(s.fname)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// always start from the file, another process may have changed it
+	users, _, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	users, err = fn(users)
+	if err != nil {
+		return err
+	}
+
+	if users == nil {
+		users = []UserRecord{}
+	}
+
+	output, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	if err := AtomicWriteFile(s.fname, output, 0660); err != nil {
+		return err
+	}
+
+	// force a reload on the next read
+	s.mtx.Lock()
+	s.finfo = nil
+	s.mtx.Unlock()
+
+	return nil
+}
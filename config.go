@@ -0,0 +1,391 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/logging"
+	"github.com/syssecfsu/witty/term_conn"
+	"github.com/syssecfsu/witty/web"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the content of the config file. The web options are inlined,
+// so their yaml tags are the top level keys. Every key can be overridden
+// by the environment, e.g., WITTY_PORT or WITTY_OIDC_CLIENT_SECRET, and
+// the run flags override both.
+type config struct {
+	Web     web.Options     `yaml:",inline"`
+	Auth    cmd.AuthConfig  `yaml:"auth"`
+	UserDB  string          `yaml:"user_db"`
+	TokenDB string          `yaml:"token_db"`
+	Log     logging.Options `yaml:"log"`
+
+	// generate a self-signed certificate if there is none
+	AutoCert  bool     `yaml:"auto_cert"`
+	CertHosts []string `yaml:"cert_hosts"`
+	CertDays  int      `yaml:"cert_days"`
+}
+
+const (
+	envPrefix = "WITTY"
+	envConfig = "WITTY_CONFIG" // the config file if --config is not given
+)
+
+func defaultConfig() config {
+	return config{
+		Web:     web.DefaultOptions(),
+		Auth:    cmd.AuthConfig{Backend: cmd.BackendJson, ShadowFile: "/etc/shadow"},
+		UserDB:  "./user.db",
+		TokenDB: "./token.db",
+		Log:     logging.DefaultOptions,
+
+		AutoCert:  true,
+		CertHosts: cmd.DefaultCertHosts(),
+		CertDays:  365,
+	}
+}
+
+// listFlag is a comma separated list flag, e.g., -trusted-proxies
+type listFlag struct {
+	list *[]string
+}
+
+func (l listFlag) String() string {
+	if l.list == nil {
+		return ""
+	}
+
+	return strings.Join(*l.list, ",")
+}
+
+func (l listFlag) Set(s string) error {
+	*l.list = splitList(s)
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// load reads the config file and the environment into conf
+func (conf *config) load(fname string) error {
+	if fname != "" {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+
+		// unknown keys are errors, they are most likely typos
+		if err := yaml.UnmarshalStrict(data, conf); err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+
+	return applyEnv(reflect.ValueOf(conf).Elem(), envPrefix)
+}
+
+// loadWithFlags loads the config while keeping the flags set on the
+// command line, which have the highest priority
+func (conf *config) loadWithFlags(fs *flag.FlagSet, fname string) error {
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	if err := conf.load(fname); err != nil {
+		return err
+	}
+
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// set the fields of v from the environment, the variable name is the
+// upper case yaml key prefixed by the keys of the parents
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+
+		if field.PkgPath != "" || tag[0] == "-" {
+			continue
+		}
+
+		fv := v.Field(i)
+
+		if len(tag) > 1 && tag[1] == "inline" {
+			if err := applyEnv(fv, prefix); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		key := prefix + "_" + strings.ToUpper(name)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, key); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case fv.Kind() == reflect.String:
+			fv.SetString(value)
+
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+			fv.Set(reflect.ValueOf(splitList(value)))
+
+		default:
+			// numbers, booleans, and durations like 10s
+			if err := yaml.Unmarshal([]byte(value), fv.Addr().Interface()); err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s", key, value, fv.Type())
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate checks the config and reports all the problems at once
+func (conf *config) validate() error {
+	var errs []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	opts := &conf.Web
+
+	check(opts.Port > 0 && opts.Port <= 65535, "port: %d is not between 1 and 65535", opts.Port)
+	check(len(opts.CmdToExec) > 0, "command: cannot be empty")
+
+	switch opts.Listen {
+	case web.ListenTLS:
+		// missing files are generated by autoCert
+		for _, f := range []struct {
+			key  string
+			name string
+		}{{"tls_cert", opts.TLSCert}, {"tls_key", opts.TLSKey}} {
+			_, err := os.Stat(f.name)
+			check(err == nil || (conf.AutoCert && os.IsNotExist(err)), "%s: %v", f.key, err)
+		}
+
+		check(opts.CertCheckPeriod > 0, "cert_check_period: must be positive")
+		check(!conf.AutoCert || len(conf.CertHosts) > 0, "cert_hosts: required with auto_cert")
+		check(!conf.AutoCert || conf.CertDays > 0, "cert_days: must be positive")
+
+	case web.ListenHTTP:
+		check(opts.ClientCert.CA == "", "client_cert: requires the tls listener")
+
+		for _, b := range opts.Bind {
+			check(web.IsLoopback(b), "bind: %s is not a loopback address, required by the http listener", b)
+		}
+
+	case web.ListenUnix:
+		check(opts.Socket != "", "socket: required with the unix listener")
+		_, err := web.ParseSocketMode(opts.SocketMode)
+		check(err == nil, "socket_mode: %v", err)
+		check(opts.ClientCert.CA == "", "client_cert: requires the tls listener")
+		check(len(opts.Bind) == 0, "bind: not used by the unix listener")
+
+	default:
+		check(false, "listen: unknown listener %q, expect tls, http, or unix", opts.Listen)
+	}
+
+	finfo, err := os.Stat(opts.RecordDir)
+	if err == nil {
+		check(finfo.IsDir(), "record_dir: %s is not a directory", opts.RecordDir)
+	} else {
+		check(false, "record_dir: %v", err)
+	}
+
+	check(opts.SessionFile != "", "session_file: cannot be empty")
+	check(conf.UserDB != "", "user_db: cannot be empty")
+	check(conf.TokenDB != "", "token_db: cannot be empty")
+
+	check(opts.SessionMaxAge > 0, "session_max_age: must be positive")
+	check(opts.AnonMaxAge > 0, "anon_max_age: must be positive")
+	check(opts.Term.WriteWait > 0, "term.write_wait: must be positive")
+	check(opts.Term.ViewWait > 0, "term.view_wait: must be positive")
+	check(opts.Term.PongWait > 0, "term.pong_wait: must be positive")
+	check(opts.Term.KillWait >= 0, "term.kill_wait: cannot be negative")
+	check(opts.Term.MaxMessageSize > 0, "term.max_message_size: must be positive")
+	err = term_conn.ValidCompress(opts.Term.Compress)
+	check(err == nil, "term.compress: %v", err)
+	check(!opts.Term.Encrypt || opts.Term.EncryptKeys != "", "term.encrypt_keys: required with term.encrypt")
+	check(opts.OIDC.Timeout > 0, "oidc.timeout: must be positive")
+	check(opts.ClientCert.CheckPeriod > 0, "client_cert.check_period: must be positive")
+
+	_, err = term_conn.ParseNets(opts.AllowedIPs)
+	check(err == nil, "allowed_ips: %v", err)
+	_, err = term_conn.ParseNets(opts.TrustedProxies)
+	check(err == nil, "trusted_proxies: %v", err)
+
+	check(opts.OIDC.Issuer == "" || opts.OIDC.ClientID != "", "oidc.client_id: required with oidc.issuer")
+	check(opts.ProxyHeader == "" || len(opts.TrustedProxies) > 0 || opts.Listen == web.ListenUnix,
+		"trusted_proxies: required with proxy_header")
+
+	_, err = logging.ParseLevel(conf.Log.Level)
+	check(err == nil, "log.level: %v", err)
+	check(conf.Log.Format == logging.FormatLogfmt || conf.Log.Format == logging.FormatJSON,
+		"log.format: unknown format %q, expect logfmt or json", conf.Log.Format)
+	check(conf.Log.Output != "", "log.output: cannot be empty")
+	check(conf.Log.MaxSize >= 0, "log.max_size: cannot be negative")
+	check(conf.Log.MaxAge >= 0, "log.max_age: cannot be negative")
+	check(conf.Log.MaxBackups >= 0, "log.max_backups: cannot be negative")
+
+	check(opts.Recording.Visibility == "" || cmd.ValidVisibility(opts.Recording.Visibility),
+		"recording.visibility: unknown visibility %q, expect private, team or public", opts.Recording.Visibility)
+
+	for _, role := range opts.Recording.Roles {
+		check(role == "admin" || role == "user", "recording.roles: unknown role %q, expect admin or user", role)
+	}
+
+	policy := &opts.Policy
+	check(policy.MinLength >= 0, "password_policy.min_length: cannot be negative")
+	check(policy.MaxLength == 0 || policy.MaxLength >= policy.MinLength,
+		"password_policy.max_length: smaller than min_length")
+	check(policy.MinClasses >= 0 && policy.MinClasses <= 4, "password_policy.min_classes: must be between 0 and 4")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	return nil
+}
+
+// autoCert generates a self-signed certificate on the first run, when
+// neither the certificate nor the key exists
+func (conf *config) autoCert() error {
+	opts := &conf.Web
+
+	if !conf.AutoCert || opts.Listen != web.ListenTLS {
+		return nil
+	}
+
+	_, cerr := os.Stat(opts.TLSCert)
+	_, kerr := os.Stat(opts.TLSKey)
+
+	if !os.IsNotExist(cerr) || !os.IsNotExist(kerr) {
+		return nil
+	}
+
+	if err := cmd.GenCert(opts.TLSCert, opts.TLSKey, conf.CertHosts, conf.CertDays, false); err != nil {
+		return err
+	}
+
+	fmt.Println("Generated a self-signed certificate", opts.TLSCert, "for", strings.Join(conf.CertHosts, ", "))
+	return nil
+}
+
+// loadSignKey loads the key to sign the recordings, it is generated on
+// the first run
+func (conf *config) loadSignKey() error {
+	term := &conf.Web.Term
+
+	if term.SignKey == "" {
+		return nil
+	}
+
+	_, err := os.Stat(term.SignKey)
+	created := os.IsNotExist(err)
+
+	key, err := cmd.LoadSignKey(term.SignKey, true)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		fmt.Println("Generated the key to sign the recordings", term.SignKey)
+	}
+
+	term.Signer = key
+	return nil
+}
+
+// loadRecordKeys loads the keys to encrypt and decrypt the recordings. The
+// key ring is generated on the first run with encryption enabled
+func (conf *config) loadRecordKeys(create bool) error {
+	term := &conf.Web.Term
+
+	if term.EncryptKeys == "" {
+		return nil
+	}
+
+	_, err := os.Stat(term.EncryptKeys)
+	missing := os.IsNotExist(err)
+
+	// without encryption, the keys only decrypt the old recordings
+	if missing && !create {
+		return nil
+	}
+
+	ring, err := cmd.LoadRecordKeys(term.EncryptKeys, create)
+	if err != nil {
+		return err
+	}
+
+	if missing {
+		fmt.Println("Generated the key to encrypt the recordings", term.EncryptKeys)
+	}
+
+	term.Keys = ring
+	return nil
+}
+
+// loadEnvConfig loads the config file in WITTY_CONFIG and the environment for
+// the commands other than run, so that they use the same files as the server
+func loadEnvConfig() config {
+	conf := defaultConfig()
+
+	if err := conf.load(os.Getenv(envConfig)); err != nil {
+		fmt.Println("Failed to load the configuration:", err)
+		os.Exit(1)
+	}
+
+	cmd.SetDataFiles(conf.UserDB, conf.TokenDB)
+
+	// to read the encrypted recordings
+	if err := conf.loadRecordKeys(false); err != nil {
+		fmt.Println("Failed to load the recording keys:", err)
+	}
+
+	term_conn.SetRecordKeys(conf.Web.Term.Keys)
+	cmd.SetRecordFormat(conf.Web.Term.Compress, conf.Web.Term.Encrypt)
+	return conf
+}
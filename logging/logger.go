@@ -0,0 +1,300 @@
+// Package logging is a small leveled logger with key value fields. Records
+// are written in logfmt or JSON, to a rotating file or to stderr.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// syslog priorities of the levels, understood by journald on stderr
+var levelPrios = []int{7, 6, 4, 3}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q, expect debug, info, warn, or error", s)
+}
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+
+	OutputStderr   = "stderr"
+	OutputJournald = "journald" // stderr with syslog priorities and without time
+)
+
+// Options of the logger, the yaml tags are the keys in the config file
+type Options struct {
+	Level      string        `yaml:"level"`       // debug, info, warn, or error
+	Format     string        `yaml:"format"`      // logfmt or json
+	Output     string        `yaml:"output"`      // a file, stderr, or journald
+	MaxSize    int64         `yaml:"max_size"`    // rotate the file at this size in MB, 0 to disable
+	MaxAge     time.Duration `yaml:"max_age"`     // rotate the file at this age, 0 to disable
+	MaxBackups int           `yaml:"max_backups"` // rotated files to keep, 0 to keep all
+}
+
+// DefaultOptions logs to witty.log, which is rotated instead of truncated
+var DefaultOptions = Options{
+	Level:      "info",
+	Format:     FormatLogfmt,
+	Output:     "witty.log",
+	MaxSize:    100,
+	MaxAge:     0,
+	MaxBackups: 5,
+}
+
+// the destination shared by a logger and the loggers derived from it
+type sink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+type Logger struct {
+	sink     *sink
+	level    Level
+	json     bool
+	journald bool
+	fields   []interface{} // key value pairs added to every record
+}
+
+// New creates the logger, Close it to close the log file
+func New(opts *Options) (*Logger, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Logger{level: level}
+
+	switch opts.Format {
+	case "", FormatLogfmt:
+	case FormatJSON:
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expect logfmt or json", opts.Format)
+	}
+
+	switch opts.Output {
+	case "", OutputStderr:
+		l.sink = &sink{w: os.Stderr}
+
+	case OutputJournald:
+		l.sink = &sink{w: os.Stderr}
+		l.journald = true
+
+	default:
+		rot, err := openRotator(opts.Output, opts.MaxSize*1024*1024, opts.MaxAge, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+
+		l.sink = &sink{w: rot}
+	}
+
+	return l, nil
+}
+
+// Default logs info and above to stderr, it is used until the logger
+// from the options is set up
+func Default() *Logger {
+	return &Logger{sink: &sink{w: os.Stderr}, level: LevelInfo}
+}
+
+// Close closes the log file, if any
+func (l *Logger) Close() error {
+	l.sink.mtx.Lock()
+	defer l.sink.mtx.Unlock()
+
+	if c, ok := l.sink.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// With returns a logger that adds the key value pairs to every record
+func (l *Logger) With(kv ...interface{}) *Logger {
+	nl := *l
+	nl.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &nl
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Log logs at the level, e.g., one decided at runtime
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) { l.log(level, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	if l.journald {
+		buf.WriteString("<" + strconv.Itoa(levelPrios[level]) + ">")
+	}
+
+	var pairs []interface{}
+
+	if !l.journald {
+		pairs = append(pairs, "time", time.Now().Format(time.RFC3339Nano))
+	}
+
+	pairs = append(pairs, "level", level.String(), "msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+
+	if l.json {
+		writeJSON(&buf, pairs)
+	} else {
+		writeLogfmt(&buf, pairs)
+	}
+
+	buf.WriteByte('\n')
+
+	l.sink.mtx.Lock()
+	l.sink.w.Write(buf.Bytes())
+	l.sink.mtx.Unlock()
+}
+
+// the key of the i-th pair, a missing value is reported as !MISSING
+func pairAt(pairs []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(pairs[i])
+
+	if i+1 < len(pairs) {
+		return key, pairs[i+1]
+	}
+
+	return key, "!MISSING"
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	case time.Duration:
+		return val.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeLogfmt(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		key, val := pairAt(pairs, i)
+
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(key)
+		buf.WriteByte('=')
+
+		s := toString(val)
+		if s == "" || strings.IndexFunc(s, needQuote) >= 0 {
+			s = strconv.Quote(s)
+		}
+
+		buf.WriteString(s)
+	}
+}
+
+func needQuote(r rune) bool {
+	return r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+}
+
+func writeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+
+	for i := 0; i < len(pairs); i += 2 {
+		key, val := pairAt(pairs, i)
+
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		// errors and stringers are logged as text, numbers and booleans as is
+		switch val.(type) {
+		case error, fmt.Stringer, time.Duration:
+			val = toString(val)
+		}
+
+		v, err := json.Marshal(val)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(val))
+		}
+
+		buf.Write(v)
+	}
+
+	buf.WriteByte('}')
+}
+
+// lineWriter logs each line written to it, e.g., from the standard logger
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			w.l.log(w.level, line, nil)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Writer returns a writer that logs each line at the level
+func (l *Logger) Writer(level Level) io.Writer {
+	return lineWriter{l: l, level: level}
+}
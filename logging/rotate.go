@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// rotator is a log file that is renamed to <file>.<time> when it grows
+// too large or too old, a new file is started in its place
+type rotator struct {
+	fname      string
+	maxSize    int64         // in bytes, 0 to disable
+	maxAge     time.Duration // 0 to disable
+	maxBackups int           // 0 to keep all
+
+	fp     *os.File
+	size   int64
+	opened time.Time
+}
+
+const backupTimeFormat = "20060102-150405.000"
+
+func openRotator(fname string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotator, error) {
+	r := &rotator{fname: fname, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// open the log file for appending, the old logs are kept
+func (r *rotator) open() error {
+	fp, err := os.OpenFile(r.fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	finfo, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	r.fp = fp
+	r.size = finfo.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotator) Write(p []byte) (int, error) {
+	if r.fp == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooLarge := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	tooOld := r.maxAge > 0 && time.Since(r.opened) >= r.maxAge
+
+	if tooLarge || tooOld {
+		// keep logging to the old file if the rotation fails
+		if err := r.rotate(); err != nil && r.fp == nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.fp.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotator) rotate() error {
+	backup := r.fname + "." + time.Now().Format(backupTimeFormat)
+
+	if err := os.Rename(r.fname, backup); err != nil {
+		return err
+	}
+
+	r.fp.Close()
+	r.fp = nil
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.prune()
+	return nil
+}
+
+// remove the oldest backups, the time in the names sorts in order
+func (r *rotator) prune() {
+	if r.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(r.fname + ".*")
+	if err != nil || len(backups) <= r.maxBackups {
+		return
+	}
+
+	sort.Strings(backups)
+
+	for _, b := range backups[:len(backups)-r.maxBackups] {
+		os.Remove(b)
+	}
+}
+
+func (r *rotator) Close() error {
+	if r.fp == nil {
+		return nil
+	}
+
+	err := r.fp.Close()
+	r.fp = nil
+	return err
+}
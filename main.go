@@ -7,33 +7,99 @@ import (
 	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/logging"
+	"github.com/syssecfsu/witty/term_conn"
 	"github.com/syssecfsu/witty/web"
 )
 
 const (
-	subcmds = "witty (adduser|deluser|listusers|replay|merge|run)"
+	subcmds = "witty (adduser|deluser|listusers|importusers|exportusers|token|gencert|replay|merge|export|import|verify|pubkey|compress|encrypt|run)"
+	tokcmds = "witty token (create|list|revoke)"
 )
 
 //go:embed assets/*
 var fullAssets embed.FS
 
+// add the flags of the password policy to the command
+func policyFlags(fs *flag.FlagSet, policy *cmd.PasswordPolicy) {
+	def := cmd.DefaultPolicy
+	fs.IntVar(&policy.MinLength, "min-length", def.MinLength, "Minimal password length in bytes")
+	fs.IntVar(&policy.MaxLength, "max-length", def.MaxLength, "Maximal password length in bytes (0 for no limit)")
+	fs.IntVar(&policy.MinClasses, "min-classes", def.MinClasses, "Required classes of lower, upper, digit, and other characters")
+	fs.BoolVar(&policy.AllowUsername, "allow-username", def.AllowUsername, "Allow the password to contain the user name")
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println(subcmds)
 		return
 	}
 
+	// the other commands share the files with the server
+	var envConf config
+	if os.Args[1] != "run" {
+		envConf = loadEnvConfig()
+	}
+
 	switch os.Args[1] {
 	case "adduser":
-		if len(os.Args) != 3 {
-			fmt.Println("witty adduser <username>")
+		var opts cmd.AddUserOptions
+		addCmd := flag.NewFlagSet("adduser", flag.ExitOnError)
+		addCmd.BoolVar(&opts.PasswdStdin, "password-stdin", false, "Read the password from the first line of stdin")
+		addCmd.StringVar(&opts.PasswdHash, "password-hash", "", "Use the pre-hashed password (crypt(3) or exported witty hash)")
+		addCmd.BoolVar(&opts.Admin, "admin", false, "Make the user an administrator, --admin=false demotes an existing one")
+		policyFlags(addCmd, &opts.Policy)
+
+		addCmd.Parse(os.Args[2:])
+
+		// existing users keep their role unless --admin is given
+		addCmd.Visit(func(f *flag.Flag) {
+			opts.AdminSet = opts.AdminSet || f.Name == "admin"
+		})
+
+		if len(addCmd.Args()) != 1 {
+			fmt.Println("witty adduser [--admin[=false]] [--password-stdin | --password-hash hash] <username>")
+			return
+		}
+		cmd.AddUser(addCmd.Arg(0), &opts)
+
+	case "importusers":
+		var format string
+		var update bool
+		var policy cmd.PasswordPolicy
+
+		importCmd := flag.NewFlagSet("importusers", flag.ExitOnError)
+		importCmd.StringVar(&format, "format", cmd.FormatCSV, "Format of the file (csv|json)")
+		importCmd.BoolVar(&update, "update", false, "Update the password of existing users, and their role if the admin field is set")
+		policyFlags(importCmd, &policy)
+
+		importCmd.Parse(os.Args[2:])
+
+		if len(importCmd.Args()) != 1 {
+			fmt.Println("witty importusers [--format csv|json] [--update] <file|->")
 			return
 		}
-		cmd.AddUser(os.Args[2])
+		cmd.ImportUsers(importCmd.Arg(0), format, update, &policy)
+
+	case "exportusers":
+		var format string
+
+		exportCmd := flag.NewFlagSet("exportusers", flag.ExitOnError)
+		exportCmd.StringVar(&format, "format", cmd.FormatCSV, "Format of the file (csv|json)")
+
+		exportCmd.Parse(os.Args[2:])
+
+		fname := "-"
+		if len(exportCmd.Args()) > 0 {
+			fname = exportCmd.Arg(0)
+		}
+		cmd.ExportUsers(fname, format)
 
 	case "deluser":
 		if len(os.Args) != 3 {
@@ -45,6 +111,76 @@ func main() {
 	case "listusers":
 		cmd.ListUsers()
 
+	case "token":
+		if len(os.Args) < 3 {
+			fmt.Println(tokcmds)
+			return
+		}
+
+		switch os.Args[2] {
+		case "create":
+			var name, scopes string
+			var days uint
+
+			createCmd := flag.NewFlagSet("token create", flag.ExitOnError)
+			createCmd.StringVar(&name, "n", "", "Name of the token")
+			createCmd.StringVar(&name, "name", "", "Name of the token")
+			createCmd.StringVar(&scopes, "s", strings.Join(cmd.AllScopes, ","), "Comma separated scopes of the token")
+			createCmd.StringVar(&scopes, "scopes", strings.Join(cmd.AllScopes, ","), "Comma separated scopes of the token")
+			createCmd.UintVar(&days, "e", 0, "Expire the token after days (0 for never)")
+			createCmd.UintVar(&days, "expire", 0, "Expire the token after days (0 for never)")
+
+			createCmd.Parse(os.Args[3:])
+
+			if len(createCmd.Args()) != 1 {
+				fmt.Println("witty token create [-n name] [-s scopes] [-e days] <username>")
+				return
+			}
+
+			cmd.CreateToken(createCmd.Arg(0), name, strings.Split(scopes, ","),
+				time.Duration(days)*24*time.Hour)
+
+		case "list":
+			username := ""
+			if len(os.Args) > 3 {
+				username = os.Args[3]
+			}
+
+			cmd.ListTokens(username)
+
+		case "revoke":
+			if len(os.Args) != 4 {
+				fmt.Println("witty token revoke <id>")
+				return
+			}
+
+			cmd.RevokeToken(os.Args[3])
+
+		default:
+			fmt.Println(tokcmds)
+		}
+
+	case "gencert":
+		var certFile, keyFile, hosts string
+		var days int
+		var force bool
+
+		certCmd := flag.NewFlagSet("gencert", flag.ExitOnError)
+		certCmd.StringVar(&certFile, "cert", envConf.Web.TLSCert, "Certificate file to create")
+		certCmd.StringVar(&keyFile, "key", envConf.Web.TLSKey, "Private key file to create")
+		certCmd.StringVar(&hosts, "hosts", strings.Join(envConf.CertHosts, ","), "Comma separated host names and IP addresses of the server")
+		certCmd.IntVar(&days, "days", envConf.CertDays, "Days the certificate is valid")
+		certCmd.BoolVar(&force, "force", false, "Replace the existing certificate and key")
+
+		certCmd.Parse(os.Args[2:])
+
+		if err := cmd.GenCert(certFile, keyFile, splitList(hosts), days, force); err != nil {
+			fmt.Println("Failed to generate the certificate:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Generated a self-signed certificate", certFile, "and its key", keyFile)
+
 	case "replay":
 		var wait uint
 		replayCmd := flag.NewFlagSet("replay", flag.ExitOnError)
@@ -78,10 +214,236 @@ func main() {
 
 		cmd.Merge(mergeCmd.Args(), output)
 
+	case "verify":
+		var keyFile string
+
+		verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+		verifyCmd.StringVar(&keyFile, "key", envConf.Web.Term.SignKey, "Public or private key that signed the recordings")
+
+		verifyCmd.Parse(os.Args[2:])
+
+		if len(verifyCmd.Args()) < 1 {
+			fmt.Println("witty verify [-key file] <recorded> ...")
+			return
+		}
+
+		pub, err := cmd.LoadVerifyKey(keyFile)
+		if err != nil {
+			fmt.Println("Failed to load the key, only the hashes are checked, not the signatures:", err)
+		}
+
+		failed := false
+
+		for _, fname := range verifyCmd.Args() {
+			store, name := cmd.RecordStoreOf(fname)
+			v, err := store.Verify(name, pub)
+
+			if err != nil {
+				fmt.Println(fname+": FAILED,", err)
+				failed = true
+				continue
+			}
+
+			if v.Unsigned {
+				fmt.Println(fname+": hashes OK,", v.Records, "records, the signature by key", v.Key, "is NOT checked")
+				continue
+			}
+
+			fmt.Println(fname+": OK,", v.Records, "records signed by key", v.Key)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+
+	case "pubkey":
+		var output string
+
+		pubCmd := flag.NewFlagSet("pubkey", flag.ExitOnError)
+		pubCmd.StringVar(&output, "o", "record-key.pub.pem", "Output file of the public key")
+		pubCmd.StringVar(&output, "output", "record-key.pub.pem", "Output file of the public key")
+
+		pubCmd.Parse(os.Args[2:])
+
+		if err := cmd.WritePublicKey(envConf.Web.Term.SignKey, output); err != nil {
+			fmt.Println("Failed to write the public key:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Wrote the public key of", envConf.Web.Term.SignKey, "to", output)
+
+	case "export":
+		var format, output string
+
+		exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+		exportCmd.StringVar(&format, "f", cmd.FormatAsciicast, "Export format (asciicast)")
+		exportCmd.StringVar(&format, "format", cmd.FormatAsciicast, "Export format (asciicast)")
+		exportCmd.StringVar(&output, "o", "", "Output file (default the recording name with .cast)")
+		exportCmd.StringVar(&output, "output", "", "Output file (default the recording name with .cast)")
+
+		exportCmd.Parse(os.Args[2:])
+
+		if len(exportCmd.Args()) != 1 {
+			fmt.Println("witty export [--format asciicast] [-o output] <recorded>")
+			return
+		}
+
+		fname := exportCmd.Arg(0)
+
+		if output == "" {
+			output = strings.TrimSuffix(filepath.Base(fname), ".scr") + ".cast"
+		}
+
+		if err := cmd.Export(fname, output, format); err != nil {
+			fmt.Println("Failed to export the recording:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Exported", fname, "to", output)
+
+	case "import":
+		var output, owner string
+
+		importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+		importCmd.StringVar(&output, "o", "", "Output recording (default in the record directory)")
+		importCmd.StringVar(&output, "output", "", "Output recording (default in the record directory)")
+		importCmd.StringVar(&owner, "owner", "", "The user who owns the recording (default only the administrators)")
+
+		importCmd.Parse(os.Args[2:])
+
+		if len(importCmd.Args()) != 1 {
+			fmt.Println("witty import [-o output] [--owner user] <file.cast>")
+			return
+		}
+
+		fname := importCmd.Arg(0)
+		store := cmd.NewRecordStore(envConf.Web.RecordDir)
+		name := ""
+
+		if output == "" {
+			name = strings.TrimSuffix(filepath.Base(fname), ".cast") + cmd.RecordExt
+
+			var err error
+			if output, err = store.Path(name); err != nil {
+				fmt.Println("Cannot import to", name+":", err)
+				os.Exit(1)
+			}
+		}
+
+		if !strings.HasSuffix(output, cmd.RecordExt) {
+			output += cmd.RecordExt
+		}
+
+		if err := cmd.Import(fname, output); err != nil {
+			fmt.Println("Failed to import the asciicast file:", err)
+			os.Exit(1)
+		}
+
+		if name != "" {
+			err := store.UpdateMeta(name, func(meta *cmd.RecordMeta) bool {
+				meta.Owner = owner
+				return true
+			})
+
+			if err != nil {
+				fmt.Println("Failed to update the record index:", err)
+			}
+		}
+
+		fmt.Println("Imported", fname, "to", output)
+
+	case "compress":
+		method := envConf.Web.Term.Compress
+		if method == "" || method == term_conn.CompressNone {
+			method = term_conn.CompressZstd
+		}
+
+		var force bool
+
+		compressCmd := flag.NewFlagSet("compress", flag.ExitOnError)
+		compressCmd.StringVar(&method, "m", method, "Compression (gzip|zstd|none to decompress)")
+		compressCmd.StringVar(&method, "method", method, "Compression (gzip|zstd|none to decompress)")
+		compressCmd.BoolVar(&force, "force", false, "Also convert the recordings that are not closed, the server must not be recording them")
+
+		compressCmd.Parse(os.Args[2:])
+
+		// all the recordings by default
+		fnames := compressCmd.Args()
+		if len(fnames) == 0 {
+			fnames, _ = cmd.NewRecordStore(envConf.Web.RecordDir).Paths()
+		}
+
+		if err := cmd.CompressRecords(fnames, method, force); err != nil {
+			fmt.Println("Failed to compress the recordings:", err)
+			os.Exit(1)
+		}
+
+	case "encrypt":
+		var rotate, prune, decrypt, force bool
+
+		encryptCmd := flag.NewFlagSet("encrypt", flag.ExitOnError)
+		encryptCmd.BoolVar(&rotate, "rotate", false, "Make a new current key and re-encrypt the recordings with it")
+		encryptCmd.BoolVar(&prune, "prune", false, "Remove the old keys no recording uses any more")
+		encryptCmd.BoolVar(&decrypt, "d", false, "Decrypt the recordings")
+		encryptCmd.BoolVar(&decrypt, "decrypt", false, "Decrypt the recordings")
+		encryptCmd.BoolVar(&force, "force", false, "Also rewrite the recordings that are not closed, the server must not be recording them")
+
+		encryptCmd.Parse(os.Args[2:])
+
+		keyFile := envConf.Web.Term.EncryptKeys
+		if keyFile == "" {
+			fmt.Println("No key ring is configured in term.encrypt_keys")
+			os.Exit(1)
+		}
+
+		if rotate {
+			ring, err := cmd.RotateRecordKey(keyFile)
+			if err != nil {
+				fmt.Println("Failed to rotate the key:", err)
+				os.Exit(1)
+			}
+
+			term_conn.SetRecordKeys(ring)
+			fmt.Println("The new key is", ring.Current)
+		} else if !decrypt && envConf.Web.Term.Keys == nil {
+			ring, err := cmd.LoadRecordKeys(keyFile, true)
+			if err != nil {
+				fmt.Println("Failed to create the key:", err)
+				os.Exit(1)
+			}
+
+			term_conn.SetRecordKeys(ring)
+			fmt.Println("Generated the key to encrypt the recordings", keyFile)
+		}
+
+		// all the recordings by default
+		fnames := encryptCmd.Args()
+		if len(fnames) == 0 {
+			fnames, _ = cmd.NewRecordStore(envConf.Web.RecordDir).Paths()
+		}
+
+		if err := cmd.EncryptRecords(fnames, decrypt, force); err != nil {
+			fmt.Println("Failed to encrypt the recordings:", err)
+			os.Exit(1)
+		}
+
+		// keep the old keys if any recording failed or was skipped
+		if prune {
+			if err := cmd.PruneRecordKeys(keyFile, cmd.NewRecordStore(envConf.Web.RecordDir)); err != nil {
+				fmt.Println("Failed to remove the old keys:", err)
+				os.Exit(1)
+			}
+		}
+
 	case "run":
-		// setup the web options
-		var options web.Options
+		// setup the web options, defaults < config file < environment < flags
+		conf := defaultConfig()
+		options := &conf.Web
+		var confFile string
+
 		runCmd := flag.NewFlagSet("run", flag.ExitOnError)
+		runCmd.StringVar(&confFile, "c", os.Getenv(envConfig), "YAML config file")
+		runCmd.StringVar(&confFile, "config", os.Getenv(envConfig), "YAML config file")
 		runCmd.BoolVar(&options.NoAuth, "n", false, "Run WiTTY without user authentication")
 		runCmd.BoolVar(&options.NoAuth, "naked", false, "Run WiTTY without user authentication")
 		runCmd.UintVar(&options.Port, "p", 8080, "Port number to listen on")
@@ -89,37 +451,127 @@ func main() {
 		runCmd.UintVar(&options.Wait, "w", 1000, "Max wait time between outputs")
 		runCmd.UintVar(&options.Wait, "wait", 1000, "Max wait time between outputs")
 
-		fp, err := os.OpenFile("witty.log", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		// plain HTTP and Unix sockets are for running behind a reverse proxy
+		runCmd.StringVar(&options.Listen, "listen", web.ListenTLS, "Listener (tls|http|unix), http only listens on the loopback")
+		runCmd.StringVar(&options.Socket, "socket", options.Socket, "Path of the Unix socket for the unix listener")
+		runCmd.StringVar(&options.SocketMode, "socket-mode", options.SocketMode, "Permissions of the Unix socket in octal")
+		runCmd.Var(listFlag{&options.AllowedOrigins}, "allowed-origins", "Comma separated origins allowed to open websockets (default the host)")
+		runCmd.Var(listFlag{&options.Bind}, "bind", "Comma separated addresses to listen on, e.g., 127.0.0.1,::1 (default all)")
+		runCmd.Var(listFlag{&options.AllowedIPs}, "allowed-ips", "Comma separated CIDRs of the clients allowed to connect (default all)")
+		runCmd.BoolVar(&conf.AutoCert, "auto-cert", true, "Generate a self-signed certificate if there is none")
+		runCmd.BoolVar(&options.Term.RecordInput, "record-input", false, "Also record the keyboard input, masked at password prompts")
+		runCmd.BoolVar(&options.Recording.Mandatory, "record-all", false, "Record every session, only administrators can stop it")
+		runCmd.StringVar(&options.Term.Compress, "compress", options.Term.Compress, "Compress the recordings (none|gzip|zstd)")
+		runCmd.BoolVar(&options.Term.Encrypt, "encrypt", options.Term.Encrypt, "Encrypt the recordings at rest")
 
-		if err == nil {
-			defer fp.Close()
-			log.SetOutput(fp)
-		}
+		// logging, to a rotated file by default
+		runCmd.StringVar(&conf.Log.Level, "log-level", conf.Log.Level, "Log level (debug|info|warn|error)")
+		runCmd.StringVar(&conf.Log.Format, "log-format", conf.Log.Format, "Log format (logfmt|json)")
+		runCmd.StringVar(&conf.Log.Output, "log-output", conf.Log.Output, "Log file, stderr, or journald (stderr with syslog priorities)")
+
+		// authentication backend, user.db by default
+		authConf := &conf.Auth
+		runCmd.StringVar(&authConf.Backend, "auth", cmd.BackendJson, "Authentication backend (json|htpasswd|ldap|shadow)")
+		runCmd.StringVar(&authConf.Htpasswd, "htpasswd", "", "Path of the htpasswd file for the htpasswd backend")
+		runCmd.StringVar(&authConf.ShadowFile, "shadow", "/etc/shadow", "Path of the shadow file for the shadow backend")
+		runCmd.StringVar(&authConf.LdapURL, "ldap-url", "", "LDAP server for the ldap backend, e.g., ldaps://ldap.example.com")
+		runCmd.StringVar(&authConf.LdapBindDN, "ldap-dn", "", "DN template for LDAP bind, e.g., uid=%s,ou=people,dc=example,dc=com")
+		runCmd.Var(listFlag{&authConf.Admins}, "admins", "Comma separated administrators of the htpasswd, ldap or shadow backend")
+
+		// single sign-on with OpenID Connect, in addition to the login form
+		runCmd.StringVar(&options.OIDC.Issuer, "oidc-issuer", "", "OpenID Connect issuer URL, enables single sign-on")
+		runCmd.StringVar(&options.OIDC.ClientID, "oidc-client-id", "", "OpenID Connect client ID")
+		runCmd.StringVar(&options.OIDC.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+		runCmd.StringVar(&options.OIDC.RedirectURL, "oidc-redirect", "", "OpenID Connect redirect URL (default https://<host>/login/oidc/callback)")
+		runCmd.StringVar(&options.OIDC.UserClaim, "oidc-user-claim", "email", "ID token claim used as the user name")
+		runCmd.StringVar(&options.OIDC.AdminGroup, "oidc-admin-group", "", "Members of this group are administrators")
+		runCmd.Var(listFlag{&options.OIDC.Groups}, "oidc-groups", "Comma separated groups allowed to login (default all)")
+
+		// authentication by a reverse proxy
+		runCmd.StringVar(&options.ProxyHeader, "proxy-header", "", "Header with the user name set by a trusted reverse proxy, e.g., X-Remote-User")
+		runCmd.Var(listFlag{&options.TrustedProxies}, "trusted-proxies", "Comma separated CIDRs of trusted reverse proxies")
+		runCmd.Var(listFlag{&options.ProxyAdmins}, "proxy-admins", "Comma separated users from the proxy who are administrators")
 
-		options.LogFile = fp
+		// authentication by TLS client certificates
+		runCmd.StringVar(&options.ClientCert.CA, "client-ca", "", "Require client certificates signed by this CA (PEM)")
+		runCmd.StringVar(&options.ClientCert.CRL, "client-crl", "", "CRL of the client CA, reloaded when changed")
+		runCmd.StringVar(&options.ClientCert.UserField, "client-user", "cn", "Client certificate field used as the user name (cn|email)")
+		runCmd.Var(listFlag{&options.ClientCert.Admins}, "client-admins", "Comma separated users of client certificates who are administrators")
+
+		// password policy for password changes in the web UI
+		policyFlags(runCmd, &options.Policy)
 
 		runCmd.Parse(os.Args[2:])
 
-		var cmdToExec []string
-		args := runCmd.Args()
-		if len(args) > 0 {
-			cmdToExec = args
-		} else {
-			cmdToExec = []string{"bash"}
+		if err := conf.loadWithFlags(runCmd, confFile); err != nil {
+			fmt.Println("Failed to load the configuration:", err)
+			os.Exit(1)
+		}
+
+		if args := runCmd.Args(); len(args) > 0 {
+			options.CmdToExec = args
+		}
+
+		if err := conf.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if err := conf.autoCert(); err != nil {
+			fmt.Println("Failed to generate the certificate:", err)
+			os.Exit(1)
+		}
+
+		if err := conf.loadSignKey(); err != nil {
+			fmt.Println("Failed to load the recording signing key:", err)
+			os.Exit(1)
+		}
+
+		if err := conf.loadRecordKeys(options.Term.Encrypt); err != nil {
+			fmt.Println("Failed to load the recording keys:", err)
+			os.Exit(1)
+		}
+
+		cmd.SetRecordFormat(options.Term.Compress, options.Term.Encrypt)
+
+		cmd.SetDataFiles(conf.UserDB, conf.TokenDB)
+
+		// the log file is appended to and rotated, never truncated
+		logger, err := logging.New(&conf.Log)
+
+		if err != nil {
+			fmt.Println("Failed to open the log:", err)
+			os.Exit(1)
 		}
 
-		options.CmdToExec = cmdToExec
+		defer logger.Close()
+
+		// catch the messages of the packages still using the standard logger
+		log.SetFlags(0)
+		log.SetOutput(logger.Writer(logging.LevelInfo))
+
+		options.Logger = logger
+
+		if !options.NoAuth {
+			options.Auth, err = cmd.NewAuthenticator(authConf)
+
+			if err != nil {
+				logger.Error("Failed to setup authentication", "err", err)
+				os.Exit(1)
+			}
+		}
 
 		// we need to strip the top level directory for Gin to find the files
 		assets, err := fs.Sub(fullAssets, "assets")
 
 		if err != nil {
-			log.Fatal("Failed to load assets", err)
+			logger.Error("Failed to load assets", "err", err)
+			os.Exit(1)
 		}
 
 		options.Assets = assets
 
-		web.StartWeb(&options)
+		web.StartWeb(options)
 
 	default:
 		fmt.Println(subcmds)
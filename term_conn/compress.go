@@ -0,0 +1,160 @@
+package term_conn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Recordings can be compressed with gzip or zstd. The file name is the
+// same, the compression is detected by the magic bytes, so all the readers
+// handle compressed and plain recordings alike. The compressor is flushed
+// after every line, the records written so far can still be read back if
+// witty crashes.
+
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Compressor compresses the recording as it is written
+type Compressor struct {
+	w  io.Writer
+	zw compressWriter // nil if not compressed
+}
+
+// ValidCompress checks the compression method
+func ValidCompress(method string) error {
+	switch method {
+	case "", CompressNone, CompressGzip, CompressZstd:
+		return nil
+	}
+
+	return fmt.Errorf("unknown compression %q, expect %s, %s or %s", method, CompressNone, CompressGzip, CompressZstd)
+}
+
+func newCompressWriter(w io.Writer, method string) (compressWriter, error) {
+	switch method {
+	case "", CompressNone:
+		return nil, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	}
+
+	return nil, ValidCompress(method)
+}
+
+// NewCompressor returns the writer that compresses to w with the method.
+// Every write is flushed, write whole lines to keep the file readable
+func NewCompressor(w io.Writer, method string) (*Compressor, error) {
+	zw, err := newCompressWriter(w, method)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Compressor{w: w, zw: zw}, nil
+}
+
+func (c *Compressor) Write(p []byte) (int, error) {
+	var n int
+	var err error
+
+	if c.zw == nil {
+		n, err = c.w.Write(p)
+	} else if n, err = c.zw.Write(p); err == nil {
+		err = c.zw.Flush()
+	}
+
+	// flush the encryption too
+	if f, ok := c.w.(interface{ Flush() error }); ok && err == nil {
+		err = f.Flush()
+	}
+
+	return n, err
+}
+
+// Close ends the compressed stream, the underlying writer is not closed
+func (c *Compressor) Close() error {
+	if c.zw == nil {
+		return nil
+	}
+
+	return c.zw.Close()
+}
+
+// Compression detects the compression method of the recording
+func Compression(br *bufio.Reader) string {
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressZstd
+	}
+
+	return CompressNone
+}
+
+// Decompress returns the plain content of the recording, compressed or not
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	switch Compression(br) {
+	case CompressGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return &cutReader{zr, zr.Close}, nil
+
+	case CompressZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return &cutReader{zr, func() error { zr.Close(); return nil }}, nil
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+// the compressed stream has no end if witty crashed, which is just the
+// end of the recording
+type cutReader struct {
+	r     io.Reader
+	close func() error
+}
+
+func (cr *cutReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (cr *cutReader) Close() error {
+	return cr.close()
+}
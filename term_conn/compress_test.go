@@ -0,0 +1,94 @@
+package term_conn
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	plain, _ := signedRecording(t)
+	ring := testKeyRing(t)
+
+	SetRecordKeys(ring)
+	defer SetRecordKeys(nil)
+
+	for _, method := range []string{CompressNone, CompressGzip, CompressZstd} {
+		for _, encrypted := range []bool{false, true} {
+			var buf bytes.Buffer
+			var w io.Writer = &buf
+			var enc *Encrypter
+
+			if encrypted {
+				var err error
+				if enc, err = NewEncrypter(&buf, ring); err != nil {
+					t.Fatal(err)
+				}
+
+				w = enc
+			}
+
+			cw, err := NewCompressor(w, method)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// line by line like the recorder
+			for _, line := range recordLines(plain) {
+				if _, err := cw.Write([]byte(line + "\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := cw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if enc != nil {
+				if err := enc.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !encrypted && method != CompressNone && bytes.Equal(buf.Bytes(), plain) {
+				t.Fatalf("%s: not compressed", method)
+			}
+
+			hdr, records, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%s, encrypted %v: %v", method, encrypted, err)
+			}
+
+			want, wantRecords, _ := ReadRecording(bytes.NewReader(plain))
+			if !reflect.DeepEqual(hdr, want) || !reflect.DeepEqual(records, wantRecords) {
+				t.Fatalf("%s, encrypted %v: the recording does not match", method, encrypted)
+			}
+		}
+	}
+}
+
+func TestCompressCut(t *testing.T) {
+	plain, _ := signedRecording(t)
+
+	for _, method := range []string{CompressGzip, CompressZstd} {
+		var buf bytes.Buffer
+
+		cw, err := NewCompressor(&buf, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range recordLines(plain) {
+			if _, err := cw.Write([]byte(line + "\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// not closed, as if witty crashed
+		_, records, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+		if err != nil || len(records) != len(testRecords) {
+			t.Fatalf("%s: got %d records, %v", method, len(records), err)
+		}
+	}
+}
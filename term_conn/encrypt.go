@@ -0,0 +1,369 @@
+package term_conn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Recordings can be encrypted at rest with AES-256-GCM. The file starts
+// with the magic, the ID of the key and a random salt, followed by chunks
+// of the length and the sealed data. Each file is encrypted with its own
+// key derived from the key and the salt by HKDF, so the nonces can never
+// repeat across files. The nonce of each chunk is the chunk number, so the
+// chunks cannot be reordered or replaced. The last chunk is marked, so a
+// file that lost its tail, by a crash or on purpose, is reported as
+// truncated. The encryption is below the compression, each flush of the
+// compressor is sealed right away, so the file can be read back if witty
+// crashes. The key is looked up by its ID, old keys keep working after a
+// new one is made current.
+
+const (
+	encMagic     = "WTTYENC2" // the last byte is the version
+	keyIDSize    = 8
+	saltSize     = 32
+	encHdrSize   = len(encMagic) + keyIDSize + saltSize
+	encChunkSize = 64 * 1024
+	encKeyInfo   = "witty recording"
+)
+
+// RecordKey is an AES-256 key to encrypt the recordings
+type RecordKey struct {
+	ID      string    `json:"id"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// KeyRing has the current key to encrypt and the old keys to decrypt
+type KeyRing struct {
+	Current string      `json:"current"`
+	Keys    []RecordKey `json:"keys"`
+}
+
+// the keys to read encrypted recordings, see SetRecordKeys
+var recordKeys *KeyRing
+
+// SetRecordKeys sets the keys to read and write encrypted recordings
+func SetRecordKeys(ring *KeyRing) {
+	recordKeys = ring
+}
+
+// RecordKeys returns the keys set by SetRecordKeys
+func RecordKeys() *KeyRing {
+	return recordKeys
+}
+
+// NewRecordKey returns a new random key
+func NewRecordKey() (RecordKey, error) {
+	id := make([]byte, keyIDSize)
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(id); err != nil {
+		return RecordKey{}, err
+	}
+
+	if _, err := rand.Read(key); err != nil {
+		return RecordKey{}, err
+	}
+
+	return RecordKey{ID: hex.EncodeToString(id), Key: key, Created: time.Now()}, nil
+}
+
+// Key returns the key with the ID, nil if there is no such key
+func (ring *KeyRing) Key(id string) *RecordKey {
+	if ring == nil {
+		return nil
+	}
+
+	for i := range ring.Keys {
+		if ring.Keys[i].ID == id {
+			return &ring.Keys[i]
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the keys are usable and the current key exists
+func (ring *KeyRing) Validate() error {
+	for _, k := range ring.Keys {
+		if id, err := hex.DecodeString(k.ID); err != nil || len(id) != keyIDSize {
+			return fmt.Errorf("invalid key ID %q", k.ID)
+		}
+
+		if len(k.Key) != 32 {
+			return fmt.Errorf("key %s: expect 32 bytes, got %d", k.ID, len(k.Key))
+		}
+	}
+
+	if ring.Current != "" && ring.Key(ring.Current) == nil {
+		return fmt.Errorf("the current key %s is not in the key ring", ring.Current)
+	}
+
+	return nil
+}
+
+// the cipher of the file, keyed by the key derived from the salt in the
+// header
+func newGCM(key []byte, hdr []byte) (cipher.AEAD, error) {
+	fileKey := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, key, hdr[len(encMagic)+keyIDSize:encHdrSize], []byte(encKeyInfo))
+
+	if _, err := io.ReadFull(kdf, fileKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// the nonce of the chunk, and the additional data that covers the header
+// and marks the last chunk
+func chunkNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func chunkAD(hdr []byte, last bool) []byte {
+	ad := append([]byte{}, hdr...)
+
+	if last {
+		return append(ad, 1)
+	}
+
+	return append(ad, 0)
+}
+
+// Encrypter encrypts the recording with the current key as it is written
+type Encrypter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	hdr  []byte
+	seq  uint64
+	buf  []byte
+}
+
+// NewEncrypter writes the header and returns the writer that encrypts to w
+func NewEncrypter(w io.Writer, ring *KeyRing) (*Encrypter, error) {
+	key := ring.Key(ring.Current)
+	if key == nil {
+		return nil, errors.New("no current key to encrypt the recordings")
+	}
+
+	id, _ := hex.DecodeString(key.ID)
+	hdr := append([]byte(encMagic), id...)
+	salt := make([]byte, saltSize)
+
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	hdr = append(hdr, salt...)
+
+	aead, err := newGCM(key.Key, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return &Encrypter{w: w, aead: aead, hdr: hdr}, nil
+}
+
+func (e *Encrypter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		room := encChunkSize - len(e.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+
+		e.buf = append(e.buf, p[:room]...)
+		p = p[room:]
+
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Flush seals the buffered data as a chunk
+func (e *Encrypter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+
+	return e.seal(false)
+}
+
+// Close seals the last chunk, the underlying writer is not closed
+func (e *Encrypter) Close() error {
+	return e.seal(true)
+}
+
+func (e *Encrypter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.seq), e.buf, chunkAD(e.hdr, last))
+
+	chunk := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(chunk, uint32(len(sealed)))
+	chunk = append(chunk, sealed...)
+
+	e.seq++
+	e.buf = e.buf[:0]
+
+	// the length and the data in one write, like the records
+	_, err := e.w.Write(chunk)
+	return err
+}
+
+// ErrTruncated is returned after the last complete chunk of a recording
+// without the marked last chunk, it is still written or was cut short
+var ErrTruncated = errors.New("the recording is truncated, its end is missing")
+
+// EncryptionKey returns the ID of the key that encrypted the recording,
+// empty if it is not encrypted
+func EncryptionKey(br *bufio.Reader) string {
+	hdr, err := br.Peek(encHdrSize)
+	if err != nil || !bytes.HasPrefix(hdr, []byte(encMagic)) {
+		return ""
+	}
+
+	return hex.EncodeToString(hdr[len(encMagic) : len(encMagic)+keyIDSize])
+}
+
+type decrypter struct {
+	r    io.Reader
+	aead cipher.AEAD
+	hdr  []byte
+	seq  uint64
+	buf  []byte // the opened data not read yet
+	done bool
+}
+
+// Decrypt returns the plain content of the encrypted recording. A file
+// cut short returns ErrTruncated after its last complete chunk
+func Decrypt(br *bufio.Reader, ring *KeyRing) (io.Reader, error) {
+	id := EncryptionKey(br)
+	if id == "" {
+		return nil, errors.New("the recording is not encrypted")
+	}
+
+	key := ring.Key(id)
+	if key == nil {
+		return nil, fmt.Errorf("the recording is encrypted with the unknown key %s", id)
+	}
+
+	hdr := make([]byte, encHdrSize)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key.Key, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decrypter{r: br, aead: aead, hdr: hdr}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// read and open the next chunk
+func (d *decrypter) open() error {
+	var size [4]byte
+
+	// the end of the file before the last chunk
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return ErrTruncated
+		}
+
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n < uint32(d.aead.Overhead()) || n > uint32(encChunkSize+d.aead.Overhead()) {
+		return fmt.Errorf("chunk %d: invalid length %d", d.seq, n)
+	}
+
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return ErrTruncated
+		}
+
+		return err
+	}
+
+	nonce := chunkNonce(d.seq)
+	last := false
+
+	data, err := d.aead.Open(nil, nonce, sealed, chunkAD(d.hdr, false))
+	if err != nil {
+		data, err = d.aead.Open(nil, nonce, sealed, chunkAD(d.hdr, true))
+		last = true
+	}
+
+	if err != nil {
+		return fmt.Errorf("chunk %d: the recording was modified or the key is wrong", d.seq)
+	}
+
+	d.seq++
+	d.buf = data
+	d.done = last
+	return nil
+}
+
+// OpenRecording returns the plain content of the recording, decrypted and
+// decompressed as needed
+func OpenRecording(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	if EncryptionKey(br) == "" {
+		return Decompress(br)
+	}
+
+	dr, err := Decrypt(br, recordKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return Decompress(dr)
+}
@@ -0,0 +1,185 @@
+package term_conn
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+
+	key, err := NewRecordKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &KeyRing{Current: key.ID, Keys: []RecordKey{key}}
+}
+
+// encrypt the data, flushed every flushEvery bytes if not 0
+func encrypt(t *testing.T, ring *KeyRing, data []byte, flushEvery int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	enc, err := NewEncrypter(&buf, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if flushEvery > 0 && n > flushEvery {
+			n = flushEvery
+		}
+
+		if _, err := enc.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		data = data[n:]
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decrypt(ring *KeyRing, data []byte) ([]byte, error) {
+	dr, err := Decrypt(bufio.NewReader(bytes.NewReader(data)), ring)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(dr)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	ring := testKeyRing(t)
+	plain := []byte(strings.Repeat("the quick brown fox\n", 10000))
+
+	for _, flushEvery := range []int{0, 1, 1000, encChunkSize} {
+		sealed := encrypt(t, ring, plain, flushEvery)
+
+		if EncryptionKey(bufio.NewReader(bytes.NewReader(sealed))) != ring.Current {
+			t.Fatalf("flush %d: the key ID is not in the header", flushEvery)
+		}
+
+		got, err := decrypt(ring, sealed)
+		if err != nil {
+			t.Fatalf("flush %d: %v", flushEvery, err)
+		}
+
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("flush %d: got %d bytes, expect %d", flushEvery, len(got), len(plain))
+		}
+	}
+}
+
+// the same key and content must not give the same file
+func TestEncryptFileKeys(t *testing.T) {
+	ring := testKeyRing(t)
+	plain := []byte("the same content")
+
+	a := encrypt(t, ring, plain, 0)
+	b := encrypt(t, ring, plain, 0)
+
+	if bytes.Equal(a[encHdrSize:], b[encHdrSize:]) {
+		t.Fatal("two files have the same ciphertext")
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	ring := testKeyRing(t)
+	plain := []byte(strings.Repeat("x", 3000))
+	sealed := encrypt(t, ring, plain, 1000)
+
+	// each chunk is the length, 1000 bytes and the tag, the last one is empty
+	chunk := 4 + 1000 + 16
+	last := 4 + 16
+
+	// the data before the cut is read, then the missing end is reported
+	for _, cut := range []int{1, last, chunk / 2, chunk + last, chunk + last + 3} {
+		got, err := decrypt(ring, sealed[:len(sealed)-cut])
+		if err != ErrTruncated {
+			t.Fatalf("cut %d: got %v, expect %v", cut, err, ErrTruncated)
+		}
+
+		if !bytes.HasPrefix(plain, got) {
+			t.Fatalf("cut %d: the content does not match", cut)
+		}
+	}
+
+	// the chunks are dropped, not just the end
+	got, err := decrypt(ring, sealed[:len(sealed)-2*chunk-last])
+	if err != ErrTruncated || len(got) != 1000 {
+		t.Fatalf("expect the first chunk and %v, got %d bytes, %v", ErrTruncated, len(got), err)
+	}
+}
+
+func TestRecordingTruncated(t *testing.T) {
+	ring := testKeyRing(t)
+	defer SetRecordKeys(RecordKeys())
+	SetRecordKeys(ring)
+
+	data, pub := signedRecording(t)
+	sealed := encrypt(t, ring, data, 50)
+
+	// without the last chunk, e.g., still written
+	sealed = sealed[:len(sealed)-4-16]
+
+	if _, records, err := ReadRecording(bytes.NewReader(sealed)); err != nil || len(records) != len(testRecords) {
+		t.Fatalf("got %d records, %v", len(records), err)
+	}
+
+	if _, err := VerifyRecording(bytes.NewReader(sealed), pub); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("got %v, expect %v", err, ErrTruncated)
+	}
+
+	if closed, err := RecordingClosed(bytes.NewReader(sealed)); err != nil || closed {
+		t.Fatalf("got closed %v, %v", closed, err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	ring := testKeyRing(t)
+	sealed := encrypt(t, ring, []byte(strings.Repeat("y", 3000)), 1000)
+
+	for _, pos := range []int{len(encMagic) + keyIDSize, encHdrSize + 10, len(sealed) - 1} {
+		bad := append([]byte{}, sealed...)
+		bad[pos] ^= 1
+
+		if _, err := decrypt(ring, bad); err == nil {
+			t.Fatalf("byte %d changed, expect an error", pos)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	ring := testKeyRing(t)
+	sealed := encrypt(t, ring, []byte("secret"), 0)
+
+	// the key is not in the key ring
+	if _, err := decrypt(testKeyRing(t), sealed); err == nil {
+		t.Fatal("expect an error for an unknown key")
+	}
+
+	// the key has the right ID but the wrong bytes
+	other := testKeyRing(t)
+	other.Keys[0].ID = ring.Current
+	other.Current = ring.Current
+
+	if _, err := decrypt(other, sealed); err == nil {
+		t.Fatal("expect an error for a wrong key")
+	}
+}
@@ -0,0 +1,140 @@
+package term_conn
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// reverse proxies whose X-Forwarded-* headers can be trusted
+var trustedProxies []*net.IPNet
+
+// ParseNets parses a list of networks, each entry is either a CIDR or
+// a single IP address
+func ParseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, p := range list {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+// SetTrustedProxies sets the trusted proxies, each entry is either
+// a CIDR or a single IP address
+func SetTrustedProxies(proxies []string) error {
+	nets, err := ParseNets(proxies)
+	if err != nil {
+		return err
+	}
+
+	trustedProxies = nets
+	return nil
+}
+
+// InNets checks whether the IP is in any of the networks
+func InNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the address of the client. Behind trusted proxies, it
+// is the right most address in X-Forwarded-For that is not a trusted
+// proxy, because the proxies append the address they received from.
+// It returns nil if the address is unknown
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if !FromTrustedProxy(r) {
+		return ip
+	}
+
+	addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if fip == nil {
+			break
+		}
+
+		ip = fip
+		if !InNets(fip, trustedProxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+type socketKey struct{}
+
+// SocketConnContext marks the connections accepted on a Unix socket. Only
+// the proxy can connect to the socket, protected by its permissions, so
+// these connections are trusted as well
+func SocketConnContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, socketKey{}, true)
+	}
+
+	return ctx
+}
+
+// FromTrustedProxy checks whether the request comes directly from a trusted proxy
+func FromTrustedProxy(r *http.Request) bool {
+	if r.Context().Value(socketKey{}) != nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return InNets(ip, trustedProxies)
+}
+
+// the first value of a possibly comma separated forwarded header
+func forwardedValue(r *http.Request, name string) string {
+	val := r.Header.Get(name)
+
+	if idx := strings.Index(val, ","); idx >= 0 {
+		val = val[:idx]
+	}
+
+	return strings.TrimSpace(val)
+}
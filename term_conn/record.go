@@ -0,0 +1,396 @@
+package term_conn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Recordings are line delimited JSON: a header line followed by one
+// WriteRecord per line. Each line is written at once, so the file is a
+// valid recording after every write, even if witty crashes. The legacy
+// recordings are a JSON array of WriteRecord, which is only valid after
+// the closing bracket is written.
+//
+// The records are chained by their hashes: the hash of each record covers
+// the hash of the previous one, and the first one covers the header. When
+// the recording is closed, the last hash is written in the end line and
+// signed with the server key, so any change after the fact is detected.
+
+const (
+	RecordVersion = 2 // the version of the line delimited format
+	legacyVersion = 1 // the JSON array, it has no header
+
+	HashSHA256 = "sha256" // the hash of the chain
+)
+
+// RecordHeader is the first line of a recording
+type RecordHeader struct {
+	Version int       `json:"version"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Session string    `json:"session,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Command []string  `json:"command,omitempty"`
+	Start   time.Time `json:"start"`
+	Input   bool      `json:"input,omitempty"` // the input is recorded too
+	Hash    string    `json:"hash,omitempty"`  // the hash chaining the records
+
+	Mandatory bool `json:"mandatory,omitempty"` // recorded by the policy, only administrators remove it
+}
+
+// RecordEnd is the last line of a closed recording
+type RecordEnd struct {
+	Records   int    `json:"records"`
+	Digest    string `json:"digest"`              // the hash of the last record in hex
+	Key       string `json:"key,omitempty"`       // the ID of the signing key
+	Signature string `json:"signature,omitempty"` // Ed25519 signature of the digest in base64
+}
+
+// a line after the header, either a record or the end
+type recordLine struct {
+	WriteRecord
+	End *RecordEnd `json:"end,omitempty"`
+}
+
+// the hash of the record chained to the previous hash
+func chainHash(prev []byte, record *WriteRecord) []byte {
+	var dur [8]byte
+	binary.BigEndian.PutUint64(dur[:], uint64(record.Dur))
+
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(dur[:])
+	h.Write([]byte(record.Type))
+	h.Write([]byte{0})
+	h.Write(record.Data)
+
+	return h.Sum(nil)
+}
+
+// KeyID identifies the signing key of the recordings
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewRecordHeader returns the header of a recording started now
+func NewRecordHeader(session string, user string, cmdline []string) *RecordHeader {
+	return &RecordHeader{
+		Version: RecordVersion,
+		Width:   TermCols,
+		Height:  TermRows,
+		Session: session,
+		User:    user,
+		Command: cmdline,
+		Start:   time.Now(),
+	}
+}
+
+// RecordWriter writes a recording line by line
+type RecordWriter struct {
+	w      io.Writer
+	signer ed25519.PrivateKey // nil to leave the recording unsigned
+	digest []byte             // the hash of the last line
+	count  int
+}
+
+// NewRecordWriter writes the header and returns the writer of the records.
+// The recording is signed with signer when it is closed, if not nil
+func NewRecordWriter(w io.Writer, hdr *RecordHeader, signer ed25519.PrivateKey) (*RecordWriter, error) {
+	rw := &RecordWriter{w: w, signer: signer}
+
+	hdr.Hash = HashSHA256
+
+	line, err := rw.writeLine(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(line)
+	rw.digest = sum[:]
+
+	return rw, nil
+}
+
+// Add appends the record to the recording
+func (rw *RecordWriter) Add(record WriteRecord) error {
+	rw.digest = chainHash(rw.digest, &record)
+	rw.count++
+
+	record.Hash = hex.EncodeToString(rw.digest)
+
+	_, err := rw.writeLine(record)
+	return err
+}
+
+// Close writes the end line with the signed digest, the underlying writer
+// is not closed
+func (rw *RecordWriter) Close() error {
+	end := RecordEnd{Records: rw.count, Digest: hex.EncodeToString(rw.digest)}
+
+	if rw.signer != nil {
+		end.Key = KeyID(rw.signer.Public().(ed25519.PublicKey))
+		end.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(rw.signer, rw.digest))
+	}
+
+	_, err := rw.writeLine(struct {
+		End *RecordEnd `json:"end"`
+	}{&end})
+	return err
+}
+
+// write v and the newline in one write, so that a crash leaves at most
+// one incomplete line behind. It returns the line without the newline
+func (rw *RecordWriter) writeLine(v interface{}) ([]byte, error) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rw.w.Write(append(line, '\n'))
+	return line[:len(line):len(line)], err
+}
+
+// WriteRecording writes the complete recording to w, signed by signer if not nil
+func WriteRecording(w io.Writer, hdr *RecordHeader, records []WriteRecord, signer ed25519.PrivateKey) error {
+	bw := bufio.NewWriter(w)
+
+	rw, err := NewRecordWriter(bw, hdr, signer)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if err := rw.Add(r); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.Close(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// ReadRecording reads a recording in either format, compressed, encrypted or not.
+// Legacy recordings get a header of version 1 with the fixed terminal
+// size. The incomplete last record left by a crash is dropped
+func ReadRecording(r io.Reader) (*RecordHeader, []WriteRecord, error) {
+	zr, err := OpenRecording(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+
+	// skip the white spaces to find out the format
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil, errors.New("empty recording")
+			}
+
+			return nil, nil, err
+		}
+
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+
+		br.UnreadByte()
+
+		if c == '[' {
+			return readLegacy(br)
+		}
+
+		return readLines(br)
+	}
+}
+
+func readLegacy(r io.Reader) (*RecordHeader, []WriteRecord, error) {
+	hdr := &RecordHeader{Version: legacyVersion, Width: TermCols, Height: TermRows}
+	decoder := json.NewDecoder(r)
+
+	// skip the opening [
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+
+	var records []WriteRecord
+
+	for decoder.More() {
+		var record WriteRecord
+
+		if err := decoder.Decode(&record); err != nil {
+			// the closing ] is missing if witty crashed
+			if truncated(err) {
+				break
+			}
+
+			return hdr, records, err
+		}
+
+		records = append(records, record)
+	}
+
+	return hdr, records, nil
+}
+
+// whether the error is caused by the end of the input in the middle of a record
+func truncated(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	serr, ok := err.(*json.SyntaxError)
+	return ok && serr.Error() == "unexpected end of JSON input"
+}
+
+func readLines(br *bufio.Reader) (*RecordHeader, []WriteRecord, error) {
+	var hdr *RecordHeader
+	var records []WriteRecord
+
+	for lineno := 1; ; lineno++ {
+		line, rerr := br.ReadBytes('\n')
+
+		// the encrypted recordings still being written have no last chunk
+		if errors.Is(rerr, ErrTruncated) {
+			rerr = io.EOF
+		}
+
+		if rerr != nil && rerr != io.EOF {
+			return hdr, records, rerr
+		}
+
+		// a line without the newline was cut short by a crash
+		complete := rerr == nil
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var err error
+
+			if hdr == nil {
+				var h RecordHeader
+				if err = json.Unmarshal(line, &h); err == nil {
+					if h.Version != RecordVersion {
+						return nil, nil, fmt.Errorf("unsupported recording version %d", h.Version)
+					}
+
+					hdr = &h
+				}
+			} else {
+				var rl recordLine
+				if err = json.Unmarshal(line, &rl); err == nil && rl.End == nil {
+					records = append(records, rl.WriteRecord)
+				}
+			}
+
+			if err != nil {
+				// only the records can be cut short, the header is written first
+				if !complete && hdr != nil {
+					break
+				}
+
+				return hdr, records, fmt.Errorf("line %d: invalid recording: %v", lineno, err)
+			}
+		}
+
+		if !complete {
+			break
+		}
+	}
+
+	if hdr == nil {
+		return nil, nil, errors.New("recording has no header")
+	}
+
+	return hdr, records, nil
+}
+
+// RecordingClosed reports whether the recording has its end line. A
+// recording without it is still being written by the server, or was cut
+// short by a crash. The legacy and the unchained recordings have no end
+// line, they are always closed
+func RecordingClosed(r io.Reader) (bool, error) {
+	zr, err := OpenRecording(r)
+	if err != nil {
+		return false, err
+	}
+
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+
+	var hdr *RecordHeader
+	var last []byte
+
+	for {
+		line, rerr := br.ReadBytes('\n')
+		if errors.Is(rerr, ErrTruncated) {
+			return false, nil
+		}
+
+		if rerr != nil && rerr != io.EOF {
+			return false, rerr
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if hdr == nil {
+				if line[0] == '[' {
+					return true, nil
+				}
+
+				var h RecordHeader
+				if err := json.Unmarshal(line, &h); err != nil {
+					return false, fmt.Errorf("invalid header: %v", err)
+				}
+
+				if h.Hash == "" {
+					return true, nil
+				}
+
+				hdr = &h
+			} else {
+				last = line
+			}
+
+			// the end line is written with its newline
+			if rerr == io.EOF {
+				return false, nil
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+	}
+
+	if hdr == nil {
+		return false, errors.New("empty recording")
+	}
+
+	var rl recordLine
+	return json.Unmarshal(last, &rl) == nil && rl.End != nil, nil
+}
+
+// Duration is the total time of the records
+func Duration(records []WriteRecord) time.Duration {
+	var dur time.Duration
+
+	for _, r := range records {
+		dur += r.Dur
+	}
+
+	return dur
+}
@@ -0,0 +1,89 @@
+package term_conn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRecords = []WriteRecord{
+	{Dur: 0, Data: []byte("$ ls\r\n")},
+	{Dur: 200 * time.Millisecond, Data: []byte("ls\r"), Type: "i"},
+	{Dur: time.Second, Data: []byte("a.txt b.txt\r\n")},
+}
+
+// a recording of testRecords signed by the returned key
+func signedRecording(t *testing.T) ([]byte, ed25519.PublicKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	hdr := NewRecordHeader("session", "alice", []string{"bash"})
+
+	if err := WriteRecording(&buf, hdr, testRecords, priv); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), pub
+}
+
+// the lines of the recording, without the last newline
+func recordLines(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	data, _ := signedRecording(t)
+
+	hdr, records, err := ReadRecording(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.User != "alice" || hdr.Hash != HashSHA256 {
+		t.Fatalf("wrong header %+v", hdr)
+	}
+
+	if len(records) != len(testRecords) {
+		t.Fatalf("got %d records, expect %d", len(records), len(testRecords))
+	}
+
+	for i, r := range records {
+		if r.Dur != testRecords[i].Dur || !bytes.Equal(r.Data, testRecords[i].Data) || r.Type != testRecords[i].Type {
+			t.Fatalf("record %d: got %+v, expect %+v", i+1, r, testRecords[i])
+		}
+	}
+}
+
+func TestRecordingClosed(t *testing.T) {
+	data, _ := signedRecording(t)
+	lines := recordLines(data)
+
+	tests := []struct {
+		name   string
+		data   string
+		closed bool
+	}{
+		{"closed", string(data), true},
+		{"live", strings.Join(lines[:len(lines)-1], "\n") + "\n", false},
+		{"header only", lines[0] + "\n", false},
+		{"cut short", string(data[:len(data)-1]), false},
+		{"legacy", `[{"Duration":0,"Data":"aGk="}]`, true},
+		{"unchained", `{"version":2,"width":80,"height":24}` + "\n", true},
+	}
+
+	for _, tt := range tests {
+		closed, err := RecordingClosed(strings.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if closed != tt.closed {
+			t.Errorf("%s: got closed %v, expect %v", tt.name, closed, tt.closed)
+		}
+	}
+}
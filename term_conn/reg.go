@@ -2,10 +2,8 @@ package term_conn
 
 import (
 	"errors"
-	"log"
+	"path/filepath"
 	"sync"
-
-	"github.com/gorilla/websocket"
 )
 
 // a simple registry for actors and their channels. It is possible to
@@ -24,10 +22,10 @@ func (reg *Registry) init() {
 func (d *Registry) addPlayer(tc *TermConn) {
 	d.mtx.Lock()
 	if _, ok := d.players[tc.Name]; ok {
-		log.Println(tc.Name, "Already exist in the dispatcher, skip registration")
+		logger.Warn("Session already exists in the registry, skip registration", "session", tc.Name)
 	} else {
 		d.players[tc.Name] = tc
-		log.Println("Add interactive session to registry", tc.Name)
+		logger.Debug("Added interactive session to registry", "session", tc.Name)
 	}
 	d.mtx.Unlock()
 }
@@ -39,7 +37,7 @@ func (d *Registry) removePlayer(name string) error {
 	if _, ok := d.players[name]; ok {
 		delete(d.players, name)
 		err = nil
-		log.Println("Removed interactive session to registry", name)
+		logger.Debug("Removed interactive session from registry", "session", name)
 	}
 
 	d.mtx.Unlock()
@@ -47,12 +45,12 @@ func (d *Registry) removePlayer(name string) error {
 }
 
 // we do not want to return the channel to viewer so it won't be used out of the critical section
-func (d *Registry) sendToPlayer(name string, ws *websocket.Conn) bool {
+func (d *Registry) sendToPlayer(name string, v *viewer) bool {
 	d.mtx.Lock()
 	tc, ok := d.players[name]
 
 	if ok {
-		tc.viewChan <- ws
+		tc.viewChan <- v
 	}
 
 	d.mtx.Unlock()
@@ -79,3 +77,49 @@ func ForEachSession(fp func(tc *TermConn)) {
 	}
 	registry.mtx.Unlock()
 }
+
+// SessionUser returns the user of the session, false if it does not exist
+func SessionUser(name string) (string, bool) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+
+	tc, ok := registry.players[name]
+	if !ok {
+		return "", false
+	}
+
+	return tc.User, true
+}
+
+// RecordingMandatory returns whether the session must be recorded
+func RecordingMandatory(name string) bool {
+	registry.mtx.Lock()
+	tc, ok := registry.players[name]
+	registry.mtx.Unlock()
+
+	return ok && tc.mandatory
+}
+
+// the record files still being written, by the base name
+var openRecords = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+func setRecording(fname string, open bool) {
+	openRecords.Lock()
+	if open {
+		openRecords.names[filepath.Base(fname)] = true
+	} else {
+		delete(openRecords.names, filepath.Base(fname))
+	}
+	openRecords.Unlock()
+}
+
+// Recording returns whether the record file is still being written
+func Recording(fname string) bool {
+	openRecords.Lock()
+	defer openRecords.Unlock()
+
+	return openRecords.names[filepath.Base(fname)]
+}
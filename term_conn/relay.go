@@ -1,47 +1,167 @@
-//This file contains code to relay traffic between websocket and pty
+// This file contains code to relay traffic between websocket and pty
 package term_conn
 
 import (
-	"encoding/json"
-	"log"
+	"crypto/ed25519"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
+	"github.com/syssecfsu/witty/logging"
 )
 
 const (
-	// Time allowed to write a message to the peer.
-	readWait  = 10 * time.Second
-	writeWait = 10 * time.Second
-	viewWait  = 3 * time.Second
+	readBufferSize  = 1024
+	WriteBufferSize = 1024
+
+	recordCmd = 1
+	stopCmd   = 0
+
+	inputQueue = 64 // input waiting to be recorded
+
+	validPeriod = 5 * time.Second // how often to check the viewers are still allowed
+)
+
+// Options are the settings of the terminal connections
+type Options struct {
+	RecordDir string          `yaml:"-"` // set by the web server, shared with it
+	Logger    *logging.Logger `yaml:"-"` // nil to log to stderr
+
+	// Time allowed to write a message to the player and viewers.
+	WriteWait time.Duration `yaml:"write_wait"`
+	ViewWait  time.Duration `yaml:"view_wait"`
 
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 10 * time.Second
+	PongWait time.Duration `yaml:"pong_wait"`
+
+	// Time for the shell to exit after interrupt before it is killed
+	KillWait time.Duration `yaml:"kill_wait"`
 
 	// Maximum message size allowed from peer.
-	maxMessageSize  = 4096
-	readBufferSize  = 1024
-	WriteBufferSize = 1024
+	MaxMessageSize int64 `yaml:"max_message_size"`
+
+	// also record the keyboard input, masked while the terminal does not
+	// echo it, e.g., at password prompts, unless MaskInput is false
+	RecordInput bool `yaml:"record_input"`
+	MaskInput   bool `yaml:"mask_input"`
+
+	// the recordings are signed with this key when they are closed, the
+	// key file is created if missing. Empty to leave them unsigned
+	SignKey string             `yaml:"sign_key"`
+	Signer  ed25519.PrivateKey `yaml:"-"` // loaded from SignKey
+
+	// compress the recordings with gzip or zstd, none to keep them plain
+	Compress string `yaml:"compress"`
+
+	// encrypt the recordings with the current key in EncryptKeys, the key
+	// file is created if missing. The keys also decrypt the old recordings
+	Encrypt     bool     `yaml:"encrypt"`
+	EncryptKeys string   `yaml:"encrypt_keys"`
+	Keys        *KeyRing `yaml:"-"` // loaded from EncryptKeys
+
+	// called with the file name and the user of the session when a
+	// recording is started, and with the file name when it is closed
+	RecordStarted func(fname string, user string) `yaml:"-"`
+	RecordClosed  func(fname string)              `yaml:"-"`
+
+	// whether the request of a websocket is still allowed, e.g., its
+	// client certificate is not revoked. Checked every validPeriod and on
+	// CheckSessions, the websocket is closed once it returns false
+	ConnValid func(r *http.Request) bool `yaml:"-"`
+}
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+// DefaultOptions are the settings witty has always used
+var DefaultOptions = Options{
+	RecordDir:      "./records",
+	WriteWait:      10 * time.Second,
+	ViewWait:       3 * time.Second,
+	PongWait:       10 * time.Second,
+	KillWait:       time.Second,
+	MaxMessageSize: 4096,
+	MaskInput:      true,
+	SignKey:        "./tls/record-key.pem",
+	Compress:       CompressNone,
+	EncryptKeys:    "./tls/record-keys.json",
+}
 
-	recordCmd = 1
-	stopCmd   = 0
+var (
+	options = DefaultOptions
+	logger  = logging.Default()
 )
 
-// simple function to check origin
+// Send pings to peer with this period. Must be less than pongWait.
+func pingPeriod() time.Duration {
+	return (options.PongWait * 9) / 10
+}
+
+// origins allowed to open websockets, e.g., https://witty.example.com.
+// If empty, the origin must match the host of the request
+var allowedOrigins []string
+
+// SetAllowedOrigins sets the origins allowed to connect to the websockets
+func SetAllowedOrigins(origins []string) error {
+	var list []string
+
+	for _, o := range origins {
+		u, err := url.Parse(strings.TrimSpace(o))
+
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid origin %q, expect scheme://host[:port]", o)
+		}
+
+		list = append(list, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+
+	allowedOrigins = list
+	return nil
+}
+
+// simple function to check origin. Behind a trusted reverse proxy, the
+// host and scheme seen by the browser are in the X-Forwarded-* headers
 func checkOrigin(r *http.Request) bool {
 	org := r.Header.Get("Origin")
 
-	if org != "https://"+r.Host {
-		log.Println("Failed origin check of ", org, r.Host)
+	if len(allowedOrigins) > 0 {
+		for _, o := range allowedOrigins {
+			if strings.EqualFold(org, o) {
+				return true
+			}
+		}
+
+		logger.Warn("Origin is not allowed", "origin", org)
+		return false
+	}
+
+	host := r.Host
+	proto := "https"
+
+	if r.TLS == nil {
+		proto = "http"
+	}
+
+	if FromTrustedProxy(r) {
+		if fh := forwardedValue(r, "X-Forwarded-Host"); fh != "" {
+			host = fh
+		}
+
+		if fp := forwardedValue(r, "X-Forwarded-Proto"); fp != "" {
+			proto = fp
+		}
+	}
+
+	if org != proto+"://"+host {
+		logger.Warn("Failed origin check", "origin", org, "host", host)
 		return false
 	}
 
@@ -59,21 +179,56 @@ var upgrader = websocket.Upgrader{
 type TermConn struct {
 	Name string
 	Ip   string
+	User string // the user who started the session
+
+	log *logging.Logger // logs with the session ID and the user
+
+	mandatory bool // recorded from the start, only administrators stop it
+
+	vmtx        sync.Mutex
+	viewerNames []string // who are watching the session
 
 	ws          *websocket.Conn
-	ptmx        *os.File             // the pty that runs the command
-	record      *os.File             // record session
-	lastRecTime time.Time            // last time a record is written
-	cmd         *exec.Cmd            // represents the process, we need it to terminate the process
-	viewChan    chan *websocket.Conn // channel to receive viewers
-	recordChan  chan int             // channel to start/stop recording
-	ws_done     chan struct{}        // ws is closed, only close this chan in ws reader
-	pty_done    chan struct{}        // pty is closed, close this chan in pty reader
+	ptmx        *os.File      // the pty that runs the command
+	record      *os.File      // record session
+	encrypter   *Encrypter    // encrypts the records to the file, if enabled
+	compressor  *Compressor   // compresses the records to the encrypter or the file
+	recorder    *RecordWriter // writes the records to the compressor
+	lastRecTime time.Time     // last time a record is written
+	cmd         *exec.Cmd     // represents the process, we need it to terminate the process
+	valid       func() bool   // whether the player is still allowed, nil if always
+	checkChan   chan struct{} // check the player and viewers now
+	viewChan    chan *viewer  // channel to receive viewers
+	recordChan  chan int      // channel to start/stop recording
+	inputChan   chan []byte   // input to record, if enabled
+	ws_done     chan struct{} // ws is closed, only close this chan in ws reader
+	pty_done    chan struct{} // pty is closed, close this chan in pty reader
+}
+
+// a viewer of the session, name is shown in the session list
+type viewer struct {
+	ws    *websocket.Conn
+	name  string
+	valid func() bool // nil for viewers that are always allowed
 }
 
+// the size of the pty, also the size of the recordings
+const (
+	TermCols = 120
+	TermRows = 36
+)
+
+// the types of the records, the output has no type for compatibility
+const (
+	RecordOutput = ""
+	RecordInput  = "i"
+)
+
 type WriteRecord struct {
 	Dur  time.Duration `json:"Duration"`
 	Data []byte        `json:"Data"`
+	Type string        `json:"Type,omitempty"`
+	Hash string        `json:"Hash,omitempty"` // chains the records, see RecordWriter
 }
 
 func (tc *TermConn) createPty(cmdline []string) error {
@@ -91,14 +246,14 @@ func (tc *TermConn) createPty(cmdline []string) error {
 	// But we set pty to 120x36. Using fullsize will lead
 	// some program to misbehave.
 	pty.Setsize(ptmx, &pty.Winsize{
-		Cols: 120,
-		Rows: 36,
+		Cols: TermCols,
+		Rows: TermRows,
 	})
 
 	tc.ptmx = ptmx
 	tc.cmd = cmd
 
-	log.Printf("Create shell process %v (%v)", cmdline, cmd.Process.Pid)
+	tc.log.Info("Created shell process", "cmd", strings.Join(cmdline, " "), "pid", cmd.Process.Pid)
 	return nil
 }
 
@@ -106,7 +261,7 @@ func (tc *TermConn) createPty(cmdline []string) error {
 func (tc *TermConn) ping(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(pingPeriod())
 	defer ticker.Stop()
 
 out:
@@ -114,38 +269,38 @@ out:
 		select {
 		case <-ticker.C:
 			err := tc.ws.WriteControl(websocket.PingMessage,
-				[]byte{}, time.Now().Add(writeWait))
+				[]byte{}, time.Now().Add(options.WriteWait))
 
 			if err != nil {
-				log.Println("Failed to write ping message:", err)
+				tc.log.Warn("Failed to write ping message", "err", err)
 				break out
 			}
 		case <-tc.pty_done:
-			log.Println("Exit ping routine as pty is going away")
+			tc.log.Debug("Exit ping routine as pty is going away")
 			break out
 
 		case <-tc.ws_done:
-			log.Println("Exit ping routine as ws is going away")
+			tc.log.Debug("Exit ping routine as ws is going away")
 			break out
 		}
 	}
 
-	log.Println("Ping routine exited")
+	tc.log.Debug("Ping routine exited")
 }
 
 // shovel data from websocket to pty stdin
 func (tc *TermConn) wsToPtyStdin(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	tc.ws.SetReadLimit(maxMessageSize)
+	tc.ws.SetReadLimit(options.MaxMessageSize)
 
 	// set the readdeadline. The idea here is simple,
 	// as long as we keep receiving pong message,
 	// the readdeadline will keep updating. Otherwise
 	// read will timeout.
-	tc.ws.SetReadDeadline(time.Now().Add(pongWait))
+	tc.ws.SetReadDeadline(time.Now().Add(options.PongWait))
 	tc.ws.SetPongHandler(func(string) error {
-		tc.ws.SetReadDeadline(time.Now().Add(pongWait))
+		tc.ws.SetReadDeadline(time.Now().Add(options.PongWait))
 		return nil
 	})
 
@@ -156,7 +311,7 @@ func (tc *TermConn) wsToPtyStdin(wg *sync.WaitGroup) {
 			_, buf, err := tc.ws.ReadMessage()
 
 			if err != nil {
-				log.Println("Failed to receive data from ws:", err)
+				tc.log.Info("Failed to receive data from ws", "err", err)
 				close(bufChan) // close chan by producer
 				close(tc.ws_done)
 				break
@@ -171,41 +326,50 @@ out:
 		select {
 		case buf, ok := <-bufChan:
 			if !ok {
-				log.Println("Exit wsToPtyStdin routine pty stdin error")
+				tc.log.Debug("Exit wsToPtyStdin routine pty stdin error")
 				break out
 			}
+			// check the echo before the input reaches the program
+			if options.RecordInput {
+				tc.recordInput(buf)
+			}
+
 			_, err := tc.ptmx.Write(buf)
 
 			if err != nil {
-				log.Println("Failed to send data to pty stdin: ", err)
+				tc.log.Warn("Failed to send data to pty stdin", "err", err)
 				break out
 			}
 		case <-tc.ws_done:
-			log.Println("Exit wsToPtyStdin routine as ws is going away")
+			tc.log.Debug("Exit wsToPtyStdin routine as ws is going away")
 			break out
 		case <-tc.pty_done:
-			log.Println("Exit wsToPtyStdin routine as pty is going away")
+			tc.log.Debug("Exit wsToPtyStdin routine as pty is going away")
 			break out
 		}
 	}
 
-	log.Println("wsToPtyStdin routine exited")
+	tc.log.Debug("wsToPtyStdin routine exited")
 }
 
 // shovel data from pty Stdout to WS
 func (tc *TermConn) ptyStdoutToWs(wg *sync.WaitGroup) {
-	var viewers []*websocket.Conn
+	var viewers []*viewer
 
 	defer wg.Done()
 	bufChan := make(chan []byte)
 
+	// the viewers are also checked when the terminal is idle
+	validTicker := time.NewTicker(validPeriod)
+	defer validTicker.Stop()
+
 	go func() { //create a goroutine to read from pty
 		for {
 			readBuf := make([]byte, 1024) //pty reads in 1024 blocks
 			n, err := tc.ptmx.Read(readBuf)
 
 			if err != nil {
-				log.Println("Failed to read from pty stdout: ", err)
+				tc.log.Info("Failed to read from pty stdout", "err", err)
 				close(bufChan)
 				close(tc.pty_done)
 				break
@@ -222,7 +386,7 @@ out:
 		select {
 		case buf, ok := <-bufChan:
 			if !ok {
-				tc.ws.SetWriteDeadline(time.Now().Add(writeWait))
+				tc.ws.SetWriteDeadline(time.Now().Add(options.WriteWait))
 				tc.ws.WriteMessage(websocket.CloseMessage,
 					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Pty closed"))
 
@@ -230,94 +394,141 @@ out:
 			}
 			// We could add ws to viewers as well (then we can use io.MultiWriter),
 			// but we want to handle errors differently
-			tc.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			tc.ws.SetWriteDeadline(time.Now().Add(options.WriteWait))
 			if err := tc.ws.WriteMessage(websocket.BinaryMessage, buf); err != nil {
-				log.Println("Failed to write message: ", err)
+				tc.log.Warn("Failed to write message", "err", err)
 				break out
 			}
 
 			//write to the viewer
-			for i, w := range viewers {
-				if w == nil {
+			tc.dropInvalid(viewers)
+
+			for i, v := range viewers {
+				if v == nil {
 					continue
 				}
 
 				// if the viewer exits, we will just ignore the error
-				w.SetWriteDeadline(time.Now().Add(viewWait))
-				if err := w.WriteMessage(websocket.BinaryMessage, buf); err != nil {
-					log.Println("Failed to write message to viewer: ", err)
+				v.ws.SetWriteDeadline(time.Now().Add(options.ViewWait))
+				if err := v.ws.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+					tc.log.Info("Failed to write message to viewer", "viewer", v.name, "err", err)
 
 					viewers[i] = nil
-					w.Close() // we own the socket and need to close it
+					v.ws.Close() // we own the socket and need to close it
+					tc.setViewers(viewers)
 				}
 			}
 
 			// Do we need to record the session?
-			if tc.record != nil {
-				jbuf, err := json.Marshal(WriteRecord{Dur: time.Since(tc.lastRecTime), Data: buf})
-				if err != nil {
-					log.Println("Failed to marshal record", err)
-				} else {
-					tc.record.Write([]byte(",")) // write a deliminator
-					tc.record.Write(jbuf)
+			if tc.recorder != nil {
+				if err := tc.recorder.Add(WriteRecord{Dur: time.Since(tc.lastRecTime), Data: buf}); err != nil {
+					tc.log.Error("Failed to write record", "err", err)
 				}
 
 				tc.lastRecTime = time.Now()
 			}
 
-		case cmd := <-tc.recordChan:
-			var err error
-			if cmd == recordCmd {
-				// use the session ID and current as file name
-				fname := "./records/" + tc.Name + "_" + strconv.FormatInt(time.Now().Unix(), 16) + ".scr"
-
-				tc.record, err = os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-				if err != nil {
-					log.Println("Failed to create record file", fname, err)
-					tc.record = nil
+		case buf := <-tc.inputChan:
+			if tc.recorder != nil {
+				record := WriteRecord{Dur: time.Since(tc.lastRecTime), Data: buf, Type: RecordInput}
+				if err := tc.recorder.Add(record); err != nil {
+					tc.log.Error("Failed to write record", "err", err)
 				}
 
-				tc.record.Write([]byte("[")) // write a [ for an array of json objs
-
-				// write a dummy record
 				tc.lastRecTime = time.Now()
-				jbuf, _ := json.Marshal(WriteRecord{Dur: time.Since(tc.lastRecTime), Data: []byte("")})
-				tc.record.Write(jbuf)
+			}
 
+		case cmd := <-tc.recordChan:
+			if cmd == recordCmd {
+				tc.startRecord()
 			} else {
-				tc.record.Write([]byte("]"))
-				tc.record.Close()
-				tc.record = nil
+				tc.stopRecord()
 			}
 
-		case viewer := <-tc.viewChan:
-			log.Println("Received viewer", viewer.RemoteAddr().String())
-			viewers = append(viewers, viewer)
+		case <-validTicker.C:
+			tc.dropInvalid(viewers)
+
+		case <-tc.checkChan:
+			tc.dropInvalid(viewers)
+
+		case v := <-tc.viewChan:
+			tc.log.Info("Received viewer", "viewer", v.name, "viewer_ip", v.ws.RemoteAddr().String())
+			viewers = append(viewers, v)
+			tc.setViewers(viewers)
 
 		case <-tc.ws_done:
-			log.Println("Exit ptyStdoutToWs routine as ws is going away")
+			tc.log.Debug("Exit ptyStdoutToWs routine as ws is going away")
 			break out
 
 		case <-tc.pty_done:
-			log.Println("Exit ptyStdoutToWs routine as pty is going away")
+			tc.log.Debug("Exit ptyStdoutToWs routine as pty is going away")
 			break out // do not block on these two channels
 		}
 
 	}
 
 	// close the watcher
-	for _, w := range viewers {
-		if w != nil {
-			w.Close()
+	for _, v := range viewers {
+		if v != nil {
+			v.ws.Close()
+		}
+	}
+
+	tc.log.Debug("ptyStdoutToWs routine exited")
+}
+
+// close the player and the viewers whose permission is gone, e.g., the
+// share link or the client certificate is revoked
+func (tc *TermConn) dropInvalid(viewers []*viewer) {
+	// the session ends once the ws of the player is closed
+	if tc.valid != nil && !tc.valid() {
+		tc.log.Info("Player is no longer allowed, close the session")
+
+		tc.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Access revoked"),
+			time.Now().Add(options.WriteWait))
+		tc.ws.Close()
+	}
+
+	for i, v := range viewers {
+		if v == nil || v.valid == nil || v.valid() {
+			continue
+		}
+
+		tc.log.Info("Viewer is no longer allowed, close it", "viewer", v.name)
+
+		viewers[i] = nil
+		v.ws.Close()
+		tc.setViewers(viewers)
+	}
+}
+
+// update the names of the current viewers
+func (tc *TermConn) setViewers(viewers []*viewer) {
+	var names []string
+
+	for _, v := range viewers {
+		if v != nil {
+			names = append(names, v.name)
 		}
 	}
 
-	log.Println("ptyStdoutToWs routine exited")
+	tc.vmtx.Lock()
+	tc.viewerNames = names
+	tc.vmtx.Unlock()
+}
+
+// Viewers returns the names of the viewers watching the session
+func (tc *TermConn) Viewers() []string {
+	tc.vmtx.Lock()
+	defer tc.vmtx.Unlock()
+
+	return append([]string(nil), tc.viewerNames...)
 }
 
 // this function should be executed by the main goroutine for the connection
 func (tc *TermConn) release() {
-	log.Println("Releasing terminal connection", tc.Name)
+	tc.log.Info("Releasing terminal connection")
 
 	registry.removePlayer(tc.Name)
 
@@ -331,64 +542,208 @@ func (tc *TermConn) release() {
 		// send an interrupt, this will cause the shell process to
 		// return from syscalls if any is pending
 		if err := proc.Signal(os.Interrupt); err != nil {
-			log.Printf("Failed to send Interrupt to shell process(%v): %v ", proc.Pid, err)
+			tc.log.Warn("Failed to send Interrupt to shell process", "pid", proc.Pid, "err", err)
 		}
 
-		// Wait for a second for shell process to interrupt before kill it
-		time.Sleep(time.Second)
+		// Wait for the shell process to interrupt before kill it
+		time.Sleep(options.KillWait)
 
-		log.Printf("Try to kill the shell process(%v)", proc.Pid)
+		tc.log.Debug("Try to kill the shell process", "pid", proc.Pid)
 
 		if err := proc.Signal(os.Kill); err != nil {
-			log.Printf("Failed to send KILL to shell process(%v): %v", proc.Pid, err)
+			tc.log.Debug("Failed to send KILL to shell process", "pid", proc.Pid, "err", err)
 		}
 
 		if _, err := proc.Wait(); err != nil {
-			log.Printf("Failed to wait for shell process(%v): %v", proc.Pid, err)
+			tc.log.Debug("Failed to wait for shell process", "pid", proc.Pid, "err", err)
 		}
 
 		close(tc.viewChan)
 		close(tc.recordChan)
 
-		if tc.record != nil {
-			// write a ] and close the file
-			tc.record.Write([]byte("]"))
-			tc.record.Close()
-			tc.record = nil
-		}
+		tc.stopRecord()
 	}
 
 	tc.ws.Close()
 }
 
-// handle websockets
-func handlePlayer(w http.ResponseWriter, r *http.Request, name string, cmdline []string) {
+// pass the input to ptyStdoutToWs, which owns the record file. Typing
+// is never held up by the recording, the input is dropped if it lags
+func (tc *TermConn) recordInput(buf []byte) {
+	data := buf
+
+	if options.MaskInput && hiddenInput(tc.ptmx) {
+		data = maskInput(buf)
+	}
+
+	select {
+	case tc.inputChan <- data:
+	default:
+		tc.log.Warn("Input recording lags behind, drop the input")
+	}
+}
+
+// replace the typed characters by *, keep the line endings
+func maskInput(buf []byte) []byte {
+	masked := make([]byte, 0, len(buf))
+
+	for _, r := range string(buf) {
+		if r == '\r' || r == '\n' {
+			masked = append(masked, byte(r))
+		} else {
+			masked = append(masked, '*')
+		}
+	}
+
+	return masked
+}
+
+// create the record file, the header is written right away
+func (tc *TermConn) startRecord() error {
+	if tc.record != nil {
+		return nil
+	}
+
+	// use the session ID and current as file name
+	fname := filepath.Join(options.RecordDir, tc.Name+"_"+strconv.FormatInt(time.Now().Unix(), 16)+".scr")
+
+	fp, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		tc.log.Error("Failed to create record file", "file", fname, "err", err)
+		return err
+	}
+
+	hdr := NewRecordHeader(tc.Name, tc.User, tc.cmd.Args)
+	hdr.Input = options.RecordInput
+	hdr.Mandatory = tc.mandatory
+
+	var w io.Writer = fp
+	var enc *Encrypter
+
+	if options.Encrypt {
+		if enc, err = NewEncrypter(fp, options.Keys); err != nil {
+			tc.log.Error("Failed to encrypt record file", "file", fname, "err", err)
+			fp.Close()
+			return err
+		}
+
+		w = enc
+	}
+
+	cw, err := NewCompressor(w, options.Compress)
+	if err != nil {
+		tc.log.Error("Failed to compress record file", "file", fname, "err", err)
+		fp.Close()
+		return err
+	}
+
+	rw, err := NewRecordWriter(cw, hdr, options.Signer)
+	if err != nil {
+		tc.log.Error("Failed to write record header", "file", fname, "err", err)
+		fp.Close()
+		return err
+	}
+
+	setRecording(fname, true)
+
+	if options.RecordStarted != nil {
+		go options.RecordStarted(fname, tc.User)
+	}
+
+	tc.record = fp
+	tc.encrypter = enc
+	tc.compressor = cw
+	tc.recorder = rw
+	tc.lastRecTime = time.Now()
+	tc.log.Info("Started recording", "file", fname, "mandatory", tc.mandatory, "compress", options.Compress, "encrypt", options.Encrypt)
+	return nil
+}
+
+// every record is complete once written, so the file is just closed
+func (tc *TermConn) stopRecord() {
+	if tc.record == nil {
+		return
+	}
+
+	// sign the recording
+	if err := tc.recorder.Close(); err != nil {
+		tc.log.Error("Failed to end the recording", "file", tc.record.Name(), "err", err)
+	}
+
+	if err := tc.compressor.Close(); err != nil {
+		tc.log.Error("Failed to end the compression", "file", tc.record.Name(), "err", err)
+	}
+
+	if tc.encrypter != nil {
+		if err := tc.encrypter.Close(); err != nil {
+			tc.log.Error("Failed to end the encryption", "file", tc.record.Name(), "err", err)
+		}
+	}
+
+	tc.log.Info("Stopped recording", "file", tc.record.Name())
+	tc.record.Close()
+	setRecording(tc.record.Name(), false)
+
+	// do not hold up the session
+	if options.RecordClosed != nil {
+		go options.RecordClosed(tc.record.Name())
+	}
+
+	tc.record = nil
+	tc.encrypter = nil
+	tc.compressor = nil
+	tc.recorder = nil
+}
+
+// handle websockets. If banner is not empty, the session is recorded from
+// the first byte and the banner is shown to the player
+func handlePlayer(w http.ResponseWriter, r *http.Request, name string, user string, cmdline []string, banner string) {
 	ws, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		log.Println("Failed to create websocket: ", err)
+		logger.Warn("Failed to create websocket", "session", name, "user", user, "err", err)
 		return
 	}
 
 	tc := TermConn{
-		ws:   ws,
-		Name: name,
-		Ip:   ws.RemoteAddr().String(),
+		ws:        ws,
+		Name:      name,
+		Ip:        ws.RemoteAddr().String(),
+		User:      user,
+		mandatory: banner != "",
+	}
+
+	tc.log = logger.With("session", name, "user", user)
+
+	if options.ConnValid != nil {
+		tc.valid = func() bool { return options.ConnValid(r) }
 	}
 
 	defer tc.release()
-	log.Println("Created the websocket to", ws.RemoteAddr().String())
+	tc.log.Info("Created the websocket", "ip", tc.Ip)
 
 	tc.ws_done = make(chan struct{})
 	tc.pty_done = make(chan struct{})
-	tc.viewChan = make(chan *websocket.Conn)
+	tc.checkChan = make(chan struct{}, 1)
+	tc.viewChan = make(chan *viewer)
 	tc.recordChan = make(chan int)
+	tc.inputChan = make(chan []byte, inputQueue)
 
 	if err := tc.createPty(cmdline); err != nil {
-		log.Println("Failed to create PTY: ", err)
+		tc.log.Error("Failed to create PTY", "err", err)
 		return
 	}
 
+	// the session is not started if it cannot be recorded as required
+	if tc.mandatory {
+		if err := tc.startRecord(); err != nil {
+			tc.ws.WriteMessage(websocket.BinaryMessage, []byte("\r\nThe session must be recorded, but the recording failed\r\n"))
+			return
+		}
+
+		tc.ws.WriteMessage(websocket.BinaryMessage, []byte("\x1b[1;31m"+banner+"\x1b[0m\r\n"))
+	}
+
 	registry.addPlayer(&tc)
 
 	// main event loop to shovel data between ws and pty
@@ -403,37 +758,82 @@ func handlePlayer(w http.ResponseWriter, r *http.Request, name string, cmdline [
 	go tc.wsToPtyStdin(&wg)
 
 	wg.Wait()
-	log.Println("Wait returned")
+	tc.log.Debug("Wait returned")
 }
 
 // handle websockets
-func handleViewer(w http.ResponseWriter, r *http.Request, path string) {
+func handleViewer(w http.ResponseWriter, r *http.Request, path string, v *viewer) {
 	ws, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		log.Println("Failed to create websocket: ", err)
+		logger.Warn("Failed to create websocket", "session", path, "viewer", v.name, "err", err)
 		return
 	}
 
-	log.Println("Created the websocket to", ws.RemoteAddr().String())
-	if !registry.sendToPlayer(path, ws) {
-		log.Println("Failed to send websocket to player, close it")
+	logger.Info("Created the viewer websocket", "session", path, "viewer", v.name, "ip", ws.RemoteAddr().String())
+	v.ws = ws
+
+	if options.ConnValid != nil {
+		shareValid := v.valid
+		v.valid = func() bool {
+			return options.ConnValid(r) && (shareValid == nil || shareValid())
+		}
+	}
+
+	if !registry.sendToPlayer(path, v) {
+		logger.Info("Failed to send websocket to player, close it", "session", path)
 		ws.Close()
 	}
 }
 
-func ConnectTerm(w http.ResponseWriter, r *http.Request, isViewer bool, name string, cmdline []string) {
+// ConnectTerm connects the websocket to a new session, or to an existing
+// session as a viewer. user is the owner of the new session or the viewer
+func ConnectTerm(w http.ResponseWriter, r *http.Request, isViewer bool, name string, user string, cmdline []string) {
 	if !isViewer {
-		handlePlayer(w, r, name, cmdline)
+		handlePlayer(w, r, name, user, cmdline, "")
 	} else {
-		handleViewer(w, r, name)
+		handleViewer(w, r, name, &viewer{name: user})
 	}
 }
 
-func Init() {
+// ConnectRecorded connects the player to a new session that is recorded
+// from the start, the banner tells the player about it
+func ConnectRecorded(w http.ResponseWriter, r *http.Request, name string, user string, cmdline []string, banner string) {
+	handlePlayer(w, r, name, user, cmdline, banner)
+}
+
+// ConnectGuest connects a viewer without an account to the session. The
+// viewer is disconnected once valid returns false
+func ConnectGuest(w http.ResponseWriter, r *http.Request, name string, label string, valid func() bool) {
+	handleViewer(w, r, name, &viewer{name: label, valid: valid})
+}
+
+// Init sets up the registry, opts can be nil to use the default options
+func Init(opts *Options) {
+	if opts != nil {
+		options = *opts
+	}
+
+	if options.Logger != nil {
+		logger = options.Logger
+	}
+
+	// the web server reads the encrypted recordings too
+	SetRecordKeys(options.Keys)
 	registry.init()
 }
 
+// CheckSessions makes the sessions check their players and viewers now,
+// e.g., after client certificates are revoked
+func CheckSessions() {
+	ForEachSession(func(tc *TermConn) {
+		select {
+		case tc.checkChan <- struct{}{}:
+		default: // a check is pending
+		}
+	})
+}
+
 func StartRecord(id string) {
 	registry.recordSession(id, recordCmd)
 }
@@ -0,0 +1,5 @@
+package term_conn
+
+import "golang.org/x/sys/unix"
+
+const ioctlReadTermios = unix.TCGETS
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package term_conn
+
+import "os"
+
+// the terminal state is unknown, never mask the input
+func hiddenInput(ptmx *os.File) bool {
+	return false
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package term_conn
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// hiddenInput checks whether the terminal reads a line without echoing
+// it, e.g., a password prompt. Line editors like readline also turn the
+// echo off, but they read in the raw mode and echo the input themselves
+func hiddenInput(ptmx *os.File) bool {
+	conn, err := ptmx.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	hidden := false
+
+	// Fd() would put the pty into blocking mode, use the raw conn instead
+	conn.Control(func(fd uintptr) {
+		if t, err := unix.IoctlGetTermios(int(fd), ioctlReadTermios); err == nil {
+			hidden = t.Lflag&unix.ECHO == 0 && t.Lflag&unix.ICANON != 0
+		}
+	})
+
+	return hidden
+}
@@ -0,0 +1,135 @@
+package term_conn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Verified describes a recording that passed the verification
+type Verified struct {
+	Header   *RecordHeader
+	Records  int
+	Key      string // the ID of the signing key
+	Unsigned bool   // the signature is not checked, there is no key
+}
+
+// VerifyRecording checks the hash chain and the signature of the recording.
+// The error reports the first modified record or the bad signature. If
+// pub is nil, only the hashes are checked and the result is Unsigned
+func VerifyRecording(r io.Reader, pub ed25519.PublicKey) (*Verified, error) {
+	zr, err := OpenRecording(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+
+	var hdr *RecordHeader
+	var digest []byte
+	var end *RecordEnd
+	count := 0
+
+	for lineno := 1; ; lineno++ {
+		line, rerr := br.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return nil, rerr
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if hdr == nil && line[0] == '[' {
+				return nil, errors.New("legacy recording, it has no hashes to verify")
+			}
+
+			if rerr == io.EOF {
+				return nil, fmt.Errorf("line %d: incomplete, the recording was not closed", lineno)
+			}
+
+			switch {
+			case hdr == nil:
+				var h RecordHeader
+				if err := json.Unmarshal(line, &h); err != nil {
+					return nil, fmt.Errorf("line %d: invalid header: %v", lineno, err)
+				}
+
+				if h.Hash != HashSHA256 {
+					return nil, errors.New("the records are not chained, nothing to verify")
+				}
+
+				hdr = &h
+				sum := sha256.Sum256(line)
+				digest = sum[:]
+
+			case end != nil:
+				return nil, fmt.Errorf("line %d: data after the end of the recording", lineno)
+
+			default:
+				var rl recordLine
+				if err := json.Unmarshal(line, &rl); err != nil {
+					return nil, fmt.Errorf("line %d: invalid record: %v", lineno, err)
+				}
+
+				if rl.End != nil {
+					end = rl.End
+					continue
+				}
+
+				count++
+				digest = chainHash(digest, &rl.WriteRecord)
+
+				if rl.Hash != hex.EncodeToString(digest) {
+					// the first record does not match if the header was modified
+					if count == 1 {
+						return nil, fmt.Errorf("the header or record 1 (line %d) was modified", lineno)
+					}
+
+					return nil, fmt.Errorf("record %d (line %d) was modified", count, lineno)
+				}
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+	}
+
+	if hdr == nil {
+		return nil, errors.New("empty recording")
+	}
+
+	if end == nil {
+		return nil, fmt.Errorf("the recording has %d records but no end, it was not closed or was cut short", count)
+	}
+
+	if end.Records != count || end.Digest != hex.EncodeToString(digest) {
+		return nil, fmt.Errorf("the end does not match the %d records, records were removed or the end was modified", count)
+	}
+
+	if end.Signature == "" {
+		return nil, errors.New("the recording is not signed")
+	}
+
+	// anyone can make the hashes of a forged recording, say so
+	if pub == nil {
+		return &Verified{Header: hdr, Records: count, Key: end.Key, Unsigned: true}, nil
+	}
+
+	if end.Key != KeyID(pub) {
+		return nil, fmt.Errorf("signed by key %s, not by the given key %s", end.Key, KeyID(pub))
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(end.Signature)
+	if err != nil || !ed25519.Verify(pub, digest, sig) {
+		return nil, errors.New("bad signature")
+	}
+
+	return &Verified{Header: hdr, Records: count, Key: end.Key}, nil
+}
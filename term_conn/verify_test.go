@@ -0,0 +1,112 @@
+package term_conn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func joinLines(lines []string) []byte {
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// change the JSON line with fn and marshal it again
+func editLine(t *testing.T, line string, fn func(v map[string]interface{})) string {
+	t.Helper()
+
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	fn(v)
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestVerifyRecording(t *testing.T) {
+	data, pub := signedRecording(t)
+
+	v, err := VerifyRecording(bytes.NewReader(data), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Records != len(testRecords) || v.Key != KeyID(pub) {
+		t.Fatalf("wrong result %+v", v)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	data, pub := signedRecording(t)
+	lines := recordLines(data)
+
+	// the header, three records and the end
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, expect 5", len(lines))
+	}
+
+	changed := func(i int, fn func(v map[string]interface{})) []byte {
+		out := append([]string{}, lines...)
+		out[i] = editLine(t, lines[i], fn)
+		return joinLines(out)
+	}
+
+	removed := func(i int) []byte {
+		out := append([]string{}, lines[:i]...)
+		return joinLines(append(out, lines[i+1:]...))
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		expect string
+	}{
+		{"header", changed(0, func(v map[string]interface{}) { v["user"] = "mallory" }), "the header or record 1"},
+		{"data", changed(2, func(v map[string]interface{}) { v["Data"] = "cm0gLXJmIC8NCg==" }), "record 2 (line 3) was modified"},
+		{"duration", changed(3, func(v map[string]interface{}) { v["Duration"] = 1 }), "record 3 (line 4) was modified"},
+		{"removed", removed(2), "record 2 (line 3) was modified"},
+		{"last removed", removed(3), "records were removed"},
+		{"count", changed(4, func(v map[string]interface{}) {
+			v["end"].(map[string]interface{})["records"] = 2
+		}), "records were removed"},
+		{"signature", changed(4, func(v map[string]interface{}) {
+			v["end"].(map[string]interface{})["signature"] = "AAAA"
+		}), "bad signature"},
+		{"unsigned", changed(4, func(v map[string]interface{}) {
+			delete(v["end"].(map[string]interface{}), "signature")
+		}), "not signed"},
+		{"cut", joinLines(lines[:4]), "no end"},
+		{"appended", joinLines(append(append([]string{}, lines...), lines[1])), "data after the end"},
+	}
+
+	for _, tt := range tests {
+		_, err := VerifyRecording(bytes.NewReader(tt.data), pub)
+		if err == nil || !strings.Contains(err.Error(), tt.expect) {
+			t.Errorf("%s: got %v, expect %q", tt.name, err, tt.expect)
+		}
+	}
+
+	// signed by another key
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := VerifyRecording(bytes.NewReader(data), other); err == nil {
+		t.Error("expect an error for the wrong key")
+	}
+
+	// without a key, only the hashes are checked and the result says so
+	if v, err := VerifyRecording(bytes.NewReader(data), nil); err != nil || !v.Unsigned {
+		t.Errorf("no key: got %+v, %v, expect the signature not checked", v, err)
+	}
+
+	modified := changed(2, func(v map[string]interface{}) { v["Data"] = "cm0gLXJmIC8NCg==" })
+	if _, err := VerifyRecording(bytes.NewReader(modified), nil); err == nil {
+		t.Error("no key: expect an error for the modified record")
+	}
+}
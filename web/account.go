@@ -0,0 +1,178 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+	"github.com/syssecfsu/witty/cmd"
+)
+
+const (
+	accountMsgKey = "account_msg"
+	adminMsgKey   = "admin_msg"
+)
+
+// the flash messages are kept in short-lived cookies, not in the session,
+// so that requests without a login do not make sessions
+const msgMaxAge = 60
+
+// flash a message to be shown on the next page load
+func leftMsg(c *gin.Context, key string, msg string) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "witty_" + key,
+		Value:    url.QueryEscape(msg),
+		Path:     "/",
+		MaxAge:   msgMaxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func takeMsg(c *gin.Context, key string) string {
+	cookie, err := c.Request.Cookie("witty_" + key)
+	if err != nil {
+		return ""
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     cookie.Name,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	msg, _ := url.QueryUnescape(cookie.Value)
+	return msg
+}
+
+func sessionUser(c *gin.Context) string {
+	user, _ := sessions.Default(c).Get(userKey).(string)
+	return user
+}
+
+func accountPage(c *gin.Context) {
+	user := sessionUser(c)
+	_, err := cmd.LookupUser(user)
+
+	c.HTML(http.StatusOK, "account.html", gin.H{
+		"user":      user,
+		"local":     err == nil,
+		"must":      sessions.Default(c).Get(mustKey) != nil,
+		"admin":     isAdmin(c),
+		"msg":       takeMsg(c, accountMsgKey),
+		"csrfField": csrf.TemplateField(c.Request),
+	})
+}
+
+// change the password of the current user
+func changePasswd(c *gin.Context) {
+	user := sessionUser(c)
+	current := c.PostForm("current")
+	passwd := c.PostForm("passwd")
+
+	if passwd != c.PostForm("passwd2") {
+		leftMsg(c, accountMsgKey, "New passwords do not match")
+		c.Redirect(http.StatusSeeOther, "/account")
+		return
+	}
+
+	err := cmd.ChangePassword(user, []byte(current), []byte(passwd), &options.Policy)
+
+	switch err {
+	case nil:
+		// keep this login, the others must login with the new password
+		session := sessions.Default(c)
+		current := ""
+		if cookie, err := c.Request.Cookie(sessionCookie); err == nil {
+			current = hashID(cookie.Value)
+		}
+
+		sessStore.revokeUser(user, current)
+
+		if info, err := cmd.LookupUser(user); err == nil {
+			session.Set(changeKey, info.Changed)
+		}
+
+		session.Delete(mustKey)
+		session.Save()
+		leftMsg(c, accountMsgKey, "Password changed")
+
+	case cmd.ErrUserNotFound:
+		leftMsg(c, accountMsgKey, "Your password is not managed by WiTTY")
+
+	default:
+		leftMsg(c, accountMsgKey, "Failed to change password: "+err.Error())
+	}
+
+	c.Redirect(http.StatusSeeOther, "/account")
+}
+
+func adminPage(c *gin.Context) {
+	users, err := cmd.ListUserInfo()
+	msg := takeMsg(c, adminMsgKey)
+
+	if err != nil {
+		msg = "Failed to read users: " + err.Error()
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	c.HTML(http.StatusOK, "admin.html", gin.H{
+		"users":     users,
+		"logins":    sessStore.logins(),
+		"msg":       msg,
+		"csrfField": csrf.TemplateField(c.Request),
+	})
+}
+
+// reset the password of another user
+func resetPasswd(c *gin.Context) {
+	user := c.Param("user")
+	passwd := c.PostForm("passwd")
+	must := c.PostForm("must_change") != ""
+
+	err := cmd.ResetPassword(user, []byte(passwd), must, &options.Policy)
+
+	// the logins with the old password must login again
+	if err == nil {
+		sessStore.revokeUser(user, "")
+	}
+
+	if err != nil {
+		leftMsg(c, adminMsgKey, "Failed to reset password of "+user+": "+err.Error())
+	} else if must {
+		leftMsg(c, adminMsgKey, "Password of "+user+" reset, it must be changed on next login")
+	} else {
+		leftMsg(c, adminMsgKey, "Password of "+user+" reset")
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// revoke a single login session
+func revokeLogin(c *gin.Context) {
+	if sessStore.revoke(c.Param("id")) {
+		leftMsg(c, adminMsgKey, "Login session revoked")
+	} else {
+		leftMsg(c, adminMsgKey, "Login session does not exist")
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// revoke all the login sessions of a user, e.g., a compromised account
+func revokeUserLogins(c *gin.Context) {
+	user := c.Param("user")
+	n := sessStore.revokeUser(user, "")
+
+	leftMsg(c, adminMsgKey, "Revoked "+strconv.Itoa(n)+" login sessions of "+user)
+	c.Redirect(http.StatusSeeOther, "/admin")
+}
@@ -0,0 +1,33 @@
+package web
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// the networks allowed to connect, empty for all
+var allowedNets []*net.IPNet
+
+// IPAllowed rejects the clients outside of the allowed networks. It is
+// the first middleware, so nothing, not even the login page, is served
+// to them
+func IPAllowed(c *gin.Context) {
+	if len(allowedNets) == 0 {
+		c.Next()
+		return
+	}
+
+	ip := term_conn.ClientIP(c.Request)
+
+	if ip == nil || !term_conn.InNets(ip, allowedNets) {
+		logger.Warn("Reject client outside of the allowed IPs", "path", c.Request.URL.Path, "remote", c.Request.RemoteAddr, "ip", ip)
+		c.String(http.StatusForbidden, "Forbidden")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
@@ -0,0 +1,241 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// The JSON API is for scripted access. Requests are authenticated either
+// with a bearer token created by "witty token create", or with the same
+// cookie session as the web UI.
+
+const (
+	apiTokenKey = "api_token"
+	apiUserKey  = "api_user"
+	apiRoleKey  = "api_role" // the role of users authenticated outside of witty
+
+	maxUploadSize = 64 << 20
+)
+
+func bearerToken(c *gin.Context) (string, bool) {
+	auth := c.GetHeader("Authorization")
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+// skipCsrfForTokens marks requests with bearer tokens to skip the CSRF
+// check. Browsers never attach the tokens by themselves, so such requests
+// cannot be forged. It must be installed before the CSRF middleware of
+// the API group only.
+func skipCsrfForTokens(c *gin.Context) {
+	if _, ok := bearerToken(c); ok {
+		c.Request = csrf.UnsafeSkipCheck(c.Request)
+	}
+
+	c.Next()
+}
+
+func apiError(c *gin.Context, code int, msg string) {
+	c.AbortWithStatusJSON(code, gin.H{"error": msg})
+}
+
+// apiAuth authenticates API requests, a request with a bearer token
+// never falls back to the cookie session
+func apiAuth(c *gin.Context) {
+	if token, ok := bearerToken(c); ok {
+		rec := cmd.ValidateToken(token)
+
+		if rec == nil {
+			apiError(c, http.StatusUnauthorized, "invalid or expired token")
+			return
+		}
+
+		c.Set(apiTokenKey, rec)
+		c.Set(apiUserKey, rec.User)
+		c.Next()
+		return
+	}
+
+	if options.NoAuth {
+		c.Next()
+		return
+	}
+
+	user, role := externalUser(c)
+
+	if user != "" {
+		c.Set(apiRoleKey, role)
+	} else {
+		var state int
+		user, state = checkSession(c)
+
+		switch state {
+		case sessionNoUser, sessionRevoked:
+			apiError(c, http.StatusUnauthorized, "authentication required")
+			return
+		case sessionMustChange:
+			apiError(c, http.StatusForbidden, "the password must be changed first")
+			return
+		}
+	}
+
+	c.Set(apiUserKey, user)
+	c.Next()
+}
+
+// requireScope checks the scope of token requests, cookie sessions
+// have the full access as the web UI
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v, ok := c.Get(apiTokenKey); ok && !v.(*cmd.TokenRecord).HasScope(scope) {
+			apiError(c, http.StatusForbidden, "token does not have the "+scope+" scope")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func apiListSessions(c *gin.Context) {
+	players := collectSessions(c, options.CmdToExec[0])
+
+	if players == nil {
+		players = []InteractiveSession{}
+	}
+
+	c.JSON(http.StatusOK, players)
+}
+
+// the recordings can be sorted and paged like the records tab, all of
+// them are returned unless per_page is set
+func apiListRecords(c *gin.Context) {
+	perPage, _ := strconv.Atoi(c.Query("per_page"))
+	records, page := collectRecords(c, perPage)
+
+	c.Header("X-Total-Count", strconv.Itoa(page.Total))
+	c.Header("X-Page-Count", strconv.Itoa(page.Pages))
+
+	if records == nil {
+		records = []RecordedSession{}
+	}
+
+	c.JSON(http.StatusOK, records)
+}
+
+func apiGetRecord(c *gin.Context) {
+	fname := c.Param("fname")
+
+	if _, code, msg := recordAccess(c, fname, false); code != http.StatusOK {
+		apiError(c, code, msg)
+		return
+	}
+
+	switch c.Query("format") {
+	case "", "scr":
+		sendRecord(c, fname, true)
+	case cmd.FormatAsciicast:
+		sendCast(c, fname)
+	default:
+		apiError(c, http.StatusBadRequest, "unknown format, expect scr or asciicast")
+	}
+}
+
+// upload a recording, the body is the content of the .scr file
+func apiUploadRecord(c *gin.Context) {
+	fname := c.Param("fname")
+
+	if !strings.HasSuffix(fname, cmd.RecordExt) {
+		fname += cmd.RecordExt
+	}
+
+	if !cmd.ValidRecordName(fname) {
+		apiError(c, http.StatusBadRequest, "invalid recording name")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize))
+	if err != nil {
+		apiError(c, http.StatusRequestEntityTooLarge, "recording is too large")
+		return
+	}
+
+	if _, _, err := term_conn.ReadRecording(bytes.NewReader(data)); err != nil {
+		apiError(c, http.StatusBadRequest, "not a valid recording: "+err.Error())
+		return
+	}
+
+	fp, err := recStore.Create(fname)
+	if err != nil {
+		recordError(c, fname, err)
+		return
+	}
+
+	// compressed and encrypted like the recordings of the sessions
+	if err := cmd.SaveRecord(fp, bytes.NewReader(data)); err != nil {
+		reqLog(c).Error("Failed to write record file", "err", err)
+		recStore.Remove(fname)
+		apiError(c, http.StatusInternalServerError, "failed to save recording")
+		return
+	}
+
+	// the uploader owns the recording, not the user in its header
+	user, _ := recordUser(c)
+
+	err = recStore.UpdateMeta(fname, func(meta *cmd.RecordMeta) bool {
+		meta.Owner = user
+		return true
+	})
+
+	if err != nil {
+		reqLog(c).Error("Failed to update the record index", "err", err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"name": fname})
+}
+
+func apiDeleteRecord(c *gin.Context) {
+	fname := c.Param("fname")
+
+	meta, code, msg := recordAccess(c, fname, true)
+	if code == http.StatusOK {
+		code, msg = recordRemovable(c, meta)
+	}
+
+	if code != http.StatusOK {
+		apiError(c, code, msg)
+		return
+	}
+
+	if err := recStore.Remove(fname); err != nil {
+		recordError(c, fname, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+const apiPrefix = "/api/v1"
+
+// the API requests with cookies are checked for CSRF like the web UI
+func setupAPI(rt *gin.Engine, csrfGin gin.HandlerFunc) {
+	api := rt.Group(apiPrefix)
+	api.Use(skipCsrfForTokens, csrfGin, apiAuth)
+
+	api.GET("/sessions", requireScope(cmd.ScopeSessionsRead), apiListSessions)
+	api.GET("/records", requireScope(cmd.ScopeRecordsRead), apiListRecords)
+	api.GET("/records/:fname", requireScope(cmd.ScopeRecordsRead), apiGetRecord)
+	api.PUT("/records/:fname", requireScope(cmd.ScopeRecordsWrite), apiUploadRecord)
+	api.DELETE("/records/:fname", requireScope(cmd.ScopeRecordsWrite), apiDeleteRecord)
+}
@@ -8,18 +8,24 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/csrf"
 	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/term_conn"
 )
 
 const (
-	userKey  = "authorized_user"
-	nameKey  = "last_login"
-	loginKey = "login_msg"
+	userKey   = "authorized_user"
+	nameKey   = "last_login"
+	loginKey  = "login_msg"
+	roleKey   = "user_role"
+	mustKey   = "must_change"
+	localKey  = "local_user"
+	changeKey = "passwd_changed" // when the password of a local user is set
+
+	roleAdmin = "admin"
+	roleUser  = "user"
 )
 
 func leftLoginMsg(c *gin.Context, msg string) {
-	session := sessions.Default(c)
-	session.Set(loginKey, msg)
-	session.Save()
+	leftMsg(c, loginKey, msg)
 }
 
 func login(c *gin.Context) {
@@ -36,7 +42,8 @@ func login(c *gin.Context) {
 	}
 
 	// Check for username and password match, usually from a database
-	if !cmd.ValidateUser([]byte(username), []byte(passwd)) {
+	if !options.Auth.Authenticate([]byte(username), []byte(passwd)) {
+		reqLog(c).Warn("Login failed", "login", username)
 		leftLoginMsg(c, "Username/password does not match")
 		c.Redirect(http.StatusSeeOther, "/login")
 		return
@@ -45,6 +52,22 @@ func login(c *gin.Context) {
 	// Save the username in the session
 	session.Set(userKey, username)
 	session.Set(nameKey, username)
+	session.Set(roleKey, roleUser)
+
+	if options.Auth.Admin(username) {
+		session.Set(roleKey, roleAdmin)
+	}
+
+	// users in user.db are checked on every request, so that deleting
+	// them logs them out. The administrator may also require a new password
+	if info, err := cmd.LookupUser(username); err == nil && cmd.LocalBackend(options.Auth) {
+		session.Set(localKey, true)
+		session.Set(changeKey, info.Changed)
+
+		if info.MustChange {
+			session.Set(mustKey, true)
+		}
+	}
 
 	if err := session.Save(); err != nil {
 		leftLoginMsg(c, "Failed to save session data")
@@ -52,6 +75,7 @@ func login(c *gin.Context) {
 		return
 	}
 
+	reqLog(c).Info("Login", "login", username)
 	c.Redirect(http.StatusSeeOther, "/")
 }
 
@@ -61,6 +85,10 @@ func logout(c *gin.Context) {
 	user := session.Get(userKey)
 	if user != nil {
 		session.Delete(userKey)
+		session.Delete(roleKey)
+		session.Delete(mustKey)
+		session.Delete(localKey)
+		session.Delete(changeKey)
 		session.Save()
 	}
 
@@ -68,26 +96,167 @@ func logout(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/login")
 }
 
+// proxyUser returns the user authenticated by a trusted reverse proxy,
+// the header is ignored if the request does not come from such a proxy
+func proxyUser(c *gin.Context) string {
+	if options.ProxyHeader == "" {
+		return ""
+	}
+
+	user := strings.TrimSpace(c.GetHeader(options.ProxyHeader))
+	if user == "" {
+		return ""
+	}
+
+	if !term_conn.FromTrustedProxy(c.Request) {
+		logger.Warn("Ignore the proxy header from an untrusted address", "header", options.ProxyHeader, "remote", c.Request.RemoteAddr)
+		return ""
+	}
+
+	return user
+}
+
+// externalUser returns the user authenticated outside of witty, either
+// by a client certificate or by a reverse proxy, and its role. The roles
+// in user.db do not apply, a colliding name must not make an admin
+func externalUser(c *gin.Context) (string, string) {
+	user, admins := certUser(c), options.ClientCert.Admins
+
+	if user == "" {
+		user, admins = proxyUser(c), options.ProxyAdmins
+	}
+
+	if user != "" && contains(admins, user) {
+		return user, roleAdmin
+	}
+
+	return user, roleUser
+}
+
 // AuthRequired is a simple middleware to check the session
 func AuthRequired(c *gin.Context) {
 	session := sessions.Default(c)
-	user := session.Get(userKey)
 
-	if user == nil {
+	if eu, role := externalUser(c); eu != "" {
+		// remember the user in the session, so it works the same as form login
+		if session.Get(userKey) != eu || session.Get(roleKey) != role {
+			session.Set(userKey, eu)
+			session.Set(nameKey, eu)
+			session.Set(roleKey, role)
+			session.Save()
+		}
+
+		c.Next()
+		return
+	}
+
+	user, state := checkSession(c)
+
+	switch state {
+	case sessionNoUser:
 		leftLoginMsg(c, "Not authorized, login first")
 		c.Redirect(http.StatusTemporaryRedirect, "/login")
 		c.Abort()
 		return
+
+	case sessionRevoked:
+		logger.Info("User no longer exists or the password is reset, log it out", "user", user)
+		session.Clear()
+		session.Save()
+		leftLoginMsg(c, "Not authorized, login first")
+
+		c.Redirect(http.StatusTemporaryRedirect, "/login")
+		c.Abort()
+		return
+
+	case sessionMustChange:
+		// only allow the user to change the password or logout
+		if p := c.Request.URL.Path; p != "/account" && p != "/logout" {
+			c.Redirect(http.StatusSeeOther, "/account")
+			c.Abort()
+			return
+		}
 	}
 
 	c.Next()
 }
 
+// the states of the login in a session, see checkSession
+const (
+	sessionValid      = iota
+	sessionNoUser     // not logged in
+	sessionRevoked    // the user is deleted or its password is reset
+	sessionMustChange // the user must change the password first
+)
+
+// checkSession returns the user of the session and whether its login is
+// still valid, for both the web UI and the API
+func checkSession(c *gin.Context) (string, int) {
+	session := sessions.Default(c)
+	user, _ := session.Get(userKey).(string)
+
+	if user == "" {
+		return "", sessionNoUser
+	}
+
+	// users in user.db are checked on every request
+	if session.Get(localKey) != nil {
+		info, err := cmd.LookupUser(user)
+
+		if err == cmd.ErrUserNotFound {
+			return user, sessionRevoked
+		}
+
+		// the password is changed after the login, e.g., by the CLI
+		changed, _ := session.Get(changeKey).(int64)
+		if err == nil && info.Changed != changed {
+			return user, sessionRevoked
+		}
+	}
+
+	if session.Get(mustKey) != nil {
+		return user, sessionMustChange
+	}
+
+	return user, sessionValid
+}
+
+// AdminRequired only allows administrators, it must follow AuthRequired
+func AdminRequired(c *gin.Context) {
+	if !isAdmin(c) {
+		c.String(http.StatusForbidden, "Administrators only")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+func isAdmin(c *gin.Context) bool {
+	return sessions.Default(c).Get(roleKey) == roleAdmin
+}
+
+// the role of users in user.db, e.g., for their API tokens
+func localRole(username string) string {
+	if info, err := cmd.LookupUser(username); err == nil && info.Admin {
+		return roleAdmin
+	}
+
+	return roleUser
+}
+
 func loginPage(c *gin.Context) {
+	// already authenticated by client certificate or reverse proxy,
+	// no need to login again
+	if eu, _ := externalUser(c); eu != "" {
+		c.Redirect(http.StatusSeeOther, "/")
+		return
+	}
+
 	session := sessions.Default(c)
-	msg := session.Get(loginKey)
+	msg := takeMsg(c, loginKey)
 
-	if msg == nil {
+	if msg == "" {
 		msg = "Login first"
 	}
 
@@ -101,6 +270,7 @@ func loginPage(c *gin.Context) {
 			"msg":       msg,
 			"username":  username,
 			"csrfField": csrf.TemplateField(c.Request),
+			"oidc":      oidcEnabled(),
 		},
 	)
 }
@@ -0,0 +1,198 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/term_conn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPasswd = "Passw0rd!xyz"
+
+// user.db in a temporary directory with the administrator root1
+func testUserDB(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cmd.SetDataFiles(filepath.Join(dir, "user.db"), filepath.Join(dir, "token.db"))
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPasswd), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.AddUser("root1", &cmd.AddUserOptions{PasswdHash: string(hash), Admin: true, AdminSet: true})
+
+	if info, err := cmd.LookupUser("root1"); err != nil || !info.Admin {
+		t.Fatalf("failed to add the administrator: %v", err)
+	}
+}
+
+// a backend other than user.db, e.g., ldap, that accepts everyone
+type testAuth struct {
+	admins []string
+}
+
+func (a testAuth) Authenticate(username []byte, passwd []byte) bool {
+	return true
+}
+
+func (a testAuth) Admin(username string) bool {
+	return contains(a.admins, username)
+}
+
+func roleRouter(t *testing.T) *gin.Engine {
+	rt := newTestRouter(t)
+	rt.POST("/login", login)
+	rt.GET("/role", AuthRequired, func(c *gin.Context) {
+		role, _ := sessions.Default(c).Get(roleKey).(string)
+		c.String(http.StatusOK, sessionUser(c)+" "+role)
+	})
+
+	return rt
+}
+
+// login with the form and return the cookies of the session
+func loginCookies(t *testing.T, rt *gin.Engine, user string) []*http.Cookie {
+	t.Helper()
+
+	form := url.Values{"username": {user}, "passwd": {testPasswd}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+	return w.Result().Cookies()
+}
+
+// the user and the role of the session, empty if it is not logged in
+func sessionRole(rt *gin.Engine, cookies []*http.Cookie) string {
+	req := httptest.NewRequest(http.MethodGet, "/role", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		return ""
+	}
+
+	return w.Body.String()
+}
+
+// login with the form and return the user and the role of the session
+func loginRole(t *testing.T, rt *gin.Engine, user string) string {
+	t.Helper()
+	return sessionRole(rt, loginCookies(t, rt, user))
+}
+
+func TestLoginRole(t *testing.T) {
+	testUserDB(t)
+	defer func(auth cmd.Authenticator) { options.Auth = auth }(options.Auth)
+
+	rt := roleRouter(t)
+
+	// only the json backend uses the roles in user.db
+	options.Auth, _ = cmd.NewAuthenticator(&cmd.AuthConfig{})
+	if got := loginRole(t, rt, "root1"); got != "root1 admin" {
+		t.Errorf("json: got %q, expect the admin", got)
+	}
+
+	options.Auth = testAuth{}
+	if got := loginRole(t, rt, "root1"); got != "root1 user" {
+		t.Errorf("ldap: got %q, expect a normal user", got)
+	}
+
+	options.Auth = testAuth{admins: []string{"carol"}}
+	if got := loginRole(t, rt, "carol"); got != "carol admin" {
+		t.Errorf("ldap: got %q, expect the configured admin", got)
+	}
+}
+
+func TestExternalRole(t *testing.T) {
+	testUserDB(t)
+	defer func() { options.ProxyHeader, options.ProxyAdmins = "", nil }()
+
+	// httptest requests come from 192.0.2.1
+	if err := term_conn.SetTrustedProxies([]string{"192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer term_conn.SetTrustedProxies(nil)
+
+	rt := roleRouter(t)
+	options.ProxyHeader = "X-Remote-User"
+
+	role := func(user string) string {
+		req := httptest.NewRequest(http.MethodGet, "/role", nil)
+		req.Header.Set(options.ProxyHeader, user)
+
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// the name collides with the administrator in user.db
+	if got := role("root1"); got != "root1 user" {
+		t.Errorf("got %q, expect a normal user", got)
+	}
+
+	options.ProxyAdmins = []string{"root1"}
+	if got := role("root1"); got != "root1 admin" {
+		t.Errorf("got %q, expect the configured admin", got)
+	}
+}
+
+func TestPasswordRevoke(t *testing.T) {
+	testUserDB(t)
+	defer func(auth cmd.Authenticator) { options.Auth = auth }(options.Auth)
+
+	options.Auth, _ = cmd.NewAuthenticator(&cmd.AuthConfig{})
+	rt := roleRouter(t)
+	rt.POST("/account", AuthRequired, changePasswd)
+
+	current := loginCookies(t, rt, "root1")
+	other := loginCookies(t, rt, "root1")
+
+	form := url.Values{"current": {testPasswd}, "passwd": {"N3w-Passw0rd!"}, "passwd2": {"N3w-Passw0rd!"}}
+	req := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range current {
+		req.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+
+	if !cmd.ValidateUser([]byte("root1"), []byte("N3w-Passw0rd!")) {
+		t.Fatalf("password not changed: %d %v", w.Code, w.Result().Cookies())
+	}
+
+	// the session that changed the password is kept
+	if got := sessionRole(rt, current); got != "root1 admin" {
+		t.Errorf("current session: got %q", got)
+	}
+
+	if got := sessionRole(rt, other); got != "" {
+		t.Errorf("other session: got %q, expect it to be revoked", got)
+	}
+
+	// a reset by the CLI, in another process, revokes the remaining login
+	if err := cmd.ResetPassword("root1", []byte(testPasswd), false, &cmd.PasswordPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sessionRole(rt, current); got != "" {
+		t.Errorf("after reset: got %q, expect the session to be revoked", got)
+	}
+}
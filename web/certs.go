@@ -0,0 +1,100 @@
+package web
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the server certificate and reloads it on SIGHUP or
+// when the files change. Established connections, e.g., live terminals,
+// keep using the certificate they were opened with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx     sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // of the certificate file
+	keyTime time.Time // of the key file
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := cr.reload(true); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// reload the certificate, unless it is unchanged and force is not set
+func (cr *certReloader) reload(force bool) error {
+	cinfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+
+	kinfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mtx.RLock()
+	unchanged := cinfo.ModTime().Equal(cr.modTime) && kinfo.ModTime().Equal(cr.keyTime)
+	cr.mtx.RUnlock()
+
+	if unchanged && !force {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mtx.Lock()
+	cr.cert = &cert
+	cr.modTime = cinfo.ModTime()
+	cr.keyTime = kinfo.ModTime()
+	cr.mtx.Unlock()
+
+	logger.Info("Loaded the server certificate", "file", cr.certFile)
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mtx.RLock()
+	defer cr.mtx.RUnlock()
+
+	return cr.cert, nil
+}
+
+// reload on SIGHUP, and when the files change. A half written pair, e.g.,
+// the new cert with the old key, fails to load and is retried later
+func (cr *certReloader) watch(period time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		force := false
+
+		select {
+		case <-hup:
+			logger.Info("Received SIGHUP, reload the server certificate")
+			force = true
+		case <-ticker.C:
+		}
+
+		if err := cr.reload(force); err != nil {
+			logger.Error("Failed to reload the server certificate, keep using the old one", "err", err)
+		}
+	}
+}
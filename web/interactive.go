@@ -2,6 +2,7 @@ package web
 
 import (
 	"net/http"
+	"net/url"
 
 	"github.com/dchest/uniuri"
 	"github.com/gin-gonic/gin"
@@ -10,20 +11,30 @@ import (
 )
 
 type InteractiveSession struct {
-	Ip  string
-	Cmd string
-	Id  string
+	Ip      string
+	Cmd     string
+	Id      string
+	User    string
+	Viewers []string
+	Shares  int // number of active share links
 }
 
 func collectSessions(c *gin.Context, cmd string) (players []InteractiveSession) {
 	term_conn.ForEachSession(func(tc *term_conn.TermConn) {
 		players = append(players, InteractiveSession{
-			Id:  tc.Name,
-			Ip:  tc.Ip,
-			Cmd: cmd,
+			Id:      tc.Name,
+			Ip:      tc.Ip,
+			Cmd:     cmd,
+			User:    tc.User,
+			Viewers: tc.Viewers(),
 		})
 	})
 
+	// do not hold the registry lock while taking the share lock
+	for i := range players {
+		players[i].Shares = shareLinks(players[i].Id)
+	}
+
 	return
 }
 
@@ -37,6 +48,7 @@ func indexPage(c *gin.Context) {
 	c.HTML(http.StatusOK, "index.html",
 		gin.H{
 			"disabled":  disabled,
+			"admin":     isAdmin(c),
 			"csrfField": csrf.TemplateField(c.Request),
 			"csrfToken": csrf.Token(c.Request),
 		})
@@ -57,11 +69,12 @@ func updateIndex(c *gin.Context) {
 	}
 
 	players := collectSessions(c, options.CmdToExec[0])
-	records := collectRecords(c)
+	records, page := collectRecords(c, recordsPerPage)
 
 	c.HTML(http.StatusOK, "tab.html", gin.H{
 		"players": players,
 		"records": records,
+		"page":    page,
 		"active0": active0,
 		"active1": active1,
 	})
@@ -75,27 +88,64 @@ func newInteractive(c *gin.Context) {
 		"path":      "/ws_new/" + id,
 		"id":        id,
 		"logo":      "keyboard",
+		"recorded":  mustRecord(c),
+		"admin":     isAdmin(c),
 		"csrfToken": csrf.Token(c.Request),
 	})
 }
 
 func newTermConn(c *gin.Context) {
 	id := c.Param("id")
-	term_conn.ConnectTerm(c.Writer, c.Request, false, id, options.CmdToExec)
+
+	if mustRecord(c) {
+		banner := options.Recording.Banner
+		if banner == "" {
+			banner = defaultBanner
+		}
+
+		term_conn.ConnectRecorded(c.Writer, c.Request, id, sessionUser(c), options.CmdToExec, banner)
+		return
+	}
+
+	term_conn.ConnectTerm(c.Writer, c.Request, false, id, sessionUser(c), options.CmdToExec)
 }
 
 func viewPage(c *gin.Context) {
 	id := c.Param("id")
+	title := "viewer terminal"
+	path := "/ws_view/" + id
+
+	// guests keep the share token for the websocket, and cannot record
+	guest := guestLink(c) != nil
+	if guest {
+		title = "viewer terminal (" + guestLabel + ")"
+		path += "?" + shareQuery + "=" + url.QueryEscape(c.Query(shareQuery))
+	}
+
 	c.HTML(http.StatusOK, "term.html", gin.H{
-		"title":     "viewer terminal",
-		"path":      "/ws_view/" + id,
+		"title":     title,
+		"path":      path,
 		"id":        id,
 		"logo":      "view",
+		"guest":     guest,
+		"recorded":  term_conn.RecordingMandatory(id),
+		"admin":     isAdmin(c),
 		"csrfToken": csrf.Token(c.Request),
 	})
 }
 
 func newViewWS(c *gin.Context) {
 	id := c.Param("id")
-	term_conn.ConnectTerm(c.Writer, c.Request, true, id, nil)
+
+	if link := guestLink(c); link != nil {
+		term_conn.ConnectGuest(c.Writer, c.Request, id, guestLabel, link.valid)
+		return
+	}
+
+	user := sessionUser(c)
+	if user == "" {
+		user = c.ClientIP()
+	}
+
+	term_conn.ConnectTerm(c.Writer, c.Request, true, id, user, nil)
 }
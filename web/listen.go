@@ -0,0 +1,170 @@
+package web
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// how the server accepts connections
+const (
+	ListenTLS  = "tls"  // HTTPS on all interfaces, the default
+	ListenHTTP = "http" // plain HTTP on the loopback, behind a reverse proxy
+	ListenUnix = "unix" // plain HTTP on a Unix socket, behind a reverse proxy
+)
+
+// ParseSocketMode parses the permissions of the Unix socket, e.g., 0660
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+
+	if err != nil || m > 0777 {
+		return 0, errors.New("invalid socket mode " + strconv.Quote(mode) + ", expect octal like 0660")
+	}
+
+	return os.FileMode(m), nil
+}
+
+// create the Unix socket, a socket left by a previous run is removed
+func listenUnix(path string, mode string) (net.Listener, error) {
+	perm, err := ParseSocketMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if finfo, err := os.Lstat(path); err == nil {
+		if finfo.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// listenAddrs returns the addresses to listen on. Each bind address is an
+// IP or host name, optionally with a port, e.g., 10.8.0.1, ::1, or [::1]:9090.
+// def is used if there is no bind address
+func listenAddrs(bind []string, port string, def string) []string {
+	if len(bind) == 0 {
+		return []string{net.JoinHostPort(def, port)}
+	}
+
+	var addrs []string
+
+	for _, b := range bind {
+		if _, _, err := net.SplitHostPort(b); err == nil {
+			addrs = append(addrs, b)
+		} else {
+			addrs = append(addrs, net.JoinHostPort(b, port))
+		}
+	}
+
+	return addrs
+}
+
+// IsLoopback checks whether the bind address only accepts local connections
+func IsLoopback(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		host = bind
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serve the requests with the configured listeners, it only returns on errors
+func serve(srv *http.Server, port string) error {
+	if options.Listen == ListenUnix {
+		l, err := listenUnix(options.Socket, options.SocketMode)
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(options.Socket)
+
+		srv.ConnContext = term_conn.SocketConnContext
+		return srv.Serve(l)
+	}
+
+	// never expose unencrypted terminals to the network
+	def := ""
+	if options.Listen == ListenHTTP {
+		def = "127.0.0.1"
+	}
+
+	var listeners []net.Listener
+
+	for _, addr := range listenAddrs(options.Bind, port, def) {
+		if options.Listen == ListenHTTP && !IsLoopback(addr) {
+			return errors.New("plain HTTP only listens on the loopback, not " + addr)
+		}
+
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	useTLS := options.Listen != ListenHTTP
+
+	if useTLS {
+		// the certificate can be replaced without restarting witty
+		cr, err := newCertReloader(options.TLSCert, options.TLSKey)
+		if err != nil {
+			return err
+		}
+
+		go cr.watch(options.CertCheckPeriod)
+
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+
+		srv.TLSConfig.GetCertificate = cr.getCertificate
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		logger.Info("Listening", "addr", l.Addr(), "tls", useTLS)
+
+		go func(l net.Listener) {
+			if useTLS {
+				errs <- srv.ServeTLS(l, "", "")
+			} else {
+				errs <- srv.Serve(l)
+			}
+		}(l)
+	}
+
+	return <-errs
+}
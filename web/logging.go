@@ -0,0 +1,74 @@
+package web
+
+import (
+	"os"
+	"time"
+
+	"github.com/gin-gonic/contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/logging"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// the logger of the web server, replaced by options.Logger in StartWeb
+var logger = logging.Default()
+
+// the user of the request for the logs: the user of the API token,
+// the guest of a share link, or the user in the session
+func logUser(c *gin.Context) string {
+	if u, ok := c.Get(apiUserKey); ok {
+		return u.(string)
+	}
+
+	if guestLink(c) != nil {
+		return guestLabel
+	}
+
+	// the session is missing if the request is rejected before it
+	if v, ok := c.Get(sessions.DefaultKey); ok {
+		u, _ := v.(sessions.Session).Get(userKey).(string)
+		return u
+	}
+
+	return ""
+}
+
+func clientIP(c *gin.Context) string {
+	if ip := term_conn.ClientIP(c.Request); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// reqLog returns the logger with the user and the client of the request
+func reqLog(c *gin.Context) *logging.Logger {
+	return logger.With("user", logUser(c), "ip", clientIP(c))
+}
+
+// accessLog logs every request, it replaces the gin logger
+func accessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	level := logging.LevelInfo
+	if status := c.Writer.Status(); status >= 500 {
+		level = logging.LevelError
+	} else if status >= 400 {
+		level = logging.LevelWarn
+	}
+
+	reqLog(c).Log(level, "Request", "method", c.Request.Method, "path", c.Request.URL.Path,
+		"status", c.Writer.Status(), "latency", time.Since(start))
+}
+
+// fatal logs the error of the setup and exits
+func fatal(msg string, err error) {
+	if err != nil {
+		logger.Error(msg, "err", err)
+	} else {
+		logger.Error(msg)
+	}
+
+	os.Exit(1)
+}
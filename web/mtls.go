@@ -0,0 +1,279 @@
+package web
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// ClientCertOptions configures mutual TLS. If CA is set, clients must
+// present a certificate signed by it, and the user name is taken from
+// the certificate instead of the login form.
+type ClientCertOptions struct {
+	CA          string        `yaml:"ca"`           // PEM file of the CA that signs client certificates
+	CRL         string        `yaml:"crl"`          // optional CRL of the CA, reloaded when it changes
+	UserField   string        `yaml:"user_field"`   // cn (default) or email, which field is the user name
+	CheckPeriod time.Duration `yaml:"check_period"` // how often to check the CRL for changes
+	Admins      []string      `yaml:"admins"`       // the users of the certificates who are administrators
+}
+
+const (
+	certUserCN    = "cn"
+	certUserEmail = "email"
+)
+
+// the currently loaded CRL, the set of revoked serial numbers. The
+// certificates are refused once the CRL is past its next update, until a
+// new CRL is in place
+type crlCache struct {
+	mtx        sync.RWMutex
+	loaded     bool
+	issuer     []byte
+	revoked    map[string]bool
+	modTime    time.Time
+	nextUpdate time.Time
+}
+
+var crl crlCache
+
+func clientCertEnabled() bool {
+	return options.ClientCert.CA != ""
+}
+
+func loadCAPool(fname string) (*x509.CertPool, *x509.Certificate, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	var first *x509.Certificate
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if first == nil {
+			first = cert
+		}
+
+		pool.AddCert(cert)
+	}
+
+	if first == nil {
+		return nil, nil, errors.New("no certificate found in " + fname)
+	}
+
+	return pool, first, nil
+}
+
+// reload the CRL if the file has changed, the CRL must be signed by the CA
+func (cc *crlCache) reload(fname string, ca *x509.Certificate) error {
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+
+	cc.mtx.RLock()
+	unchanged := finfo.ModTime().Equal(cc.modTime)
+	cc.mtx.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	// the CRL can be either PEM or DER encoded
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseCRL(data)
+	if err != nil {
+		return err
+	}
+
+	if err := ca.CheckCRLSignature(list); err != nil {
+		return err
+	}
+
+	revoked := make(map[string]bool)
+	for _, r := range list.TBSCertList.RevokedCertificates {
+		revoked[r.SerialNumber.String()] = true
+	}
+
+	// signed by the CA, so it lists the certificates issued by the CA
+	cc.mtx.Lock()
+	cc.loaded = true
+	cc.issuer = ca.RawSubject
+	cc.revoked = revoked
+	cc.modTime = finfo.ModTime()
+	cc.nextUpdate = list.TBSCertList.NextUpdate
+	cc.mtx.Unlock()
+
+	logger.Info("Loaded CRL", "file", fname, "revoked", len(revoked), "next_update", list.TBSCertList.NextUpdate)
+
+	if cc.stale() {
+		logger.Error("The CRL is past its next update, client certificates are refused", "file", fname)
+	}
+
+	// close the sessions of the certificates just revoked
+	term_conn.CheckSessions()
+	return nil
+}
+
+// periodically check whether the CRL file has changed
+func (cc *crlCache) watch(fname string, ca *x509.Certificate) {
+	for range time.Tick(options.ClientCert.CheckPeriod) {
+		if err := cc.reload(fname, ca); err != nil {
+			logger.Error("Failed to reload CRL, keep using the old one", "err", err)
+		}
+
+		if cc.stale() {
+			logger.Error("The CRL is past its next update, client certificates are refused until it is updated", "file", fname)
+			term_conn.CheckSessions()
+		}
+	}
+}
+
+// whether the CRL is past its next update
+func (cc *crlCache) stale() bool {
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+
+	return !cc.nextUpdate.IsZero() && time.Now().After(cc.nextUpdate)
+}
+
+func (cc *crlCache) isRevoked(cert *x509.Certificate) bool {
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+
+	return bytes.Equal(cert.RawIssuer, cc.issuer) && cc.revoked[cert.SerialNumber.String()]
+}
+
+// checkChains returns an error if a certificate in the chains is revoked,
+// or the CRL is too old to tell
+func checkChains(verifiedChains [][]*x509.Certificate) error {
+	crl.mtx.RLock()
+	loaded := crl.loaded
+	crl.mtx.RUnlock()
+
+	if !loaded {
+		return nil
+	}
+
+	if crl.stale() {
+		return errors.New("the CRL is past its next update")
+	}
+
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if crl.isRevoked(cert) {
+				return errors.New("client certificate " + cert.Subject.String() + " is revoked")
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRevoked is called by the TLS stack after the chain is verified
+func checkRevoked(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return checkChains(verifiedChains)
+}
+
+// certValid checks the client certificate of the request against the
+// current CRL, the connections stay open after the handshake
+func certValid(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return true
+	}
+
+	return checkChains(r.TLS.VerifiedChains) == nil
+}
+
+// CertNotRevoked refuses the requests on the connections whose client
+// certificate is revoked after the handshake, and closes them
+func CertNotRevoked(c *gin.Context) {
+	if !clientCertEnabled() || certValid(c.Request) {
+		c.Next()
+		return
+	}
+
+	logger.Warn("Refuse the request with a revoked client certificate", "user", certUser(c))
+	c.Header("Connection", "close")
+	c.String(http.StatusForbidden, "Client certificate is revoked")
+	c.Abort()
+}
+
+// clientCertConfig creates the TLS config that requires client certificates
+func clientCertConfig() (*tls.Config, error) {
+	switch options.ClientCert.UserField {
+	case "", certUserCN, certUserEmail:
+	default:
+		return nil, errors.New("unknown client certificate user field " + options.ClientCert.UserField)
+	}
+
+	pool, ca, err := loadCAPool(options.ClientCert.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+
+	if options.ClientCert.CRL != "" {
+		if err := crl.reload(options.ClientCert.CRL, ca); err != nil {
+			return nil, err
+		}
+
+		go crl.watch(options.ClientCert.CRL, ca)
+		conf.VerifyPeerCertificate = checkRevoked
+	}
+
+	return conf, nil
+}
+
+// certUser returns the user name in the verified client certificate
+func certUser(c *gin.Context) string {
+	if !clientCertEnabled() || c.Request.TLS == nil {
+		return ""
+	}
+
+	if len(c.Request.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := c.Request.TLS.VerifiedChains[0][0]
+
+	if options.ClientCert.UserField == certUserEmail {
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+
+		return ""
+	}
+
+	return cert.Subject.CommonName
+}
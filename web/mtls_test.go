@@ -0,0 +1,154 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert, key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, user string) *x509.Certificate {
+	t.Helper()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: user},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// the CRLs are reloaded by the mtime, which is coarse on some systems
+var crlWrites int
+
+// write the CRL revoking the serials in PEM, signed by the CA
+func (ca *testCA) writeCRL(t *testing.T, fname string, nextUpdate time.Time, serials ...int64) {
+	t.Helper()
+
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), nextUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fname, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	crlWrites++
+	mtime := time.Now().Add(time.Duration(crlWrites) * time.Second)
+
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRL(t *testing.T) {
+	crl = crlCache{}
+	defer func() { crl = crlCache{} }()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, "witty CA")
+	alice, bob := ca.issue(t, 1001, "alice"), ca.issue(t, 1002, "bob")
+
+	fname := filepath.Join(dir, "crl.pem")
+	ca.writeCRL(t, fname, time.Now().Add(time.Hour), 1001)
+
+	if err := crl.reload(fname, ca.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if checkChains([][]*x509.Certificate{{alice, ca.cert}}) == nil {
+		t.Error("the revoked certificate of alice is accepted")
+	}
+
+	if err := checkChains([][]*x509.Certificate{{bob, ca.cert}}); err != nil {
+		t.Errorf("bob is refused: %v", err)
+	}
+
+	// the same serial from another CA is not revoked
+	other := newTestCA(t, "other CA")
+	if err := checkChains([][]*x509.Certificate{{other.issue(t, 1001, "carol"), other.cert}}); err != nil {
+		t.Errorf("the certificate of another CA is refused: %v", err)
+	}
+
+	// a CRL not signed by the CA is not loaded
+	forged := filepath.Join(dir, "forged.pem")
+	other.writeCRL(t, forged, time.Now().Add(time.Hour), 1002)
+
+	if err := crl.reload(forged, ca.cert); err == nil {
+		t.Error("loaded a CRL of another CA")
+	}
+
+	// refuse everyone once the CRL is stale
+	stale := filepath.Join(dir, "stale.pem")
+	ca.writeCRL(t, stale, time.Now().Add(-time.Minute))
+
+	if err := crl.reload(stale, ca.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if checkChains([][]*x509.Certificate{{bob, ca.cert}}) == nil {
+		t.Error("bob is accepted with a stale CRL")
+	}
+}
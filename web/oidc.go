@@ -0,0 +1,636 @@
+package web
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// OIDCOptions configures single sign-on with an OpenID Connect provider.
+// The authorization code flow with PKCE is used, the ID token is verified
+// with the keys published by the provider.
+type OIDCOptions struct {
+	Issuer       string        `yaml:"issuer"`        // issuer URL, used for discovery
+	ClientID     string        `yaml:"client_id"`     // client ID registered with the provider
+	ClientSecret string        `yaml:"client_secret"` // client secret, can be empty for public clients
+	RedirectURL  string        `yaml:"redirect_url"`  // defaults to https://<host>/login/oidc/callback
+	UserClaim    string        `yaml:"user_claim"`    // claim used as the witty user name, email by default
+	AdminGroup   string        `yaml:"admin_group"`   // members of this group get the admin role
+	Groups       []string      `yaml:"groups"`        // if not empty, only members of these groups can login
+	Timeout      time.Duration `yaml:"timeout"`       // timeout of requests to the provider
+}
+
+const (
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcVerifierKey = "oidc_verifier"
+
+	oidcSkew    = time.Minute
+	oidcRefetch = time.Minute // the keys are fetched at most this often
+)
+
+type oidcProvider struct {
+	mtx       sync.Mutex
+	issuer    string
+	authURL   string
+	tokenURL  string
+	jwksURL   string
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	discovery time.Time
+
+	// serializes the key fetches, so that mtx is not held over the network
+	fetchMtx sync.Mutex
+}
+
+var (
+	oidc       oidcProvider
+	oidcClient = &http.Client{}
+)
+
+func oidcEnabled() bool {
+	return options.OIDC.Issuer != "" && options.OIDC.ClientID != ""
+}
+
+func oidcGetJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover the endpoints of the provider, this is done lazily so that
+// witty can start even if the provider is temporarily unavailable
+func (p *oidcProvider) discover() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if !p.discovery.IsZero() && time.Since(p.discovery) < time.Hour {
+		return nil
+	}
+
+	var conf struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JwksURL  string `json:"jwks_uri"`
+	}
+
+	issuer := strings.TrimSuffix(options.OIDC.Issuer, "/")
+	if err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &conf); err != nil {
+		return err
+	}
+
+	if strings.TrimSuffix(conf.Issuer, "/") != issuer {
+		return errors.New("issuer mismatch in discovery document " + conf.Issuer)
+	}
+
+	p.issuer = conf.Issuer
+	p.authURL = conf.AuthURL
+	p.tokenURL = conf.TokenURL
+	p.jwksURL = conf.JwksURL
+	p.discovery = time.Now()
+	p.keys = nil
+	p.fetched = time.Time{}
+
+	return nil
+}
+
+// the endpoints of the provider, discovered if needed. The callback may
+// come before any login after a restart, so it discovers them too
+type oidcEndpoints struct {
+	issuer   string
+	authURL  string
+	tokenURL string
+}
+
+func (p *oidcProvider) endpoints() (oidcEndpoints, error) {
+	if err := p.discover(); err != nil {
+		return oidcEndpoints{}, err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return oidcEndpoints{issuer: p.issuer, authURL: p.authURL, tokenURL: p.tokenURL}, nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// fetch the signing keys of the provider, only RSA and EC keys are supported
+func fetchKeys(jwksURL string) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := oidcGetJSON(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err1 := b64Int(k.N)
+			e, err2 := b64Int(k.E)
+
+			if err1 != nil || err2 != nil {
+				logger.Warn("Skip malformed RSA key", "kid", k.Kid)
+				continue
+			}
+
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+		case "EC":
+			var curve elliptic.Curve
+
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+
+			x, err1 := b64Int(k.X)
+			y, err2 := b64Int(k.Y)
+
+			if err1 != nil || err2 != nil {
+				logger.Warn("Skip malformed EC key", "kid", k.Kid)
+				continue
+			}
+
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+
+	return keys, nil
+}
+
+// the known key with the kid, nil if there is none
+func (p *oidcProvider) findKey(kid string) crypto.PublicKey {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if k, ok := p.keys[kid]; ok {
+		return k
+	}
+
+	// some providers only publish a single key without kid
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// find the key to verify the token, refetch the keys if kid is unknown
+// as the provider may have rotated its keys. The refetches are limited,
+// tokens with made up kids must not hammer the provider
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	if k := p.findKey(kid); k != nil {
+		return k, nil
+	}
+
+	p.fetchMtx.Lock()
+	defer p.fetchMtx.Unlock()
+
+	p.mtx.Lock()
+	jwksURL, fetched := p.jwksURL, p.fetched
+	p.mtx.Unlock()
+
+	// the keys may have been fetched while waiting
+	if time.Since(fetched) >= oidcRefetch {
+		keys, err := fetchKeys(jwksURL)
+
+		p.mtx.Lock()
+		p.fetched = time.Now()
+		if err == nil {
+			p.keys = keys
+		}
+		p.mtx.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if k := p.findKey(kid); k != nil {
+		return k, nil
+	}
+
+	return nil, errors.New("unknown signing key " + kid)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	var hash crypto.Hash
+
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("unsupported algorithm " + alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			break
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+
+		if ecdsa.Verify(k, digest, r, s) {
+			return nil
+		}
+
+		return errors.New("invalid ecdsa signature")
+	}
+
+	return errors.New("algorithm " + alg + " does not match the key")
+}
+
+// the subset of ID token claims that witty cares about
+type idClaims map[string]interface{}
+
+func (c idClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// both aud and groups can be a string or an array of strings
+func (c idClaims) strs(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	return nil
+}
+
+func (c idClaims) time(name string) time.Time {
+	f, _ := c[name].(float64)
+	return time.Unix(int64(f), 0)
+}
+
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verify the ID token and return its claims
+func (p *oidcProvider) verify(token string, nonce string) (idClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(buf, &header) != nil || len(header.Alg) != 5 {
+		return nil, errors.New("malformed id token header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id token signature")
+	}
+
+	ep, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims idClaims
+
+	buf, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(buf, &claims) != nil {
+		return nil, errors.New("malformed id token claims")
+	}
+
+	now := time.Now()
+	_, hasIat := claims["iat"]
+	_, hasNbf := claims["nbf"]
+
+	switch {
+	case claims.str("iss") != ep.issuer:
+		return nil, errors.New("id token issuer mismatch")
+	case !contains(claims.strs("aud"), options.OIDC.ClientID):
+		return nil, errors.New("id token audience mismatch")
+	case now.After(claims.time("exp").Add(oidcSkew)):
+		return nil, errors.New("id token expired")
+	case !hasIat || now.Add(oidcSkew).Before(claims.time("iat")):
+		return nil, errors.New("id token has no or a future issue time")
+	case hasNbf && now.Add(oidcSkew).Before(claims.time("nbf")):
+		return nil, errors.New("id token is not valid yet")
+	case claims.str("nonce") != nonce:
+		return nil, errors.New("id token nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+func oidcRedirectURL(c *gin.Context) string {
+	if options.OIDC.RedirectURL != "" {
+		return options.OIDC.RedirectURL
+	}
+
+	return "https://" + c.Request.Host + "/login/oidc/callback"
+}
+
+// start the authorization code flow by redirecting to the provider
+func oidcLogin(c *gin.Context) {
+	ep, err := oidc.endpoints()
+	if err != nil {
+		reqLog(c).Error("Failed to discover OIDC provider", "err", err)
+		leftLoginMsg(c, "Single sign-on is not available")
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+
+	state := uniuri.NewLen(32)
+	nonce := uniuri.NewLen(32)
+	verifier := uniuri.NewLen(64)
+
+	session := sessions.Default(c)
+	session.Set(oidcStateKey, state)
+	session.Set(oidcNonceKey, nonce)
+	session.Set(oidcVerifierKey, verifier)
+
+	if err := session.Save(); err != nil {
+		leftLoginMsg(c, "Failed to save session data")
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {options.OIDC.ClientID},
+		"redirect_uri":          {oidcRedirectURL(c)},
+		"scope":                 {"openid email profile groups"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(ep.authURL, "?") {
+		sep = "&"
+	}
+
+	c.Redirect(http.StatusSeeOther, ep.authURL+sep+query.Encode())
+}
+
+// exchange the code for tokens, returns the ID token
+func oidcExchange(c *gin.Context, code string, verifier string) (string, error) {
+	ep, err := oidc.endpoints()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL(c)},
+		"client_id":     {options.OIDC.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ep.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if options.OIDC.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(options.OIDC.ClientID), url.QueryEscape(options.OIDC.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("token request failed: %s %s", resp.Status, tokens.Error)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// map the claims to a witty user and role
+func oidcUser(claims idClaims) (string, string, error) {
+	userClaim := options.OIDC.UserClaim
+	if userClaim == "" {
+		userClaim = "email"
+	}
+
+	username := claims.str(userClaim)
+	if username == "" {
+		return "", "", errors.New("id token has no " + userClaim + " claim")
+	}
+
+	// a missing email_verified is not verified either
+	if userClaim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return "", "", errors.New("email " + username + " is not verified")
+		}
+	}
+
+	groups := claims.strs("groups")
+
+	if len(options.OIDC.Groups) > 0 {
+		allowed := false
+
+		for _, g := range options.OIDC.Groups {
+			if contains(groups, g) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return "", "", errors.New(username + " is not in any allowed group")
+		}
+	}
+
+	role := roleUser
+	if options.OIDC.AdminGroup != "" && contains(groups, options.OIDC.AdminGroup) {
+		role = roleAdmin
+	}
+
+	return username, role, nil
+}
+
+// the provider redirects back to here with the authorization code
+func oidcCallback(c *gin.Context) {
+	session := sessions.Default(c)
+
+	state, _ := session.Get(oidcStateKey).(string)
+	nonce, _ := session.Get(oidcNonceKey).(string)
+	verifier, _ := session.Get(oidcVerifierKey).(string)
+
+	// the state and verifier are single use
+	session.Delete(oidcStateKey)
+	session.Delete(oidcNonceKey)
+	session.Delete(oidcVerifierKey)
+
+	fail := func(msg string, err error) {
+		reqLog(c).Warn("OIDC login failed", "err", err)
+		session.Save()
+		leftLoginMsg(c, msg)
+		c.Redirect(http.StatusSeeOther, "/login")
+	}
+
+	if errMsg := c.Query("error"); errMsg != "" {
+		fail("Single sign-on was rejected", errors.New(errMsg+" "+c.Query("error_description")))
+		return
+	}
+
+	if state == "" || c.Query("state") != state {
+		fail("Single sign-on state mismatch, try again", errors.New("state mismatch"))
+		return
+	}
+
+	idToken, err := oidcExchange(c, c.Query("code"), verifier)
+	if err != nil {
+		fail("Single sign-on failed", err)
+		return
+	}
+
+	claims, err := oidc.verify(idToken, nonce)
+	if err != nil {
+		fail("Single sign-on failed", err)
+		return
+	}
+
+	username, role, err := oidcUser(claims)
+	if err != nil {
+		fail("Not authorized to use WiTTY", err)
+		return
+	}
+
+	reqLog(c).Info("OIDC login", "login", username, "role", role)
+
+	session.Set(userKey, username)
+	session.Set(nameKey, username)
+	session.Set(roleKey, role)
+
+	if err := session.Save(); err != nil {
+		leftLoginMsg(c, "Failed to save session data")
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,394 @@
+package web
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a stand-in OpenID provider, the codes are issued by authorize
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mtx     sync.Mutex
+	grants  map[string]url.Values             // the authorization requests by the code
+	claims  map[string]map[string]interface{} // the claims changed by the code
+	fetches int                               // how many times the keys are fetched
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{key: key, grants: make(map[string]url.Values), claims: make(map[string]map[string]interface{})}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/auth",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mtx.Lock()
+		p.fetches++
+		p.mtx.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", p.token)
+
+	p.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// the token endpoint checks the code verifier against the challenge
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	code := r.PostFormValue("code")
+
+	p.mtx.Lock()
+	grant, ok := p.grants[code]
+	claims := p.claims[code]
+	delete(p.grants, code)
+	p.mtx.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+	if !ok || grant.Get("code_challenge_method") != "S256" ||
+		grant.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) ||
+		grant.Get("redirect_uri") != r.PostFormValue("redirect_uri") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken("k1", grant.Get("nonce"), claims)})
+}
+
+// the ID token for the nonce, the claims are changed by changed, and
+// removed if nil there
+func (p *testProvider) fetchCount() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.fetches
+}
+
+func (p *testProvider) idToken(kid string, nonce string, changed map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		buf, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            p.URL,
+		"aud":            options.OIDC.ClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+
+	for k, v := range changed {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+
+	signed := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// the user agrees at the provider, returns the code and the state. The
+// claims of the ID token are changed by claims, see idToken
+func (p *testProvider) authorize(t *testing.T, location string, claims map[string]interface{}) (string, string) {
+	t.Helper()
+
+	u, err := url.Parse(location)
+	if err != nil || u.Host != p.Listener.Addr().String() || u.Path != "/auth" {
+		t.Fatalf("not redirected to the provider: %s", location)
+	}
+
+	grant := u.Query()
+	code := "code" + grant.Get("state")[:8]
+
+	p.mtx.Lock()
+	p.grants[code] = grant
+	p.claims[code] = claims
+	p.mtx.Unlock()
+
+	return code, grant.Get("state")
+}
+
+type testBrowser struct {
+	*http.Client
+	base string
+}
+
+func (b *testBrowser) get(t *testing.T, path string) *http.Response {
+	t.Helper()
+
+	resp, err := b.Get(b.base + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	return resp
+}
+
+// the user of the session and the login message
+func (b *testBrowser) whoami(t *testing.T) (string, string) {
+	t.Helper()
+
+	resp, err := b.Get(b.base + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	user, _ := io.ReadAll(resp.Body)
+
+	u, _ := url.Parse(b.base)
+	for _, c := range b.Jar.Cookies(u) {
+		if c.Name == "witty_"+loginKey {
+			msg, _ := url.QueryUnescape(c.Value)
+			return string(user), msg
+		}
+	}
+
+	return string(user), ""
+}
+
+func (b *testBrowser) login(t *testing.T) string {
+	t.Helper()
+
+	resp := b.get(t, "/login/oidc")
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("got %s, expect a redirect", resp.Status)
+	}
+
+	return resp.Header.Get("Location")
+}
+
+func (b *testBrowser) callback(t *testing.T, code string, state string) string {
+	t.Helper()
+
+	resp := b.get(t, "/login/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode())
+	return resp.Header.Get("Location")
+}
+
+func newOIDCTest(t *testing.T) (*testProvider, func() *testBrowser) {
+	p := newTestProvider(t)
+
+	options.OIDC = OIDCOptions{Issuer: p.URL, ClientID: "witty", RedirectURL: "https://witty.example.com/login/oidc/callback"}
+	oidc = oidcProvider{}
+	oidcClient = p.Client()
+
+	rt := newTestRouter(t)
+	rt.GET("/login/oidc", oidcLogin)
+	rt.GET("/login/oidc/callback", oidcCallback)
+	rt.GET("/whoami", func(c *gin.Context) {
+		c.String(http.StatusOK, sessionUser(c))
+	})
+
+	srv := httptest.NewTLSServer(rt)
+	t.Cleanup(srv.Close)
+
+	return p, func() *testBrowser {
+		jar, _ := cookiejar.New(nil)
+		client := srv.Client()
+		client.Jar = jar
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		return &testBrowser{client, srv.URL}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p, browser := newOIDCTest(t)
+	b := browser()
+
+	code, state := p.authorize(t, b.login(t), nil)
+
+	if loc := b.callback(t, code, state); loc != "/" {
+		t.Fatalf("redirected to %s, expect the login to succeed", loc)
+	}
+
+	if user, _ := b.whoami(t); user != "alice@example.com" {
+		t.Fatalf("got user %q", user)
+	}
+}
+
+func TestOIDCState(t *testing.T) {
+	p, browser := newOIDCTest(t)
+	b := browser()
+
+	code, state := p.authorize(t, b.login(t), nil)
+
+	if loc := b.callback(t, code, "forged"); loc != "/login" {
+		t.Fatalf("redirected to %s, expect the login to fail", loc)
+	}
+
+	if user, msg := b.whoami(t); user != "" || msg != "Single sign-on state mismatch, try again" {
+		t.Fatalf("got user %q, message %q", user, msg)
+	}
+
+	// the state is single use, even after a failure
+	if loc := b.callback(t, code, state); loc != "/login" {
+		t.Fatalf("redirected to %s, expect the state to be used up", loc)
+	}
+
+	// no login started in this browser
+	other := browser()
+	if loc := other.callback(t, code, state); loc != "/login" {
+		t.Fatalf("redirected to %s, expect the login to fail", loc)
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	p, browser := newOIDCTest(t)
+	victim, attacker := browser(), browser()
+
+	// the code of the victim is injected into the login of the attacker,
+	// the verifier of the attacker does not match the challenge
+	code, _ := p.authorize(t, victim.login(t), nil)
+	_, state := p.authorize(t, attacker.login(t), nil)
+
+	if loc := attacker.callback(t, code, state); loc != "/login" {
+		t.Fatalf("redirected to %s, expect the login to fail", loc)
+	}
+
+	if user, msg := attacker.whoami(t); user != "" || msg != "Single sign-on failed" {
+		t.Fatalf("got user %q, message %q", user, msg)
+	}
+}
+
+func TestOIDCNonce(t *testing.T) {
+	p, browser := newOIDCTest(t)
+	b := browser()
+
+	// the ID token was issued for another login
+	code, state := p.authorize(t, b.login(t), map[string]interface{}{"nonce": "replayed"})
+
+	if loc := b.callback(t, code, state); loc != "/login" {
+		t.Fatalf("redirected to %s, expect the login to fail", loc)
+	}
+
+	if user, _ := b.whoami(t); user != "" {
+		t.Fatalf("got user %q", user)
+	}
+}
+
+func TestOIDCClaims(t *testing.T) {
+	p, browser := newOIDCTest(t)
+	later := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{"not valid yet", map[string]interface{}{"nbf": later}},
+		{"issued later", map[string]interface{}{"iat": later}},
+		{"no issue time", map[string]interface{}{"iat": nil}},
+		{"other audience", map[string]interface{}{"aud": "other"}},
+		{"email not verified", map[string]interface{}{"email_verified": false}},
+		{"email_verified missing", map[string]interface{}{"email_verified": nil}},
+	}
+
+	for _, tt := range tests {
+		b := browser()
+		code, state := p.authorize(t, b.login(t), tt.claims)
+
+		if loc := b.callback(t, code, state); loc != "/login" {
+			t.Errorf("%s: redirected to %s, expect the login to fail", tt.name, loc)
+		}
+	}
+
+	// within the skew
+	b := browser()
+	code, state := p.authorize(t, b.login(t), map[string]interface{}{"nbf": time.Now().Add(30 * time.Second).Unix()})
+
+	if loc := b.callback(t, code, state); loc != "/" {
+		t.Errorf("redirected to %s, expect the login to succeed", loc)
+	}
+}
+
+// tokens with unknown kids refetch the keys at most once per oidcRefetch
+func TestOIDCKeyRefetch(t *testing.T) {
+	p, _ := newOIDCTest(t)
+
+	if _, err := oidc.verify(p.idToken("k1", "n", nil), "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := oidc.verify(p.idToken("x"+strconv.Itoa(i), "n", nil), "n"); err == nil {
+			t.Fatal("expect an error for an unknown key")
+		}
+	}
+
+	// the known key still works
+	if _, err := oidc.verify(p.idToken("k1", "n", nil), "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := p.fetchCount(); n != 1 {
+		t.Errorf("the keys were fetched %d times, expect once", n)
+	}
+
+	// the provider rotated its keys a while ago
+	oidc.mtx.Lock()
+	oidc.fetched = time.Now().Add(-oidcRefetch)
+	oidc.keys = nil
+	oidc.mtx.Unlock()
+
+	if _, err := oidc.verify(p.idToken("k1", "n", nil), "n"); err != nil || p.fetchCount() != 2 {
+		t.Errorf("got %v and %d fetches, expect the keys fetched again", err, p.fetchCount())
+	}
+}
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// Each recording is owned by the user who recorded it. Private recordings
+// are seen by the owner and the administrators, team recordings also by
+// the users in a team with the owner, and public ones by every user and by
+// anyone with the public link. Only the owner and the administrators can
+// rename, delete or change them. The recordings without an owner, e.g.,
+// the legacy ones, belong to the administrators. The mandatory recordings
+// are only deleted or renamed by the administrators.
+
+// the user asking for the recordings, and whether it is an administrator
+func recordUser(c *gin.Context) (string, bool) {
+	if options.NoAuth {
+		return "", true
+	}
+
+	// API tokens have no session, check the role of the token user
+	if v, ok := c.Get(apiUserKey); ok {
+		user := v.(string)
+
+		if _, token := c.Get(apiTokenKey); token {
+			return user, localRole(user) == roleAdmin
+		}
+
+		if role, ok := c.Get(apiRoleKey); ok {
+			return user, role == roleAdmin
+		}
+
+		return user, isAdmin(c)
+	}
+
+	return sessionUser(c), isAdmin(c)
+}
+
+// the visibility of the recording, the default if not set
+func recordVisibility(meta *cmd.RecordMeta) string {
+	if meta.Visibility != "" {
+		return meta.Visibility
+	}
+
+	if options.Recording.Visibility != "" {
+		return options.Recording.Visibility
+	}
+
+	return cmd.VisibilityPrivate
+}
+
+// whether the two users are in the same team
+func sameTeam(a string, b string) bool {
+	for _, members := range options.Recording.Teams {
+		if contains(members, a) && contains(members, b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func canModifyRecord(c *gin.Context, meta *cmd.RecordMeta) bool {
+	user, admin := recordUser(c)
+	return admin || (user != "" && user == meta.Owner)
+}
+
+func canViewRecord(c *gin.Context, meta *cmd.RecordMeta) bool {
+	if canModifyRecord(c, meta) {
+		return true
+	}
+
+	user, _ := recordUser(c)
+
+	switch recordVisibility(meta) {
+	case cmd.VisibilityPublic:
+		return true
+	case cmd.VisibilityTeam:
+		return meta.Owner != "" && sameTeam(user, meta.Owner)
+	}
+
+	return false
+}
+
+// recordStatus maps the errors of the record store to the status and the
+// message for the client, the other errors are logged
+func recordStatus(c *gin.Context, fname string, err error) (int, string) {
+	switch {
+	case errors.Is(err, cmd.ErrRecordName):
+		return http.StatusBadRequest, "invalid recording name"
+	case errors.Is(err, cmd.ErrNotRecord):
+		reqLog(c).Warn("Refuse to access a special file", "record", fname)
+		return http.StatusForbidden, "not a regular recording file"
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, "recording not found"
+	case errors.Is(err, os.ErrExist):
+		return http.StatusConflict, "recording already exists"
+	}
+
+	reqLog(c).Error("Failed to access the recording", "record", fname, "err", err)
+	return http.StatusInternalServerError, "failed to access the recording"
+}
+
+// recordError sends the error of the record store as JSON
+func recordError(c *gin.Context, fname string, err error) {
+	code, msg := recordStatus(c, fname, err)
+	apiError(c, code, msg)
+}
+
+// recordAccess checks that the user can view, or modify if set, the
+// recording. Otherwise it returns the status and the message of the error,
+// the recordings the user cannot see are not found
+func recordAccess(c *gin.Context, fname string, modify bool) (*cmd.RecordMeta, int, string) {
+	meta, err := recStore.Lookup(fname)
+	if err != nil {
+		code, msg := recordStatus(c, fname, err)
+		return nil, code, msg
+	}
+
+	if !canViewRecord(c, meta) {
+		reqLog(c).Warn("Refuse to show the recording", "record", fname, "owner", meta.Owner)
+		return nil, http.StatusNotFound, "recording not found"
+	}
+
+	if modify && !canModifyRecord(c, meta) {
+		reqLog(c).Warn("Refuse to change the recording", "record", fname, "owner", meta.Owner)
+		return nil, http.StatusForbidden, "only the owner can change the recording"
+	}
+
+	return meta, http.StatusOK, ""
+}
+
+// whether the recording is still being written by a session, replaced by
+// the tests
+var liveRecord = term_conn.Recording
+
+// recordRemovable checks that the recording can be deleted or renamed by
+// the user, after recordAccess. The mandatory recordings are kept for the
+// administrators, and no recording is removed while it is written
+func recordRemovable(c *gin.Context, meta *cmd.RecordMeta) (int, string) {
+	if liveRecord(meta.Fname) {
+		return http.StatusConflict, "the recording is still being recorded"
+	}
+
+	if _, admin := recordUser(c); meta.Mandatory && !admin {
+		reqLog(c).Warn("Refuse to remove the mandatory recording", "record", meta.Fname)
+		return http.StatusForbidden, "only administrators can delete or rename mandatory recordings"
+	}
+
+	return http.StatusOK, ""
+}
+
+// the recording of the public link, nil if the link is invalid
+func linkedRecord(c *gin.Context) *cmd.RecordMeta {
+	meta := recStore.FindLink(c.Param("link"))
+
+	if meta == nil || recordVisibility(meta) != cmd.VisibilityPublic {
+		c.String(http.StatusNotFound, "Recording not found")
+		return nil
+	}
+
+	return meta
+}
+
+// replay the recording of the public link, no login is needed
+func sharedReplayPage(c *gin.Context) {
+	if meta := linkedRecord(c); meta != nil {
+		reqLog(c).Debug("Replay by public link", "record", meta.Fname)
+		c.HTML(http.StatusOK, "replay.html", gin.H{
+			"fname":    meta.Fname,
+			"path":     "/shared/" + c.Param("link") + "/record",
+			"max_wait": options.Wait,
+		})
+	}
+}
+
+func sharedRec(c *gin.Context) {
+	if meta := linkedRecord(c); meta != nil {
+		sendRecord(c, meta.Fname, false)
+	}
+}
@@ -0,0 +1,162 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/term_conn"
+)
+
+// a recording of alice in the temporary record store
+func writeRecord(t *testing.T, dir string, name string, mandatory bool) {
+	t.Helper()
+
+	fp, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fp.Close()
+
+	hdr := term_conn.NewRecordHeader("session", "alice", []string{"bash"})
+	hdr.Mandatory = mandatory
+
+	if err := term_conn.WriteRecording(fp, hdr, []term_conn.WriteRecord{{Data: []byte("hello")}}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the router with the user and the role given in the headers
+func recordRouter(t *testing.T) *gin.Engine {
+	rt := newTestRouter(t)
+	rt.Use(func(c *gin.Context) {
+		c.Set(apiUserKey, c.GetHeader("X-User"))
+		c.Set(apiRoleKey, c.GetHeader("X-Role"))
+	})
+
+	rt.POST("/delete/:fname", delRec)
+	rt.POST("/rename/:oldname/:newname", renameRec)
+	rt.DELETE("/api/records/:fname", apiDeleteRecord)
+
+	return rt
+}
+
+func recordRequest(rt *gin.Engine, method string, path string, user string, role string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("X-User", user)
+	req.Header.Set("X-Role", role)
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRemoveMandatory(t *testing.T) {
+	dir := t.TempDir()
+	recStore = cmd.NewRecordStore(dir)
+	rt := recordRouter(t)
+
+	for _, name := range []string{"a.scr", "b.scr", "c.scr"} {
+		writeRecord(t, dir, name, true)
+		ownRecord(name, "alice")
+	}
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/delete/a.scr"},
+		{http.MethodPost, "/rename/b.scr/d"},
+		{http.MethodDelete, "/api/records/c.scr"},
+	}
+
+	// the owner keeps the mandatory recordings
+	for _, r := range requests {
+		if code := recordRequest(rt, r.method, r.path, "alice", roleUser); code != http.StatusForbidden {
+			t.Errorf("%s by the owner: got %d, expect %d", r.path, code, http.StatusForbidden)
+		}
+	}
+
+	for _, name := range []string{"a.scr", "b.scr", "c.scr"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	for _, r := range requests {
+		if code := recordRequest(rt, r.method, r.path, "root1", roleAdmin); code != http.StatusOK && code != http.StatusNoContent {
+			t.Errorf("%s by the admin: got %d", r.path, code)
+		}
+	}
+
+	names, _ := recStore.Names()
+	if len(names) != 1 || names[0] != "d.scr" {
+		t.Errorf("got the recordings %v, expect d.scr", names)
+	}
+}
+
+func TestRemoveLive(t *testing.T) {
+	dir := t.TempDir()
+	recStore = cmd.NewRecordStore(dir)
+	rt := recordRouter(t)
+
+	writeRecord(t, dir, "live.scr", false)
+
+	defer func() { liveRecord = term_conn.Recording }()
+	liveRecord = func(fname string) bool { return fname == "live.scr" }
+
+	paths := []string{"/delete/live.scr", "/rename/live.scr/other"}
+
+	for _, path := range paths {
+		if code := recordRequest(rt, http.MethodPost, path, "root1", roleAdmin); code != http.StatusConflict {
+			t.Errorf("%s: got %d, expect %d", path, code, http.StatusConflict)
+		}
+	}
+
+	if code := recordRequest(rt, http.MethodDelete, "/api/records/live.scr", "root1", roleAdmin); code != http.StatusConflict {
+		t.Errorf("api: got %d, expect %d", code, http.StatusConflict)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "live.scr")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordOwner(t *testing.T) {
+	dir := t.TempDir()
+	recStore = cmd.NewRecordStore(dir)
+	rt := recordRouter(t)
+
+	// anyone can write the user in the header, e.g., by an import
+	writeRecord(t, dir, "a.scr", false)
+
+	if code := recordRequest(rt, http.MethodPost, "/delete/a.scr", "alice", roleUser); code != http.StatusNotFound {
+		t.Errorf("got %d, expect only the administrators to see it", code)
+	}
+
+	// the session of alice recorded it
+	ownRecord(filepath.Join(dir, "a.scr"), "alice")
+
+	if code := recordRequest(rt, http.MethodPost, "/delete/a.scr", "alice", roleUser); code != http.StatusOK {
+		t.Errorf("got %d, expect the owner to delete it", code)
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	tests := map[string]string{
+		"a.scr":      `attachment; filename=a.scr`,
+		`a"b.scr`:    `attachment; filename="a\"b.scr"`,
+		"a; x=y.scr": `attachment; filename="a; x=y.scr"`,
+	}
+
+	for name, expect := range tests {
+		if got := attachment(name); got != expect {
+			t.Errorf("%q: got %s, expect %s", name, got, expect)
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package web
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
+	"bytes"
+	"mime"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/cmd"
 	"github.com/syssecfsu/witty/term_conn"
 )
 
@@ -18,68 +20,133 @@ type RecordedSession struct {
 	Fsize    string
 	Duration string
 	Time     string
+	Title    string
+	User     string
+	Command  string
+	Start    time.Time
+	End      time.Time
+	Tags     []string
+
+	Owner      string
+	Visibility string
+	Link       string // the public link, only for the owner
+	CanModify  bool   // the user can rename and delete it
+}
+
+// the page of the recordings, see collectRecords
+type recordPage struct {
+	Sort  string
+	Order string
+	Page  int
+	Pages int
+	Total int
 }
 
-// how many seconds of the session
-func getDuration(fname string) int64 {
-	fp, err := os.Open("./records/" + fname)
+const recordsPerPage = 24
+
+// every access to the recordings goes through the store, see cmd/recstore.go
+var recStore *cmd.RecordStore
 
+// collectRecords lists the recordings from the index, sorted by the sort
+// and order query, and paged by the page query if perPage is not 0
+func collectRecords(c *gin.Context, perPage int) ([]RecordedSession, recordPage) {
+	page := recordPage{Sort: c.DefaultQuery("sort", cmd.SortTime), Order: c.DefaultQuery("order", "desc"), Page: 1, Pages: 1}
+
+	metas, err := recStore.List()
 	if err != nil {
-		log.Println("Failed to open record file", err)
-		return 0
+		reqLog(c).Error("Failed to list the recordings", "err", err)
 	}
 
-	decoder := json.NewDecoder(fp)
+	// only the recordings the user can see
+	visible := metas[:0]
 
-	if decoder == nil {
-		log.Println("Failed to create JSON decoder")
-		return 0
+	for i := range metas {
+		if canViewRecord(c, &metas[i]) {
+			visible = append(visible, metas[i])
+		}
 	}
 
-	// To work with javascript decoder, we organize the file as
-	// an array of writeRecord. golang decode instead decode
-	// as individual record. Call decoder.Token to skip opening [
-	decoder.Token()
+	metas = visible
+	cmd.SortRecords(metas, page.Sort, page.Order != "asc")
+	page.Total = len(metas)
+
+	if perPage > 0 && len(metas) > 0 {
+		page.Pages = (len(metas) + perPage - 1) / perPage
 
-	var dur int64 = 0
+		if n, err := strconv.Atoi(c.Query("page")); err == nil && n > 1 {
+			page.Page = n
+		}
+
+		if page.Page > page.Pages {
+			page.Page = page.Pages
+		}
 
-	for decoder.More() {
-		var record term_conn.WriteRecord
+		from := (page.Page - 1) * perPage
+		to := from + perPage
 
-		if err := decoder.Decode(&record); err != nil {
-			log.Println("Failed to decode record", err)
-			continue
+		if to > len(metas) {
+			to = len(metas)
 		}
 
-		dur += record.Dur.Milliseconds()
+		metas = metas[from:to]
 	}
 
-	return dur/1000 + 1
-}
+	var records []RecordedSession
 
-func collectRecords(c *gin.Context) (records []RecordedSession) {
-	files, err := ioutil.ReadDir("./records/")
+	for i := range metas {
+		m := &metas[i]
+		rec := RecordedSession{
+			Fname:    m.Fname,
+			Fsize:    strconv.FormatInt(m.Size/1024, 10),
+			Duration: strconv.FormatInt(m.Duration.Milliseconds()/1000+1, 10),
+			Time:     m.ModTime.Format("Jan/2/2006, 15:04:05"),
+			Title:    m.Title,
+			User:     m.User,
+			Command:  strings.Join(m.Command, " "),
+			Start:    m.Start,
+			End:      m.End,
+			Tags:     m.Tags,
 
-	if err == nil {
-		for _, finfo := range files {
-			fname := finfo.Name()
-			if !strings.HasSuffix(fname, ".scr") {
-				continue
-			}
-			fsize := finfo.Size() / 1024
-			duration := getDuration(fname)
+			Owner:      m.Owner,
+			Visibility: recordVisibility(m),
+			CanModify:  canModifyRecord(c, m),
+		}
 
-			records = append(records,
-				RecordedSession{
-					Fname:    fname,
-					Fsize:    strconv.FormatInt(fsize, 10),
-					Duration: strconv.FormatInt(duration, 10),
-					Time:     finfo.ModTime().Format("Jan/2/2006, 15:04:05"),
-				})
+		if rec.CanModify && rec.Visibility == cmd.VisibilityPublic && m.Link != "" {
+			rec.Link = "/shared/" + m.Link
 		}
+
+		records = append(records, rec)
+	}
+
+	return records, page
+}
+
+// RecordingPolicy makes recording mandatory, e.g., for compliance. It
+// applies to every session, or to the sessions of the users and roles.
+// It also sets who can see the recordings, see recaccess.go
+type RecordingPolicy struct {
+	Mandatory bool     `yaml:"mandatory"` // record every session
+	Users     []string `yaml:"users"`     // record the sessions of these users
+	Roles     []string `yaml:"roles"`     // and of these roles, admin or user
+	Banner    string   `yaml:"banner"`    // shown in the terminal of recorded sessions
+
+	Visibility string              `yaml:"visibility"` // of the recordings by default, private, team or public
+	Teams      map[string][]string `yaml:"teams"`      // the members of the teams
+}
+
+const defaultBanner = "This session is recorded"
+
+// whether the sessions of the user must be recorded
+func mustRecord(c *gin.Context) bool {
+	policy := &options.Recording
+
+	if policy.Mandatory {
+		return true
 	}
 
-	return
+	role, _ := sessions.Default(c).Get(roleKey).(string)
+	return contains(policy.Users, sessionUser(c)) || contains(policy.Roles, role)
 }
 
 func startRecord(c *gin.Context) {
@@ -87,41 +154,219 @@ func startRecord(c *gin.Context) {
 	term_conn.StartRecord(id)
 }
 
+// mandatory recordings can only be stopped by administrators
 func stopRecord(c *gin.Context) {
 	id := c.Param("id")
+
+	if term_conn.RecordingMandatory(id) && !isAdmin(c) {
+		reqLog(c).Warn("Refuse to stop the mandatory recording", "session", id)
+		c.String(http.StatusForbidden, "This session must be recorded")
+		return
+	}
+
 	term_conn.StopRecord(id)
 }
 
 func replayPage(c *gin.Context) {
 	id := c.Param("id")
-	log.Println("replay/ called with", id)
+
+	if _, code, msg := recordAccess(c, id, false); code != http.StatusOK {
+		c.String(code, msg)
+		return
+	}
+
+	reqLog(c).Debug("Replay", "record", id)
 	c.HTML(http.StatusOK, "replay.html", gin.H{
 		"fname":    id,
+		"path":     "/records/" + id,
 		"max_wait": options.Wait,
 	})
 }
 
 func delRec(c *gin.Context) {
 	fname := c.Param("fname")
-	if err := os.Remove("./records/" + fname); err != nil {
-		log.Println("Failed to delete file,", err)
+
+	meta, code, msg := recordAccess(c, fname, true)
+	if code == http.StatusOK {
+		code, msg = recordRemovable(c, meta)
+	}
+
+	if code != http.StatusOK {
+		apiError(c, code, msg)
+		return
+	}
+
+	if err := recStore.Remove(fname); err != nil {
+		recordError(c, fname, err)
 	}
 }
 
 func renameRec(c *gin.Context) {
-	oldName := "./records/" + c.Param("oldname")
-	newName := "./records/" + c.Param("newname")
+	oldName := c.Param("oldname")
+	newName := c.Param("newname")
+
+	meta, code, msg := recordAccess(c, oldName, true)
+	if code == http.StatusOK {
+		code, msg = recordRemovable(c, meta)
+	}
+
+	if code != http.StatusOK {
+		apiError(c, code, msg)
+		return
+	}
+
+	if !strings.HasSuffix(newName, cmd.RecordExt) {
+		newName += cmd.RecordExt
+	}
+
+	if err := recStore.Rename(oldName, newName); err != nil {
+		recordError(c, newName, err)
+	}
+}
 
-	if !strings.HasSuffix(newName, ".scr") {
-		newName += ".scr"
+// set the title, the comma separated tags and the visibility of the
+// recording. A public recording gets a link to replay without login
+func tagRec(c *gin.Context) {
+	fname := c.Param("fname")
+
+	if _, code, msg := recordAccess(c, fname, true); code != http.StatusOK {
+		apiError(c, code, msg)
+		return
 	}
 
-	if _, err := os.Stat(newName); err == nil {
-		log.Println(newName, "already exist, ignore the request")
+	visibility := c.PostForm("visibility")
+	if visibility != "" && !cmd.ValidVisibility(visibility) {
+		apiError(c, http.StatusBadRequest, "invalid visibility")
 		return
 	}
 
-	if err := os.Rename(oldName, newName); err != nil {
-		log.Println("Failed to rename file,", err)
+	var tags []string
+
+	for _, tag := range strings.Split(c.PostForm("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
+
+	err := recStore.UpdateMeta(fname, func(meta *cmd.RecordMeta) bool {
+		meta.Title = strings.TrimSpace(c.PostForm("title"))
+		meta.Tags = tags
+
+		if visibility != "" {
+			meta.Visibility = visibility
+		}
+
+		// a new link every time the recording is made public
+		if recordVisibility(meta) != cmd.VisibilityPublic {
+			meta.Link = ""
+		} else if meta.Link == "" {
+			meta.Link = cmd.NewRecordLink()
+		}
+
+		return true
+	})
+
+	if err != nil {
+		recordError(c, fname, err)
+	}
+}
+
+// ownRecord makes the user of the session the owner of its recording
+func ownRecord(fname string, user string) {
+	err := recStore.UpdateMeta(filepath.Base(fname), func(meta *cmd.RecordMeta) bool {
+		meta.Owner = user
+		return true
+	})
+
+	if err != nil {
+		logger.Error("Failed to update the record index", "file", fname, "err", err)
+	}
+}
+
+// indexRecord adds the closed recording to the index
+func indexRecord(fname string) {
+	if err := recStore.Index(filepath.Base(fname)); err != nil {
+		logger.Error("Failed to update the record index", "file", fname, "err", err)
+	}
+}
+
+// the Content-Disposition of the file, the name is quoted and escaped
+// as needed, e.g., if it has quotes
+func attachment(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// send the recording decrypted and decompressed, as an attachment if
+// download is set
+func sendRecord(c *gin.Context, fname string, download bool) {
+	fp, err := recStore.Open(fname)
+	if err != nil {
+		recordError(c, fname, err)
+		return
+	}
+
+	defer fp.Close()
+
+	zr, err := term_conn.OpenRecording(fp)
+	if err != nil {
+		reqLog(c).Error("Failed to decrypt or decompress record file", "record", fname, "err", err)
+		apiError(c, http.StatusInternalServerError, "failed to read the recording")
+		return
+	}
+
+	defer zr.Close()
+
+	var headers map[string]string
+	if download {
+		headers = map[string]string{"Content-Disposition": attachment(fname)}
+	}
+
+	c.DataFromReader(http.StatusOK, -1, "text/plain; charset=utf-8", zr, headers)
+}
+
+// the recording for the replay page
+func getRec(c *gin.Context) {
+	fname := c.Param("fname")
+
+	if _, code, msg := recordAccess(c, fname, false); code != http.StatusOK {
+		apiError(c, code, msg)
+		return
+	}
+
+	sendRecord(c, fname, false)
+}
+
+// download the recording converted to asciicast v2 for asciinema
+func exportRec(c *gin.Context) {
+	fname := c.Param("fname")
+
+	if _, code, msg := recordAccess(c, fname, false); code != http.StatusOK {
+		apiError(c, code, msg)
+		return
+	}
+
+	sendCast(c, fname)
+}
+
+// write the recording as an asciicast attachment
+func sendCast(c *gin.Context, fname string) {
+	fp, err := recStore.Open(fname)
+	if err != nil {
+		recordError(c, fname, err)
+		return
+	}
+
+	defer fp.Close()
+
+	var buf bytes.Buffer
+
+	if err := cmd.ExportRecord(&buf, fp, cmd.FormatAsciicast); err != nil {
+		reqLog(c).Error("Failed to export record file", "record", fname, "err", err)
+		apiError(c, http.StatusInternalServerError, "failed to export the recording")
+		return
+	}
+
+	castName := strings.TrimSuffix(fname, cmd.RecordExt) + ".cast"
+	c.Header("Content-Disposition", attachment(castName))
+	c.Data(http.StatusOK, "application/x-asciicast", buf.Bytes())
 }
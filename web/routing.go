@@ -4,58 +4,198 @@ import (
 	"html/template"
 	"io/fs"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dchest/uniuri"
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/csrf"
 	adapter "github.com/gwatts/gin-adapter"
+	"github.com/syssecfsu/witty/cmd"
+	"github.com/syssecfsu/witty/logging"
 	"github.com/syssecfsu/witty/term_conn"
 )
 
+// Options of the web server, the yaml tags are the keys in the config file
 type Options struct {
-	Wait      uint
-	Port      uint
-	NoAuth    bool
-	CmdToExec []string
-	Assets    fs.FS
-	LogFile   *os.File
+	Wait      uint              `yaml:"wait"`
+	Port      uint              `yaml:"port"`
+	NoAuth    bool              `yaml:"naked"`
+	CmdToExec []string          `yaml:"command"`
+	Assets    fs.FS             `yaml:"-"`
+	Logger    *logging.Logger   `yaml:"-"`
+	Auth      cmd.Authenticator `yaml:"-"`
+	OIDC      OIDCOptions       `yaml:"oidc"`
+
+	// reverse proxy authentication, the proxy puts the user name in
+	// ProxyHeader. It is only accepted from the TrustedProxies
+	ProxyHeader    string   `yaml:"proxy_header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	ProxyAdmins    []string `yaml:"proxy_admins"` // the users from the proxy who are administrators
+
+	ClientCert ClientCertOptions `yaml:"client_cert"`
+
+	// password policy for password changes in the web UI
+	Policy cmd.PasswordPolicy `yaml:"password_policy"`
+
+	// sessions that must be recorded
+	Recording RecordingPolicy `yaml:"recording"`
+
+	// how to accept connections: tls, http (loopback only), or unix
+	Listen     string `yaml:"listen"`
+	Socket     string `yaml:"socket"`      // path of the Unix socket
+	SocketMode string `yaml:"socket_mode"` // permissions of the socket in octal
+
+	// addresses to listen on, e.g., 127.0.0.1 or [::1]:9090, all interfaces
+	// by default. Only clients in AllowedIPs (CIDRs or IPs) are served
+	Bind       []string `yaml:"bind"`
+	AllowedIPs []string `yaml:"allowed_ips"`
+
+	// origins allowed to open the websockets, e.g., https://witty.example.com,
+	// by default the origin must match the host
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// files of the server, relative to the working directory
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// how often to check the certificate for changes, it is also reloaded on SIGHUP
+	CertCheckPeriod time.Duration `yaml:"cert_check_period"`
+	RecordDir       string        `yaml:"record_dir"`
+	SessionFile     string        `yaml:"session_file"`
+
+	// how long logins last, and sessions without login (e.g., login messages)
+	SessionMaxAge time.Duration `yaml:"session_max_age"`
+	AnonMaxAge    time.Duration `yaml:"anon_max_age"`
+
+	// settings of the terminal connections
+	Term term_conn.Options `yaml:"term"`
+}
+
+// DefaultOptions returns the options witty has always used
+func DefaultOptions() Options {
+	return Options{
+		Wait:            1000,
+		Port:            8080,
+		CmdToExec:       []string{"bash"},
+		OIDC:            OIDCOptions{UserClaim: "email", Timeout: 10 * time.Second},
+		ClientCert:      ClientCertOptions{UserField: certUserCN, CheckPeriod: 30 * time.Second},
+		Policy:          cmd.DefaultPolicy,
+		Recording:       RecordingPolicy{Banner: defaultBanner},
+		Listen:          ListenTLS,
+		Socket:          "./witty.sock",
+		SocketMode:      "0660",
+		TLSCert:         "./tls/cert.pem",
+		TLSKey:          "./tls/private-key.pem",
+		CertCheckPeriod: time.Minute,
+		RecordDir:       term_conn.DefaultOptions.RecordDir,
+		SessionFile:     "./sessions.db",
+		SessionMaxAge:   7 * 24 * time.Hour,
+		AnonMaxAge:      time.Hour,
+		Term:            term_conn.DefaultOptions,
+	}
 }
 
-var options Options
+var (
+	options   Options
+	sessStore *serverStore
+)
 
 func StartWeb(opt *Options) {
 	options = *opt
 
-	if options.LogFile != nil {
-		gin.DefaultWriter = options.LogFile
+	if options.Logger != nil {
+		logger = options.Logger
 	}
 
-	rt := gin.Default()
+	// requests are logged by accessLog, gin only prints debug messages
+	gin.DefaultWriter = logger.Writer(logging.LevelDebug)
+	gin.DefaultErrorWriter = logger.Writer(logging.LevelError)
 
-	// We randomly generate a key for now, should use a fixed key
-	// so login can survive server reboot
-	store := sessions.NewCookieStore([]byte(uniuri.NewLen(32)))
-	rt.Use(sessions.Sessions("witty-session", store))
+	oidcClient.Timeout = options.OIDC.Timeout
+
+	if options.Auth == nil {
+		options.Auth, _ = cmd.NewAuthenticator(&cmd.AuthConfig{})
+	}
+
+	rt := gin.New()
+	rt.Use(accessLog, gin.Recovery())
+
+	// reject the clients outside of the allowed networks before anything else
+	nets, err := term_conn.ParseNets(options.AllowedIPs)
+	if err != nil {
+		fatal("Invalid allowed IPs", err)
+	}
+
+	allowedNets = nets
+	rt.Use(IPAllowed)
+	rt.Use(CertNotRevoked)
+
+	// session data is kept on the server, the cookie only has the ID
+	sessStore = newServerStore(options.SessionFile)
+	rt.Use(sessions.Sessions(sessionCookie, sessStore))
 
 	csrfHttp := csrf.Protect([]byte(uniuri.NewLen(32)), csrf.Path("/"))
 	csrfGin := adapter.Wrap(csrfHttp)
-	rt.Use(csrfGin)
 
-	rt.SetTrustedProxies(nil)
+	// the API has its own CSRF check that skips the token requests, see
+	// setupAPI, the bearer tokens never relax the check of the web UI
+	rt.Use(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, apiPrefix+"/") {
+			c.Next()
+			return
+		}
+
+		csrfGin(c)
+	})
+
+	if err := term_conn.SetTrustedProxies(options.TrustedProxies); err != nil {
+		fatal("Invalid trusted proxies", err)
+	}
+
+	// only the proxy can connect to the Unix socket
+	if options.ProxyHeader != "" && len(options.TrustedProxies) == 0 && options.Listen != ListenUnix {
+		fatal("Proxy authentication requires trusted proxies", nil)
+	}
+
+	if err := term_conn.SetAllowedOrigins(options.AllowedOrigins); err != nil {
+		fatal("Invalid allowed origins", err)
+	}
+
+	if len(options.TrustedProxies) > 0 {
+		rt.SetTrustedProxies(options.TrustedProxies)
+	} else {
+		rt.SetTrustedProxies(nil)
+	}
 
 	templ := template.Must(template.New("assets").ParseFS(options.Assets, "template/*.html"))
 	rt.SetHTMLTemplate(templ)
 
 	// handle static files
 	rt.StaticFS("/assets", http.FS(options.Assets))
-	rt.Static("/records", "./records")
 
 	rt.GET("/login", loginPage)
 	rt.POST("/login", login)
 
+	if oidcEnabled() {
+		rt.GET("/login/oidc", oidcLogin)
+		rt.GET("/login/oidc/callback", oidcCallback)
+	}
+
+	// viewers with a share link do not need an account
+	rt.GET("/view/:id", ViewAuth, viewPage)
+	rt.GET("/ws_view/:id", ViewAuth, newViewWS)
+	rt.POST("/share_unlock", unlockShare)
+
+	// public recordings can be replayed by their links without login
+	rt.GET("/shared/:link", sharedReplayPage)
+	rt.GET("/shared/:link/record", sharedRec)
+
+	// JSON API for scripts, authenticated by tokens or the cookie
+	setupAPI(rt, csrfGin)
+
 	g1 := rt.Group("/")
 
 	if !options.NoAuth {
@@ -66,6 +206,18 @@ func StartWeb(opt *Options) {
 	g1.GET("/", indexPage)
 	g1.GET("/logout", logout)
 
+	// change the password of the current user
+	g1.GET("/account", accountPage)
+	g1.POST("/account", changePasswd)
+
+	// administrators manage other users
+	admin := g1.Group("/admin")
+	admin.Use(AdminRequired)
+	admin.GET("", adminPage)
+	admin.POST("/reset/:user", resetPasswd)
+	admin.POST("/revoke/:id", revokeLogin)
+	admin.POST("/revoke_user/:user", revokeUserLogins)
+
 	// to update the tabs of current interactive and saved sessions
 	g1.GET("/update/:active", updateIndex)
 
@@ -73,9 +225,9 @@ func StartWeb(opt *Options) {
 	g1.POST("/new", newInteractive)
 	g1.GET("/ws_new/:id", newTermConn)
 
-	// create a viewer of an interactive session
-	g1.GET("/view/:id", viewPage)
-	g1.GET("/ws_view/:id", newViewWS)
+	// share a live session with people without an account
+	g1.POST("/share/:id", createShare)
+	g1.POST("/share/:id/revoke", revokeShares)
 
 	// start/stop recording the session
 	g1.POST("/record/:id", startRecord)
@@ -84,12 +236,50 @@ func StartWeb(opt *Options) {
 	// create a viewer of an interactive session
 	g1.GET("/replay/:id", replayPage)
 
+	// the recording for the replay page, decrypted and decompressed
+	g1.GET("/records/:fname", getRec)
+
+	// download a recording for asciinema
+	g1.GET("/export/:fname", exportRec)
+
 	// delete a recording
 	g1.POST("/delete/:fname", delRec)
 	// Rename a recording
 	g1.POST("/rename/:oldname/:newname", renameRec)
+	// set the title and tags of a recording
+	g1.POST("/tag/:fname", tagRec)
+
+	options.Term.RecordDir = options.RecordDir
+	options.Term.RecordStarted = ownRecord
+	options.Term.RecordClosed = indexRecord
 
-	term_conn.Init()
+	// close the terminals of the client certificates revoked later
+	if clientCertEnabled() && options.ClientCert.CRL != "" {
+		options.Term.ConnValid = certValid
+	}
+	recStore = cmd.NewRecordStore(options.RecordDir)
+	options.Term.Logger = logger
+	term_conn.Init(&options.Term)
 	port := strconv.FormatUint(uint64(uint16(options.Port)), 10)
-	rt.RunTLS(":"+port, "./tls/cert.pem", "./tls/private-key.pem")
+	srv := &http.Server{
+		Handler: rt,
+	}
+
+	if clientCertEnabled() {
+		if options.Listen != ListenTLS {
+			fatal("Client certificates require the tls listener", nil)
+		}
+
+		conf, err := clientCertConfig()
+
+		if err != nil {
+			fatal("Failed to setup client certificate authentication", err)
+		}
+
+		srv.TLSConfig = conf
+	}
+
+	if err := serve(srv, port); err != nil {
+		logger.Error("Failed to start the server", "err", err)
+	}
 }
@@ -0,0 +1,384 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/contrib/sessions"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/syssecfsu/witty/cmd"
+)
+
+// serverStore keeps the session data on the server, the cookie only
+// has an opaque random ID. This allows us to list the active logins and
+// revoke them. Sessions are persisted to a file so logins survive restart.
+// Only the SHA256 of the ID is stored, so the file cannot be used to
+// hijack sessions. The sessions without a user, e.g., of the login page,
+// are only kept in memory, and there are at most maxAnonSessions of them.
+type serverStore struct {
+	fname   string
+	options gsessions.Options
+
+	mtx      sync.Mutex
+	sessions map[string]*storedSession // indexed by the hashed ID
+	pending  bool                      // a write is scheduled
+
+	writeMtx sync.Mutex // the writes of the file are in order
+}
+
+type storedSession struct {
+	User     string    `json:"User"`
+	Ip       string    `json:"Ip"`
+	Agent    string    `json:"Agent"`
+	Created  time.Time `json:"Created"`
+	LastSeen time.Time `json:"LastSeen"`
+	Values   []byte    `json:"Values"` // gob encoded session values
+}
+
+// ActiveLogin is a session with a logged in user, shown to administrators
+type ActiveLogin struct {
+	Id       string // the hashed session ID
+	User     string
+	Ip       string
+	Agent    string
+	Created  string
+	LastSeen string
+
+	created time.Time
+}
+
+const (
+	sessionCookie   = "witty-session"
+	lastSeenPeriod  = time.Minute
+	persistDelay    = time.Second // the changes in a second are written once
+	maxAnonSessions = 10000
+)
+
+func newServerStore(fname string) *serverStore {
+	s := &serverStore{
+		fname:    fname,
+		sessions: make(map[string]*storedSession),
+		options: gsessions.Options{
+			Path:     "/",
+			MaxAge:   int(options.SessionMaxAge.Seconds()),
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+
+	file, err := os.ReadFile(fname)
+
+	if err == nil {
+		if err = json.Unmarshal(file, &s.sessions); err != nil {
+			logger.Error("Failed to parse sessions file, start with no sessions", "file", fname, "err", err)
+			s.sessions = make(map[string]*storedSession)
+		}
+	} else if !os.IsNotExist(err) {
+		logger.Error("Failed to read sessions file", "file", fname, "err", err)
+	}
+
+	s.expire()
+	return s
+}
+
+func hashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// remove the expired sessions, must be called with mtx held
+func (s *serverStore) expire() {
+	now := time.Now()
+
+	for k, ss := range s.sessions {
+		maxAge := options.SessionMaxAge
+		if ss.User == "" {
+			maxAge = options.AnonMaxAge
+		}
+
+		if now.Sub(ss.LastSeen) > maxAge {
+			delete(s.sessions, k)
+		}
+	}
+}
+
+// remove the least recently seen sessions without a user until there is
+// room for a new one, must be called with mtx held
+func (s *serverStore) limitAnon() {
+	var anon []string
+
+	for k, ss := range s.sessions {
+		if ss.User == "" {
+			anon = append(anon, k)
+		}
+	}
+
+	if len(anon) < maxAnonSessions {
+		return
+	}
+
+	sort.Slice(anon, func(i, j int) bool {
+		return s.sessions[anon[i]].LastSeen.Before(s.sessions[anon[j]].LastSeen)
+	})
+
+	for _, k := range anon[:len(anon)-maxAnonSessions+1] {
+		delete(s.sessions, k)
+	}
+}
+
+// persist schedules writing the sessions, must be called with mtx held.
+// The logins removed, e.g., by logout or revoke, are written right away,
+// so that they do not come back after a restart
+func (s *serverStore) persist(now bool) {
+	if now {
+		go s.write()
+		return
+	}
+
+	if !s.pending {
+		s.pending = true
+		time.AfterFunc(persistDelay, s.write)
+	}
+}
+
+// write the sessions with a user to the file
+func (s *serverStore) write() {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	s.mtx.Lock()
+	s.pending = false
+	logins := make(map[string]*storedSession)
+
+	for k, ss := range s.sessions {
+		if ss.User != "" {
+			logins[k] = ss
+		}
+	}
+
+	data, err := json.Marshal(logins)
+	s.mtx.Unlock()
+
+	if err == nil {
+		err = cmd.AtomicWriteFile(s.fname, data, 0600)
+	}
+
+	if err != nil {
+		logger.Error("Failed to save sessions file", "err", err)
+	}
+}
+
+func (s *serverStore) Options(opts sessions.Options) {
+	s.options.Path = opts.Path
+	s.options.Domain = opts.Domain
+	s.options.MaxAge = opts.MaxAge
+	s.options.Secure = opts.Secure
+	s.options.HttpOnly = opts.HttpOnly
+}
+
+func (s *serverStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *serverStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ss, ok := s.sessions[hashID(cookie.Value)]
+
+	if !ok || time.Since(ss.LastSeen) > options.SessionMaxAge {
+		return session, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(ss.Values)).Decode(&session.Values); err != nil {
+		logger.Warn("Failed to decode session values", "err", err)
+		return session, nil
+	}
+
+	// avoid writing the file on every request
+	if time.Since(ss.LastSeen) > lastSeenPeriod {
+		ss.LastSeen = time.Now()
+
+		if ss.User != "" {
+			s.persist(false)
+		}
+	}
+
+	session.ID = cookie.Value
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// a negative MaxAge deletes the session
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			delete(s.sessions, hashID(session.ID))
+			s.persist(true)
+		}
+
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	key := ""
+	if session.ID != "" {
+		key = hashID(session.ID)
+	}
+
+	ss, ok := s.sessions[key]
+
+	// the session has been revoked while the request is processed,
+	// do not bring the login back
+	if !ok && session.ID != "" {
+		session.Values = make(map[interface{}]interface{})
+	}
+
+	user, _ := session.Values[userKey].(string)
+
+	// whether the session is in the file
+	persisted := ok && ss.User != ""
+
+	// use a new ID when the user logs in to prevent session fixation
+	if ok && user != "" && user != ss.User {
+		delete(s.sessions, key)
+		ok = false
+	}
+
+	var values bytes.Buffer
+	if err := gob.NewEncoder(&values).Encode(session.Values); err != nil {
+		return err
+	}
+
+	if !ok {
+		session.ID = uniuri.NewLen(43)
+		key = hashID(session.ID)
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		ss = &storedSession{
+			Ip:      ip,
+			Agent:   r.UserAgent(),
+			Created: time.Now(),
+		}
+
+		s.expire()
+
+		if user == "" {
+			s.limitAnon()
+		}
+
+		s.sessions[key] = ss
+	}
+
+	ss.User = user
+	ss.Values = values.Bytes()
+	ss.LastSeen = time.Now()
+
+	// a logout is written right away, the sessions without a user are
+	// not written at all
+	if persisted && user == "" {
+		s.persist(true)
+	} else if user != "" {
+		s.persist(false)
+	}
+
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// logins returns the sessions with a logged in user
+func (s *serverStore) logins() []ActiveLogin {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.expire()
+
+	var logins []ActiveLogin
+	for k, ss := range s.sessions {
+		if ss.User == "" {
+			continue
+		}
+
+		logins = append(logins, ActiveLogin{
+			Id:       k,
+			User:     ss.User,
+			Ip:       ss.Ip,
+			Agent:    ss.Agent,
+			Created:  ss.Created.Format("Jan/2/2006, 15:04:05"),
+			LastSeen: ss.LastSeen.Format("Jan/2/2006, 15:04:05"),
+			created:  ss.Created,
+		})
+	}
+
+	sort.Slice(logins, func(i, j int) bool {
+		if logins[i].User != logins[j].User {
+			return logins[i].User < logins[j].User
+		}
+
+		return logins[i].created.Before(logins[j].created)
+	})
+
+	return logins
+}
+
+// revoke deletes the session with the hashed ID
+func (s *serverStore) revoke(id string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.sessions[id]; !ok {
+		return false
+	}
+
+	delete(s.sessions, id)
+	s.persist(true)
+	return true
+}
+
+// revokeUser deletes all the sessions of the user, except the one with
+// the hashed ID except
+func (s *serverStore) revokeUser(user string, except string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	n := 0
+	for k, ss := range s.sessions {
+		if ss.User == user && k != except {
+			delete(s.sessions, k)
+			n++
+		}
+	}
+
+	if n > 0 {
+		s.persist(true)
+	}
+
+	return n
+}
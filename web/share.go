@@ -0,0 +1,283 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+	"github.com/syssecfsu/witty/term_conn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share links let people without an account watch one live session.
+// The token is signed with a per-process key, live sessions do not
+// survive a restart anyway. Links are also kept in memory so that they
+// can be revoked before they expire.
+type shareLink struct {
+	Id      string
+	Session string
+	Creator string
+	Expires time.Time
+	Passwd  []byte // bcrypt hash, nil if not password protected
+}
+
+const (
+	shareQuery     = "share"
+	unlockKey      = "share_unlocked"
+	guestLabel     = "guest via link"
+	shareDefMinute = 60
+	shareMaxMinute = 24 * 60
+)
+
+var (
+	shareKey = []byte(uniuri.NewLen(32))
+
+	shareMtx sync.Mutex
+	shares   = make(map[string]*shareLink)
+)
+
+func shareSign(id string, session string, exp string) string {
+	mac := hmac.New(sha256.New, shareKey)
+	mac.Write([]byte(id + "|" + session + "|" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// the token of the link, it is signed for the session and the expiry
+func (link *shareLink) token() string {
+	exp := strconv.FormatInt(link.Expires.Unix(), 10)
+	return link.Id + "." + exp + "." + shareSign(link.Id, link.Session, exp)
+}
+
+// validShare returns the link if the token is valid for the session
+func validShare(tok string, session string) *shareLink {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	sig := shareSign(parts[0], session, parts[1])
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return nil
+	}
+
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return nil
+	}
+
+	shareMtx.Lock()
+	defer shareMtx.Unlock()
+
+	link, ok := shares[parts[0]]
+	if !ok || link.Session != session {
+		return nil
+	}
+
+	return link
+}
+
+// remove the expired links, must be called with shareMtx held
+func expireShares() {
+	now := time.Now()
+
+	for k, link := range shares {
+		if now.After(link.Expires) {
+			delete(shares, k)
+		}
+	}
+}
+
+// the user of the live session, replaced by the tests
+var sessionOwner = term_conn.SessionUser
+
+// create a share link for the session, returns the link in JSON. Only
+// the user of the session and the administrators can share it
+func createShare(c *gin.Context) {
+	id := c.Param("id")
+
+	owner, ok := sessionOwner(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if owner != sessionUser(c) && !isAdmin(c) {
+		reqLog(c).Warn("Refuse to share the session of another user", "session", id, "owner", owner)
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner of the session can share it"})
+		return
+	}
+
+	minutes := shareDefMinute
+	if m := c.PostForm("minutes"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n <= 0 || n > shareMaxMinute {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "minutes must be between 1 and " + strconv.Itoa(shareMaxMinute),
+			})
+			return
+		}
+
+		minutes = n
+	}
+
+	link := &shareLink{
+		Id:      uniuri.New(),
+		Session: id,
+		Creator: sessionUser(c),
+		Expires: time.Now().Add(time.Duration(minutes) * time.Minute),
+	}
+
+	if passwd := c.PostForm("passwd"); passwd != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash the password"})
+			return
+		}
+
+		link.Passwd = hash
+	}
+
+	tok := link.token()
+
+	shareMtx.Lock()
+	expireShares()
+	shares[link.Id] = link
+	shareMtx.Unlock()
+
+	reqLog(c).Info("Shared session", "session", id, "until", link.Expires)
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":     "/view/" + id + "?" + shareQuery + "=" + tok,
+		"expires": link.Expires.Format(time.RFC3339),
+	})
+}
+
+// revoke all the share links of the session, guests are disconnected
+func revokeShares(c *gin.Context) {
+	id := c.Param("id")
+	n := 0
+
+	shareMtx.Lock()
+	for k, link := range shares {
+		if link.Session == id {
+			delete(shares, k)
+			n++
+		}
+	}
+	shareMtx.Unlock()
+
+	reqLog(c).Info("Revoked share links", "session", id, "links", n)
+	c.JSON(http.StatusOK, gin.H{"revoked": n})
+}
+
+// shareLinks returns how many share links the session has
+func shareLinks(id string) int {
+	shareMtx.Lock()
+	defer shareMtx.Unlock()
+
+	n := 0
+	for _, link := range shares {
+		if link.Session == id && time.Now().Before(link.Expires) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// unlock a password protected share link
+func unlockShare(c *gin.Context) {
+	id := c.PostForm("id")
+	tok := c.PostForm("token")
+	link := validShare(tok, id)
+
+	if link == nil {
+		c.String(http.StatusForbidden, "Invalid or expired share link")
+		return
+	}
+
+	target := "/view/" + id + "?" + shareQuery + "=" + tok
+
+	if bcrypt.CompareHashAndPassword(link.Passwd, []byte(c.PostForm("passwd"))) != nil {
+		reqLog(c).Warn("Wrong password for share link", "session", id)
+		leftMsg(c, loginKey, "Wrong password")
+		c.Redirect(http.StatusSeeOther, target)
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set(unlockKey, link.Id)
+	session.Save()
+
+	c.Redirect(http.StatusSeeOther, target)
+}
+
+// ViewAuth lets a valid share link view its session without logging in,
+// other requests must pass AuthRequired
+func ViewAuth(c *gin.Context) {
+	tok := c.Query(shareQuery)
+
+	if tok == "" {
+		if !options.NoAuth {
+			AuthRequired(c)
+		}
+
+		return
+	}
+
+	id := c.Param("id")
+	link := validShare(tok, id)
+
+	if link == nil {
+		c.String(http.StatusForbidden, "Invalid or expired share link")
+		c.Abort()
+		return
+	}
+
+	if link.Passwd != nil && sessions.Default(c).Get(unlockKey) != link.Id {
+		if strings.HasPrefix(c.Request.URL.Path, "/ws_view/") {
+			c.String(http.StatusForbidden, "Share link is locked")
+			c.Abort()
+			return
+		}
+
+		c.HTML(http.StatusOK, "share.html", gin.H{
+			"id":        id,
+			"token":     tok,
+			"msg":       takeMsg(c, loginKey),
+			"csrfField": csrf.TemplateField(c.Request),
+		})
+		c.Abort()
+		return
+	}
+
+	c.Set(shareQuery, link)
+	c.Next()
+}
+
+// the share link used by this request, nil for normal users
+func guestLink(c *gin.Context) *shareLink {
+	if v, ok := c.Get(shareQuery); ok {
+		return v.(*shareLink)
+	}
+
+	return nil
+}
+
+// whether the share link is still valid, used to disconnect guests
+func (link *shareLink) valid() bool {
+	shareMtx.Lock()
+	defer shareMtx.Unlock()
+
+	_, ok := shares[link.Id]
+	return ok && time.Now().Before(link.Expires)
+}
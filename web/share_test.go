@@ -0,0 +1,214 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/syssecfsu/witty/term_conn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// a router with the session store in a temporary directory
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	// the store may still be writing the sessions when the test ends
+	dir, err := os.MkdirTemp("", "witty-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	options.SessionFile = filepath.Join(dir, "sessions.db")
+	options.SessionMaxAge = time.Hour
+	sessStore = newServerStore(options.SessionFile)
+
+	rt := gin.New()
+	rt.Use(sessions.Sessions("witty-session", sessStore))
+	return rt
+}
+
+// register a link of the session, valid for d
+func addShare(session string, d time.Duration) *shareLink {
+	link := &shareLink{Id: strconv.Itoa(len(shares) + 1), Session: session, Creator: "alice", Expires: time.Now().Add(d)}
+
+	shareMtx.Lock()
+	shares[link.Id] = link
+	shareMtx.Unlock()
+
+	return link
+}
+
+func viewShared(rt *gin.Engine, session string, tok string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ws_view/"+session+"?"+shareQuery+"="+tok, nil))
+	return w
+}
+
+func TestShareToken(t *testing.T) {
+	shares = make(map[string]*shareLink)
+
+	rt := newTestRouter(t)
+	rt.GET("/ws_view/:id", ViewAuth, func(c *gin.Context) {
+		c.String(http.StatusOK, logUser(c))
+	})
+
+	link := addShare("s1", time.Hour)
+	tok := link.token()
+	parts := strings.Split(tok, ".")
+
+	if w := viewShared(rt, "s1", tok); w.Code != http.StatusOK || w.Body.String() != guestLabel {
+		t.Fatalf("got %d %s, expect the guest", w.Code, w.Body)
+	}
+
+	later := strconv.FormatInt(link.Expires.Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name    string
+		session string
+		tok     string
+	}{
+		{"other session", "s2", tok},
+		{"extended", "s1", parts[0] + "." + later + "." + parts[2]},
+		{"signature", "s1", parts[0] + "." + parts[1] + "." + shareSign(parts[0], "s2", parts[1])},
+		{"malformed", "s1", parts[0] + "." + parts[1]},
+		{"not registered", "s1", (&shareLink{Id: "x", Session: "s1", Expires: link.Expires}).token()},
+	}
+
+	for _, tt := range tests {
+		if w := viewShared(rt, tt.session, tt.tok); w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, expect 403", tt.name, w.Code)
+		}
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	shares = make(map[string]*shareLink)
+
+	rt := newTestRouter(t)
+	rt.GET("/ws_view/:id", ViewAuth, func(c *gin.Context) {})
+
+	expired := addShare("s1", -time.Minute)
+	live := addShare("s1", time.Hour)
+
+	if w := viewShared(rt, "s1", expired.token()); w.Code != http.StatusForbidden {
+		t.Errorf("got %d, expect 403 for the expired link", w.Code)
+	}
+
+	if expired.valid() || !live.valid() {
+		t.Errorf("got %v and %v, expect only the live link valid", expired.valid(), live.valid())
+	}
+
+	if n := shareLinks("s1"); n != 1 {
+		t.Errorf("got %d links, expect 1", n)
+	}
+
+	shareMtx.Lock()
+	expireShares()
+	_, ok := shares[expired.Id]
+	shareMtx.Unlock()
+
+	if ok {
+		t.Error("the expired link was not removed")
+	}
+}
+
+func TestShareRevoke(t *testing.T) {
+	shares = make(map[string]*shareLink)
+
+	rt := newTestRouter(t)
+	rt.GET("/ws_view/:id", ViewAuth, func(c *gin.Context) {})
+	rt.POST("/share/:id/revoke", revokeShares)
+
+	a, b := addShare("s1", time.Hour), addShare("s1", time.Hour)
+	other := addShare("s2", time.Hour)
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/share/s1/revoke", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != `{"revoked":2}` {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+
+	// the viewers are dropped when the link is no longer valid
+	if a.valid() || b.valid() || !other.valid() {
+		t.Error("expect only the links of s1 revoked")
+	}
+
+	if w := viewShared(rt, "s1", a.token()); w.Code != http.StatusForbidden {
+		t.Errorf("got %d, expect 403 for the revoked link", w.Code)
+	}
+
+	if w := viewShared(rt, "s2", other.token()); w.Code != http.StatusOK {
+		t.Errorf("got %d, expect 200 for the link of s2", w.Code)
+	}
+}
+
+func TestShareLocked(t *testing.T) {
+	shares = make(map[string]*shareLink)
+
+	rt := newTestRouter(t)
+	rt.GET("/ws_view/:id", ViewAuth, func(c *gin.Context) {})
+
+	link := addShare("s1", time.Hour)
+	link.Passwd, _ = bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	w := viewShared(rt, "s1", link.token())
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "locked") {
+		t.Errorf("got %d %s, expect the link locked", w.Code, w.Body)
+	}
+}
+
+func TestShareOwner(t *testing.T) {
+	shares = make(map[string]*shareLink)
+	defer func() { sessionOwner = term_conn.SessionUser }()
+	sessionOwner = func(id string) (string, bool) { return "alice", id == "s1" }
+
+	rt := newTestRouter(t)
+	rt.Use(func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Set(userKey, c.GetHeader("X-User"))
+		session.Set(roleKey, c.GetHeader("X-Role"))
+	})
+	rt.POST("/share/:id", createShare)
+
+	share := func(id string, user string, role string) int {
+		req := httptest.NewRequest(http.MethodPost, "/share/"+id, nil)
+		req.Header.Set("X-User", user)
+		req.Header.Set("X-Role", role)
+
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := share("s1", "bob", roleUser); code != http.StatusForbidden {
+		t.Errorf("another user: got %d, expect 403", code)
+	}
+
+	if len(shares) != 0 {
+		t.Fatal("the link of another user is created")
+	}
+
+	if code := share("s1", "alice", roleUser); code != http.StatusOK {
+		t.Errorf("the owner: got %d, expect 200", code)
+	}
+
+	if code := share("s1", "root1", roleAdmin); code != http.StatusOK {
+		t.Errorf("the admin: got %d, expect 200", code)
+	}
+
+	if code := share("s2", "alice", roleUser); code != http.StatusNotFound {
+		t.Errorf("no session: got %d, expect 404", code)
+	}
+}